@@ -0,0 +1,240 @@
+package main
+
+import (
+	"socks5"
+
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serveAdmin http_server 上的管理接口, 请求需携带 Authorization: Bearer <http_token>
+//
+//	GET    /routes                         路由列表
+//	POST   /routes {"in":..,"out":..}      新增路由
+//	PUT    /routes {"in":..,"out":..}      修改路由的出口地址
+//	DELETE /routes?in=..&drain=秒          删除路由, drain内已建立的连接继续转发
+//	GET    /sessions?user=&route=&dest=&client=  正在转发的连接
+//	DELETE /sessions?id=.. 或过滤条件      关闭连接的两端
+//	GET    /clients                        模式0服务端接入的内网客户端
+//
+// 路由的修改立即生效并写回配置文件
+func serveAdmin(addr, token string) {
+	if token == "" {
+		log.Error("[admin] http_token not set, admin api disabled")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", routesHandler)
+	mux.HandleFunc("/sessions", sessionsHandler)
+	mux.HandleFunc("/clients", clientsHandler)
+	log.Info("[admin] listen at ", addr)
+	log.Error("[admin] serve err: ", http.ListenAndServe(addr, adminAuth(token, mux)))
+}
+
+// adminAuth 校验Bearer token, 缺少Bearer前缀的请求被拒绝
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, got, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("<unauthorized>"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeBody 路由的json表示
+type routeBody struct {
+	In         string `json:"in"`
+	Out        string `json:"out"`
+	Client     string `json:"client,omitempty"`
+	Registered bool   `json:"registered,omitempty"` // 由客户端注册, 不能修改
+}
+
+func routesHandler(w http.ResponseWriter, r *http.Request) {
+	// 与配置热加载互斥, 避免重新加载读到写回之前的路由
+	if r.Method != http.MethodGet {
+		configMu.Lock()
+		defer configMu.Unlock()
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]routeBody, 0)
+		for _, rt := range routes.list() {
+			list = append(list, routeBody{In: rt.In, Out: rt.Out, Client: rt.Client, Registered: rt.Registered})
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case http.MethodPost, http.MethodPut:
+		var body routeBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if body.In == "" || body.Out == "" {
+			writeError(w, http.StatusBadRequest, errors.New("<in and out are required>"))
+			return
+		}
+		rt := route{In: body.In, Out: body.Out, Client: body.Client}
+		status := http.StatusOK
+		var err error
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+			err = routes.add(rt)
+		} else {
+			err = routes.update(rt)
+		}
+		if err != nil {
+			writeError(w, routeErrorStatus(err), err)
+			return
+		}
+		log.Info("[admin] ", r.Method, " route ", body.In, " -> ", body.Out)
+		saveRoutes(w, status, body)
+
+	case http.MethodDelete:
+		in := r.URL.Query().Get("in")
+		var drain time.Duration
+		if s := r.URL.Query().Get("drain"); s != "" {
+			secs, err := strconv.ParseFloat(s, 64)
+			if err != nil || secs < 0 {
+				writeError(w, http.StatusBadRequest, errors.New("<drain must be a non-negative number of seconds>"))
+				return
+			}
+			drain = time.Duration(secs * float64(time.Second))
+		}
+		active, err := routes.remove(in, drain)
+		if err != nil {
+			writeError(w, routeErrorStatus(err), err)
+			return
+		}
+		log.Info("[admin] DELETE route ", in, ", ", active, " active connections, drain ", drain)
+		saveRoutes(w, http.StatusOK, map[string]interface{}{"in": in, "active": active})
+
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("<method not allowed>"))
+	}
+}
+
+// sessionFilter 会话过滤条件, user/route精确匹配, dest/client为子串匹配
+func sessionFilter(q url.Values) (match func(socks5.SessionInfo) bool, ok bool) {
+	user, routeName, dest, client := q.Get("user"), q.Get("route"), q.Get("dest"), q.Get("client")
+	match = func(s socks5.SessionInfo) bool {
+		return (user == "" || s.User == user) &&
+			(routeName == "" || s.Route == routeName) &&
+			(dest == "" || strings.Contains(s.Dest, dest)) &&
+			(client == "" || strings.Contains(s.Client, client))
+	}
+	return match, user != "" || routeName != "" || dest != "" || client != ""
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	match, filtered := sessionFilter(q)
+	if id := q.Get("id"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("<invalid id>"))
+			return
+		}
+		match, filtered = func(s socks5.SessionInfo) bool { return s.ID == n }, true
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, socks5.Sessions.List(match))
+
+	case http.MethodDelete:
+		// 不允许无条件关闭全部连接
+		if !filtered {
+			writeError(w, http.StatusBadRequest, errors.New("<id or filter required>"))
+			return
+		}
+		killed := make([]uint64, 0)
+		for _, s := range socks5.Sessions.List(match) {
+			if socks5.Sessions.Kill(s.ID) {
+				killed = append(killed, s.ID)
+			}
+		}
+		if q.Get("id") != "" && len(killed) == 0 {
+			writeError(w, http.StatusNotFound, errors.New("<session not found>"))
+			return
+		}
+		log.Info("[admin] kill sessions ", killed)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"killed": killed})
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("<method not allowed>"))
+	}
+}
+
+// clientBody 内网客户端的json表示
+type clientBody struct {
+	ID     string    `json:"id"`
+	Remote string    `json:"remote"`
+	Since  time.Time `json:"since"`
+	Routes []string  `json:"routes"`
+}
+
+func clientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, errors.New("<method not allowed>"))
+		return
+	}
+	rts := routes.list()
+	list := make([]clientBody, 0)
+	for _, a := range listAgents() {
+		c := clientBody{ID: a.ID, Remote: a.Remote, Since: a.Since, Routes: make([]string, 0)}
+		for _, rt := range rts {
+			if rt.Client == a.ID {
+				c.Routes = append(c.Routes, rt.In)
+			}
+		}
+		list = append(list, c)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// saveRoutes 写回配置文件后响应, 写入失败时修改仍然生效
+func saveRoutes(w http.ResponseWriter, status int, v interface{}) {
+	if err := routes.save(); err != nil {
+		log.Error("[admin] save config err: ", err)
+		writeError(w, http.StatusInternalServerError, errors.New("<applied but not persisted> "+err.Error()))
+		return
+	}
+	writeJSON(w, status, v)
+}
+
+func routeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errRouteExists), errors.Is(err, errRouteRegistered):
+		return http.StatusConflict
+	case errors.Is(err, errRouteNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
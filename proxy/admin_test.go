@@ -0,0 +1,264 @@
+package main
+
+import (
+	"socks5"
+
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestSessionsHandler 会话接口: 按条件列出与关闭, 关闭须指定id或过滤条件
+func TestSessionsHandler(t *testing.T) {
+	const user = "TestSessionsHandler"
+	done := make(map[string]chan struct{})
+	for _, dest := range []string{"a.example:443", "b.example:443"} {
+		client, clientPeer := net.Pipe()
+		target, targetPeer := net.Pipe()
+		defer clientPeer.Close()
+		defer targetPeer.Close()
+		go io.Copy(io.Discard, targetPeer)
+		ch := make(chan struct{})
+		done[dest] = ch
+		go func(sess *socks5.Session) {
+			defer close(ch)
+			socks5.ProxySession(sess, client, target)
+		}(&socks5.Session{User: user, Client: dest + "-client", Dest: dest})
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(sessionsHandler))
+	defer srv.Close()
+	do := func(method, query string, v interface{}) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+"/sessions?"+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	list := func() (l []socks5.SessionInfo) {
+		do(http.MethodGet, "user="+user, &l)
+		return
+	}
+	for deadline := time.Now().Add(2 * time.Second); len(list()) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var l []socks5.SessionInfo
+	if do(http.MethodGet, "user="+user+"&dest=b.example", &l); len(l) != 1 || l[0].Dest != "b.example:443" {
+		t.Errorf("filtered list = %+v", l)
+	}
+	if code := do(http.MethodDelete, "", nil); code != http.StatusBadRequest {
+		t.Errorf("delete without filter: status %d", code)
+	}
+	if code := do(http.MethodDelete, "id=x", nil); code != http.StatusBadRequest {
+		t.Errorf("delete invalid id: status %d", code)
+	}
+	if code := do(http.MethodDelete, "id=18446744073709551615", nil); code != http.StatusNotFound {
+		t.Errorf("delete unknown id: status %d", code)
+	}
+
+	var killed struct{ Killed []uint64 }
+	if code := do(http.MethodDelete, "user="+user+"&dest=a.example", &killed); code != http.StatusOK || len(killed.Killed) != 1 {
+		t.Fatalf("delete by filter: status %d, killed %v", code, killed.Killed)
+	}
+	select {
+	case <-done["a.example:443"]:
+	case <-time.After(2 * time.Second):
+		t.Fatal("killed session still proxying")
+	}
+	if l := list(); len(l) != 1 || l[0].Dest != "b.example:443" {
+		t.Errorf("list after kill = %+v", l)
+	}
+	if code := do(http.MethodDelete, "user="+user, &killed); code != http.StatusOK || len(killed.Killed) != 1 {
+		t.Errorf("delete remaining: status %d, killed %v", code, killed.Killed)
+	}
+	<-done["b.example:443"]
+}
+
+// TestAdminAuth 只接受带Bearer前缀且token正确的请求
+func TestAdminAuth(t *testing.T) {
+	h := adminAuth("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"Bearer secret", http.StatusNoContent},
+		{"bearer secret", http.StatusNoContent},
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret2", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/routes", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("Authorization %q: status %d, want %d", tt.header, rec.Code, tt.status)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Authorization %q: missing WWW-Authenticate", tt.header)
+		}
+	}
+}
+
+// TestRoutesHandler 路由的增删改立即生效并写回配置文件, 删除时drain内已建立的连接继续保持
+func TestRoutesHandler(t *testing.T) {
+	dir := t.TempDir()
+	a, b := "unix:"+filepath.Join(dir, "a.sock"), "unix:"+filepath.Join(dir, "b.sock")
+	path := filepath.Join(dir, "server.json")
+	config := `{"http_token": "tok", "proxy_router": [{"in": "` + a + `", "out": "10.0.0.1:22"}]}`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 连接保持到被关闭
+	hold := func(conn net.Conn, routeName, remoteAddr string) {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+	old := routes
+	routes = testRoutes(t, route{In: a, Out: "10.0.0.1:22"})
+	t.Cleanup(func() { routes = old })
+	routes.attach("", hold)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", routesHandler)
+	srv := httptest.NewServer(adminAuth("tok", mux))
+	defer srv.Close()
+	do := func(method, query, body string) (int, map[string]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+"/routes"+query, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer tok")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var v map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&v)
+		return resp.StatusCode, v
+	}
+	// saved 配置文件中的proxy_router
+	saved := func() []route {
+		t.Helper()
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			t.Fatal(err)
+		}
+		if v.GetString("http_token") != "tok" {
+			t.Error("other config keys lost on save")
+		}
+		var r []route
+		for _, item := range v.Get("proxy_router").([]interface{}) {
+			m := item.(map[string]interface{})
+			r = append(r, route{In: m["in"].(string), Out: m["out"].(string)})
+		}
+		return r
+	}
+
+	resp, err := http.Get(srv.URL + "/routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without token: status %d", resp.StatusCode)
+	}
+
+	if code, _ := do(http.MethodPost, "", `{"in": "`+b+`", "out": "10.0.0.2:80"}`); code != http.StatusCreated {
+		t.Fatalf("POST status %d", code)
+	}
+	if !routes.listening(b) {
+		t.Error("added route not listening")
+	}
+	if code, _ := do(http.MethodPost, "", `{"in": "`+b+`", "out": "10.0.0.2:80"}`); code != http.StatusConflict {
+		t.Errorf("POST existing: status %d", code)
+	}
+	if code, _ := do(http.MethodPost, "", `{"in": "`+b+`"}`); code != http.StatusBadRequest {
+		t.Errorf("POST without out: status %d", code)
+	}
+	if code, _ := do(http.MethodPut, "", `{"in": "`+b+`", "out": "10.0.0.3:80"}`); code != http.StatusOK {
+		t.Errorf("PUT status %d", code)
+	}
+	if code, _ := do(http.MethodPut, "", `{"in": "unix:/missing.sock", "out": "10.0.0.3:80"}`); code != http.StatusNotFound {
+		t.Errorf("PUT unknown: status %d", code)
+	}
+	want := []route{{In: a, Out: "10.0.0.1:22"}, {In: b, Out: "10.0.0.3:80"}}
+	if got := saved(); !reflect.DeepEqual(got, want) {
+		t.Errorf("saved %+v, want %+v", got, want)
+	}
+
+	// drain内已建立的连接继续保持, 之后关闭
+	conn, err := socks5.DialAddr(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for deadline := time.Now().Add(2 * time.Second); routes.active() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not tracked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if code, _ := do(http.MethodDelete, "?in="+a+"&drain=x", ""); code != http.StatusBadRequest {
+		t.Errorf("DELETE invalid drain: status %d", code)
+	}
+	code, body := do(http.MethodDelete, "?in="+a+"&drain=0.5", "")
+	if code != http.StatusOK || body["active"] != float64(1) {
+		t.Fatalf("DELETE status %d, body %v", code, body)
+	}
+	if routes.listening(a) {
+		t.Error("deleted route still listening")
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !os.IsTimeout(err) {
+		t.Errorf("connection closed before drain: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection after drain: %v", err)
+	}
+	if code, _ := do(http.MethodDelete, "?in="+a, ""); code != http.StatusNotFound {
+		t.Errorf("DELETE unknown: status %d", code)
+	}
+	if got := saved(); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("saved %+v after delete, want %+v", got, want[1:])
+	}
+}
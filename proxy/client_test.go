@@ -0,0 +1,82 @@
+package main
+
+import (
+	"socks5/protocol"
+
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestBackoffReset 握手成功后退避从initial重新开始, 连续重连次数也重新计算
+func TestBackoffReset(t *testing.T) {
+	b := &backoff{config: reconnectPolicy{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2, MaxRetries: 3}}
+	failed := errors.New("dial failed")
+	steps := []struct {
+		err   error
+		delay time.Duration
+		ok    bool
+	}{
+		{failed, time.Second, true},
+		{failed, 2 * time.Second, true},
+		{nil, time.Second, true}, // 握手成功, 重置
+		{failed, 2 * time.Second, true},
+		{failed, 4 * time.Second, true},
+		{failed, 0, false}, // 连续3次失败后放弃
+		{nil, time.Second, true},
+	}
+	for i, s := range steps {
+		delay, ok := b.after(s.err)
+		if delay != s.delay || ok != s.ok {
+			t.Errorf("step %d: after(%v) = %v, %v; want %v, %v", i, s.err, delay, ok, s.delay, s.ok)
+		}
+	}
+}
+
+// TestReconnectConfig initial与max均以秒为单位, 可以是小数
+func TestReconnectConfig(t *testing.T) {
+	loadConfig(t, `{"reconnect": {"initial": 0.5, "max": 1.5, "multiplier": 3, "max_retries": 4}}`)
+	got := reconnectConfig()
+	want := reconnectPolicy{Initial: 500 * time.Millisecond, Max: 1500 * time.Millisecond, Multiplier: 3, Jitter: 0.2, MaxRetries: 4}
+	if got != want {
+		t.Errorf("reconnect %+v, want %+v", got, want)
+	}
+	loadConfig(t, `{"reconnect": {"max": 30}}`)
+	if got := reconnectConfig(); got.Max != 30*time.Second || got.Initial != time.Second {
+		t.Errorf("reconnect %+v", got)
+	}
+}
+
+// TestClientConnHandshake 服务端未完成握手即断开时clientConn返回错误, 不重置退避
+func TestClientConnHandshake(t *testing.T) {
+	name := memName(t)
+	loadConfig(t, fmt.Sprintf(`{"proxy_mode": 1, "proxy_server": %q}`, name))
+	baseConfig()
+	s5.ConnConfig = &protocol.MemConfig{}
+	t.Cleanup(func() { routes.load(nil) })
+
+	lis := protocol.New(s5.ConnConfig)
+	if err := lis.Listen(name); err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- clientConn() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("clientConn returned nil without hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clientConn did not return")
+	}
+}
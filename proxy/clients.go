@@ -0,0 +1,333 @@
+package main
+
+import (
+	"socks5/protocol"
+
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+模式0: 多个内网客户端接入同一个公网服务端
+隧道建立后内网客户端先发送hello
+	+------+-----+-----------+
+	| 0x02 | LEN | CLIENT_ID |
+	+------+-----+-----------+
+	|    1 |   1 |       LEN |
+	+------+-----+-----------+
+未设置 client_id 时只发送 0x01, 与之前的版本相同. 设置了 client_secret 时发送带认证的hello
+	+------+-----+-----------+-----------+-------+-----+
+	| 0x03 | LEN | CLIENT_ID | TIMESTAMP | NONCE | MAC |
+	+------+-----+-----------+-----------+-------+-----+
+	|    1 |   1 |       LEN |         8 |    16 |  32 |
+	+------+-----+-----------+-----------+-------+-----+
+TIMESTAMP为unix纳秒, MAC = HMAC-SHA256(client_secret, 之前的全部字节).
+服务端按标识登记客户端并开启 proxy_router 中属于该客户端的路由(client项), 客户端断开时只关闭自己的监听.
+服务端 clients 中配置了密钥的标识必须以该密钥认证, 时间戳与服务端相差超过helloWindow或nonce重复时拒绝.
+同一标识的新隧道替换旧隧道(内网客户端重启后重新连接); 未认证的新隧道不能替换已认证的旧隧道, 来自同一地址时也拒绝.
+服务端拒绝客户端时发送原因后关闭隧道, smux帧的首字节为版本号(1或2), 不会与0xFF混淆
+	+------+-----+--------+
+	| 0xFF | LEN | REASON |
+	+------+-----+--------+
+	|    1 |   1 |    LEN |
+	+------+-----+--------+
+*/
+
+const (
+	helloPing   byte = 0x01 // 不带标识
+	helloID     byte = 0x02 // 带标识
+	helloAuth   byte = 0x03 // 带标识与认证
+	helloReject byte = 0xff // 服务端拒绝, 之后为原因
+
+	maxClientIDLen = 255
+	helloTimeout   = time.Second * 10
+
+	helloNonceSize = 16
+	helloAuthSize  = 8 + helloNonceSize + sha256.Size
+	helloWindow    = time.Minute // 允许的时钟偏差, 也是nonce的保存时间
+	helloSeenLimit = 4096        // 保存的nonce数量上限
+)
+
+var (
+	errClientAuth   = errors.New("<client authentication failed>")
+	errClientInUse  = errors.New("<client id already connected>")
+	errHelloReplay  = errors.New("<hello replayed>")
+	errHelloExpired = errors.New("<hello timestamp out of window>")
+)
+
+// hello 客户端标识及认证数据
+type hello struct {
+	id   string
+	auth []byte // helloAuth的 TIMESTAMP|NONCE|MAC, 未认证时为nil
+}
+
+// helloMAC 认证hello的MAC, msg为MAC之前的全部字节
+func helloMAC(secret string, msg []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// writeHello 发送hello, id为空时只发送 0x01, secret不为空时发送带认证的hello
+func writeHello(conn io.Writer, id, secret string) error {
+	if id == "" {
+		_, err := conn.Write([]byte{helloPing})
+		return err
+	}
+	if len(id) > maxClientIDLen {
+		return fmt.Errorf("<client id longer than %d>", maxClientIDLen)
+	}
+	if secret == "" {
+		buf := append([]byte{helloID, byte(len(id))}, id...)
+		_, err := conn.Write(buf)
+		return err
+	}
+	buf := append([]byte{helloAuth, byte(len(id))}, id...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(time.Now().UnixNano()))
+	nonce := make([]byte, helloNonceSize)
+	rand.Read(nonce)
+	buf = append(buf, nonce...)
+	buf = append(buf, helloMAC(secret, buf)...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// readHello 读取hello, 不校验认证数据
+func readHello(conn io.Reader) (h hello, err error) {
+	buf := make([]byte, 2+maxClientIDLen+helloAuthSize)
+	if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+		return
+	}
+	switch buf[0] {
+	case helloPing:
+		return
+	case helloID, helloAuth:
+		if _, err = io.ReadFull(conn, buf[1:2]); err != nil {
+			return
+		}
+		n := 2 + int(buf[1])
+		if buf[0] == helloAuth {
+			n += helloAuthSize
+		}
+		if _, err = io.ReadFull(conn, buf[2:n]); err != nil {
+			return
+		}
+		h.id = string(buf[2 : 2+int(buf[1])])
+		if buf[0] == helloAuth {
+			// MAC覆盖类型与长度字节
+			h.auth = buf[:n]
+		}
+		return
+	}
+	return h, errors.New("<unknown hello>")
+}
+
+// writeReject 向客户端发送拒绝原因, 只发送错误类别, 不泄露其他客户端的信息
+func writeReject(conn io.Writer, err error) error {
+	reason := "<client rejected>"
+	for _, e := range []error{errClientAuth, errClientInUse, errHelloReplay, errHelloExpired} {
+		if errors.Is(err, e) {
+			reason = e.Error()
+			break
+		}
+	}
+	_, err = conn.Write(append([]byte{helloReject, byte(len(reason))}, reason...))
+	return err
+}
+
+// rejectReader 客户端发送hello后检查服务端的首个字节, 为拒绝时读取原因并返回错误, 否则原样交给smux
+type rejectReader struct {
+	io.ReadWriteCloser
+	mu      sync.Mutex
+	checked bool
+	err     error
+}
+
+func (r *rejectReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	checked := r.checked
+	r.checked = true
+	r.mu.Unlock()
+	if checked || len(p) == 0 {
+		return r.ReadWriteCloser.Read(p)
+	}
+
+	if _, err := io.ReadFull(r.ReadWriteCloser, p[:1]); err != nil {
+		return 0, err
+	}
+	if p[0] != helloReject {
+		return 1, nil
+	}
+	buf := make([]byte, 1+255)
+	err := errors.New("<rejected by server>")
+	if _, e := io.ReadFull(r.ReadWriteCloser, buf[:1]); e == nil {
+		if _, e := io.ReadFull(r.ReadWriteCloser, buf[1:1+int(buf[0])]); e == nil {
+			err = fmt.Errorf("<rejected by server> %s", buf[1:1+int(buf[0])])
+		}
+	}
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+	return 0, err
+}
+
+// rejected 服务端发送的拒绝, 未被拒绝时为nil
+func (r *rejectReader) rejected() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// helloSeen 认证hello使用过的nonce, 防止重放
+var (
+	helloSeenMu sync.Mutex
+	helloSeen   = make(map[[helloNonceSize]byte]time.Time) // nonce -> 过期时间
+)
+
+// authenticate 校验hello, 返回认证使用的密钥; 标识未配置密钥时按未认证处理, 返回空
+func authenticate(h hello, now time.Time) (string, error) {
+	secret, ok := currentClientSecrets()[h.id]
+	if !ok {
+		if h.auth != nil {
+			return "", fmt.Errorf("<client %s has no secret on server> %w", h.id, errClientAuth)
+		}
+		return "", nil
+	}
+	if h.auth == nil {
+		return "", fmt.Errorf("<client %s sent no credential> %w", h.id, errClientAuth)
+	}
+	msg, tag := h.auth[:len(h.auth)-sha256.Size], h.auth[len(h.auth)-sha256.Size:]
+	if !hmac.Equal(tag, helloMAC(secret, msg)) {
+		return "", fmt.Errorf("<client %s bad mac> %w", h.id, errClientAuth)
+	}
+	auth := msg[len(msg)-8-helloNonceSize:]
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(auth[:8])))
+	if d := now.Sub(ts); d > helloWindow || d < -helloWindow {
+		return "", errHelloExpired
+	}
+	var nonce [helloNonceSize]byte
+	copy(nonce[:], auth[8:])
+
+	helloSeenMu.Lock()
+	defer helloSeenMu.Unlock()
+	if _, ok := helloSeen[nonce]; ok {
+		return "", errHelloReplay
+	}
+	if len(helloSeen) >= helloSeenLimit {
+		for k, expire := range helloSeen {
+			if now.After(expire) {
+				delete(helloSeen, k)
+			}
+		}
+		if len(helloSeen) >= helloSeenLimit {
+			return "", errHelloReplay
+		}
+	}
+	// 时间戳在窗口内的hello可能在2*helloWindow内重放
+	helloSeen[nonce] = now.Add(2 * helloWindow)
+	return secret, nil
+}
+
+// agent 模式0下接入的内网客户端
+type agent struct {
+	ID     string
+	Remote string
+	Since  time.Time
+	secret string // 认证使用的密钥, 未认证时为空
+	die    chan struct{}
+}
+
+var (
+	agentsMu sync.Mutex
+	agents   = make(map[string]*agent)
+)
+
+// registerAgent 登记客户端并关闭同一标识的旧隧道, 未认证时不替换已认证或来自同一地址的旧隧道
+func registerAgent(id, remote, secret string) (*agent, error) {
+	a := &agent{ID: id, Remote: remote, Since: time.Now(), secret: secret, die: make(chan struct{})}
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	if old, ok := agents[id]; ok {
+		if secret == "" && (old.secret != "" || old.Remote == remote) {
+			return nil, fmt.Errorf("<client %s from %s> %w", id, old.Remote, errClientInUse)
+		}
+		log.Warn("[agent] client '", id, "' connected from ", remote, ", replaces ", old.Remote)
+		close(old.die)
+	}
+	agents[id] = a
+	return a, nil
+}
+
+func unregisterAgent(a *agent) {
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	if agents[a.ID] == a {
+		delete(agents, a.ID)
+	}
+}
+
+// clientAuthenticated 客户端在线且以当前配置的密钥认证, 密钥在热加载中修改或删除后返回false
+func clientAuthenticated(id string) bool {
+	agentsMu.Lock()
+	a, ok := agents[id]
+	agentsMu.Unlock()
+	if !ok || a.secret == "" {
+		return false
+	}
+	secret, ok := currentClientSecrets()[id]
+	return ok && secret == a.secret
+}
+
+// listAgents 按标识排序的客户端
+func listAgents() []agent {
+	agentsMu.Lock()
+	list := make([]agent, 0, len(agents))
+	for _, a := range agents {
+		list = append(list, *a)
+	}
+	agentsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// serveAgent 模式0服务端: 读取hello登记客户端, 隧道可用期间开启其路由的监听
+func serveAgent(conn protocol.Conn) {
+	defer conn.Close()
+
+	conn.SetReadTimeout(helloTimeout)
+	h, err := readHello(conn)
+	if err != nil {
+		log.Error("[agent] hello from ", conn.RemoteAddr(), " err: ", err)
+		return
+	}
+	conn.SetReadTimeout(0)
+	id := h.id
+	secret, err := authenticate(h, time.Now())
+	if err != nil {
+		log.Error("[agent] client '", id, "' from ", conn.RemoteAddr(), " rejected: ", err)
+		writeReject(conn, err)
+		return
+	}
+
+	a, err := registerAgent(id, conn.RemoteAddr().String(), secret)
+	if err != nil {
+		log.Error("[agent] client '", id, "' rejected: ", err)
+		writeReject(conn, err)
+		return
+	}
+	defer unregisterAgent(a)
+	log.Info("[agent] client '", id, "' connected from ", a.Remote)
+	defer log.Info("[agent] client '", id, "' disconnected")
+
+	muxClient(conn, id, a.die)
+}
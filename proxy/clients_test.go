@@ -0,0 +1,264 @@
+package main
+
+import (
+	"socks5/protocol"
+
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// encodeHello writeHello的输出经readHello解析的结果
+func encodeHello(t *testing.T, id, secret string) hello {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeHello(&buf, id, secret); err != nil {
+		t.Fatal(err)
+	}
+	h, err := readHello(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes left after hello", buf.Len())
+	}
+	return h
+}
+
+// TestHelloRoundTrip hello编码后解析得到相同的标识, 超长标识不能发送
+func TestHelloRoundTrip(t *testing.T) {
+	tests := []struct {
+		name, id, secret string
+	}{
+		{"ping", "", ""},
+		{"id", "office", ""},
+		{"max length id", strings.Repeat("a", maxClientIDLen), ""},
+		{"authenticated", "office", "s3cret"},
+		{"authenticated max length id", strings.Repeat("b", maxClientIDLen), "s3cret"},
+		{"secret without id", "", "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := encodeHello(t, tt.id, tt.secret)
+			if h.id != tt.id {
+				t.Errorf("id %q, want %q", h.id, tt.id)
+			}
+			if authenticated := tt.id != "" && tt.secret != ""; (h.auth != nil) != authenticated {
+				t.Errorf("auth %x, want authenticated %v", h.auth, authenticated)
+			}
+		})
+	}
+
+	if err := writeHello(&bytes.Buffer{}, strings.Repeat("a", maxClientIDLen+1), ""); err == nil {
+		t.Error("oversize id written")
+	}
+	if err := writeHello(&bytes.Buffer{}, strings.Repeat("a", maxClientIDLen+1), "s3cret"); err == nil {
+		t.Error("oversize authenticated id written")
+	}
+	for _, bad := range [][]byte{{0x09}, {helloID}, {helloID, 3, 'a'}, {helloAuth, 1, 'a', 0, 0}} {
+		if _, err := readHello(bytes.NewReader(bad)); err == nil {
+			t.Errorf("hello %x accepted", bad)
+		}
+	}
+}
+
+// withClientSecrets 测试期间替换服务端的客户端密钥
+func withClientSecrets(t *testing.T, secrets map[string]string) {
+	liveMu.Lock()
+	old := clientSecrets
+	clientSecrets = secrets
+	liveMu.Unlock()
+	t.Cleanup(func() {
+		liveMu.Lock()
+		clientSecrets = old
+		liveMu.Unlock()
+	})
+}
+
+// TestAuthenticate 配置了密钥的标识必须以该密钥认证, 重放与过期的hello被拒绝
+func TestAuthenticate(t *testing.T) {
+	withClientSecrets(t, map[string]string{"office": "s3cret"})
+	now := time.Now()
+
+	tamper := encodeHello(t, "office", "s3cret")
+	tamper.auth[2] ^= 1 // MAC覆盖标识
+	tests := []struct {
+		name   string
+		hello  hello
+		now    time.Time
+		secret string
+		err    error
+	}{
+		{"unlisted id", encodeHello(t, "lab", ""), now, "", nil},
+		{"unlisted id with credential", encodeHello(t, "lab", "s3cret"), now, "", errClientAuth},
+		{"listed id without credential", encodeHello(t, "office", ""), now, "", errClientAuth},
+		{"wrong secret", encodeHello(t, "office", "guess"), now, "", errClientAuth},
+		{"tampered", tamper, now, "", errClientAuth},
+		{"expired", encodeHello(t, "office", "s3cret"), now.Add(2 * helloWindow), "", errHelloExpired},
+		{"from the future", encodeHello(t, "office", "s3cret"), now.Add(-2 * helloWindow), "", errHelloExpired},
+		{"valid", encodeHello(t, "office", "s3cret"), now, "s3cret", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := authenticate(tt.hello, tt.now)
+			if !errors.Is(err, tt.err) || secret != tt.secret {
+				t.Errorf("authenticate = %q, %v; want %q, %v", secret, err, tt.secret, tt.err)
+			}
+		})
+	}
+
+	h := encodeHello(t, "office", "s3cret")
+	if _, err := authenticate(h, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticate(h, now); !errors.Is(err, errHelloReplay) {
+		t.Errorf("replayed hello: %v, want %v", err, errHelloReplay)
+	}
+}
+
+// TestRegisterAgent 新隧道替换同一标识的旧隧道, 未认证时不替换已认证或来自同一地址的旧隧道
+func TestRegisterAgent(t *testing.T) {
+	const id = "TestRegisterAgent"
+	first, err := registerAgent(id, "10.0.0.1:1000", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unregisterAgent(first)
+
+	if _, err := registerAgent(id, "10.0.0.1:1000", ""); !errors.Is(err, errClientInUse) {
+		t.Errorf("duplicate from the same address: %v, want %v", err, errClientInUse)
+	}
+	select {
+	case <-first.die:
+		t.Fatal("live tunnel closed by a duplicate from the same address")
+	default:
+	}
+
+	second, err := registerAgent(id, "10.0.0.2:2000", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unregisterAgent(second)
+	select {
+	case <-first.die:
+	default:
+		t.Error("unauthenticated reconnect did not replace the old tunnel")
+	}
+
+	third, err := registerAgent(id, "10.0.0.3:3000", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unregisterAgent(third)
+	select {
+	case <-second.die:
+	default:
+		t.Error("authenticated reconnect did not replace the old tunnel")
+	}
+	if _, err := registerAgent(id, "10.0.0.4:4000", ""); !errors.Is(err, errClientInUse) {
+		t.Errorf("unauthenticated over authenticated: %v, want %v", err, errClientInUse)
+	}
+
+	// 旧隧道退出时不注销新隧道
+	unregisterAgent(first)
+	unregisterAgent(second)
+	found := false
+	for _, a := range listAgents() {
+		found = found || (a.ID == id && a.Remote == "10.0.0.3:3000")
+	}
+	if !found {
+		t.Error("replacement unregistered by the old tunnel")
+	}
+}
+
+// TestAgentRestart 未配置密钥的客户端重启后从新地址接入替换旧隧道, 被拒绝的客户端收到原因
+func TestAgentRestart(t *testing.T) {
+	withClientSecrets(t, map[string]string{"office": "s3cret"})
+	// 结束时关闭留下的隧道并等待服务端退出, 之后的测试会修改全局配置
+	var wg sync.WaitGroup
+	t.Cleanup(wg.Wait)
+	ids := []string{"TestAgentRestart", ""}
+	t.Cleanup(func() {
+		agentsMu.Lock()
+		defer agentsMu.Unlock()
+		for _, id := range ids {
+			if a, ok := agents[id]; ok {
+				close(a.die)
+			}
+		}
+	})
+
+	// 每个监听的客户端地址不同, 模拟客户端重启后的新连接
+	serve := func() string {
+		name := memName(t)
+		lis := protocol.New(&protocol.MemConfig{})
+		if err := lis.Listen(name); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { lis.Close() })
+		go func() {
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					serveAgent(conn)
+				}()
+			}
+		}()
+		return name
+	}
+	dial := func(name, id, secret string) protocol.Conn {
+		conn := protocol.New(&protocol.MemConfig{})
+		if err := conn.Dial(name); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := writeHello(conn, id, secret); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	waitAgent := func(id, remote string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for _, a := range listAgents() {
+				if a.ID == id && a.Remote == remote {
+					return
+				}
+			}
+		}
+		t.Fatalf("client '%s' from %s not registered", id, remote)
+	}
+	rejected := func(conn protocol.Conn, want error) {
+		t.Helper()
+		conn.SetReadTimeout(5 * time.Second)
+		r := &rejectReader{ReadWriteCloser: conn}
+		if _, err := r.Read(make([]byte, 16)); err == nil || !strings.Contains(err.Error(), want.Error()) || r.rejected() == nil {
+			t.Errorf("rejection %v, want %v", err, want)
+		}
+	}
+
+	before, after := serve(), serve()
+	for _, id := range ids {
+		old := dial(before, id, "")
+		waitAgent(id, "client:"+before)
+
+		dial(after, id, "")
+		waitAgent(id, "client:"+after)
+		old.SetReadTimeout(5 * time.Second)
+		if _, err := io.Copy(io.Discard, old); err != nil {
+			t.Errorf("client '%s' old tunnel not closed: %v", id, err)
+		}
+
+		rejected(dial(after, id, ""), errClientInUse)
+	}
+	rejected(dial(before, "office", ""), errClientAuth)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"socks5"
+	"socks5/protocol"
+
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// loadConfig 以json内容替换viper中的配置
+func loadConfig(t *testing.T, config string) {
+	t.Helper()
+	viper.Reset()
+	viper.SetConfigType("json")
+	if err := viper.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(viper.Reset)
+}
+
+func TestSocks5DefaultAuthMethods(t *testing.T) {
+	socks5.RegisterMechanism("config-test", func() socks5.Mechanism { return nil })
+	tests := []struct {
+		name   string
+		config string
+		want   []byte
+	}{
+		{"no socks5", `{}`, []byte{socks5.AuthNoAuthRequired}},
+		{"no credentials", `{"socks5": {"version": 5}}`, []byte{socks5.AuthNoAuthRequired}},
+		{"username", `{"socks5": {"username": "u", "password": "p"}}`,
+			[]byte{socks5.AuthUsernamePasswd}},
+		{"secret", `{"socks5": {"secret": "s"}}`, []byte{socks5.AuthHMACChallenge}},
+		{"all", `{"socks5": {"username": "u", "secret": "s", "gssapi": {"mechanism": "config-test"}}}`,
+			[]byte{socks5.AuthGSSAPI, socks5.AuthHMACChallenge, socks5.AuthUsernamePasswd}},
+		{"explicit none", `{"socks5": {"username": "u", "auth_methods": ["username", "none"]}}`,
+			[]byte{socks5.AuthUsernamePasswd, socks5.AuthNoAuthRequired}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, tt.config)
+			p, err := socks5Config(viper.GetViper(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p.AuthMethodSupport, tt.want) {
+				t.Errorf("methods %v, want %v", authMethodNames(p.AuthMethodSupport), authMethodNames(tt.want))
+			}
+		})
+	}
+}
+
+func TestSocks5ConfigErrors(t *testing.T) {
+	socks5.RegisterMechanism("config-test", func() socks5.Mechanism { return nil })
+	for _, config := range []string{
+		`{"socks5": {"auth_methods": ["kerberos"]}}`,
+		`{"socks5": {"gssapi": {"mechanism": "missing"}}}`,
+		`{"socks5": {"gssapi": {"mechanism": "config-test", "protection": "privacy"}}}`,
+		`{"socks5": {"unix_targets": ["/run/[app.sock"]}}`,
+		`{"socks5": {"auth_methods": ["hmac", "none"]}}`,
+		`{"socks5": {"secret": "", "auth_methods": ["hmac"]}}`,
+	} {
+		loadConfig(t, config)
+		if _, err := socks5Config(viper.GetViper(), nil); err == nil {
+			t.Errorf("accepted %s", config)
+		}
+	}
+}
+
+// TestTransportConfig 传输层注册的解析读取viper中的配置
+func TestTransportConfig(t *testing.T) {
+	loadConfig(t, `{"transport": "tcp", "tcp": {"nodelay": false}}`)
+	config := transportConfig()
+	got, ok := config.(*protocol.TCPConfig)
+	if !ok {
+		t.Fatalf("config %T", config)
+	}
+	want := protocol.DefaultTCPConfig()
+	if got.NoDelay || got.KeepAlive != want.KeepAlive || got.DialTimeout != want.DialTimeout {
+		t.Errorf("tcp config %+v, defaults %+v", got, want)
+	}
+
+	// 未配置kcp项时返回无类型nil, 传输层使用默认配置
+	loadConfig(t, `{"transport": "kcp"}`)
+	if config := transportConfig(); config != nil {
+		t.Errorf("kcp config %#v, want nil", config)
+	}
+	loadConfig(t, `{"transport": "kcp", "kcp": {"mtu": 1200, "ping_interval": 3}}`)
+	kc, ok := transportConfig().(*protocol.KcpConfig)
+	if !ok || kc.MTU != 1200 || kc.PingInterval != 3*time.Second {
+		t.Errorf("kcp config %+v", kc)
+	}
+
+	loadConfig(t, `{"ws": {"tls": true}, "tls": {"server_name": "example.com"}}`)
+	wc, err := protocol.ParseConfig("ws", viper.GetViper())
+	if err != nil || wc.(*protocol.WSConfig).TLS == nil || wc.(*protocol.WSConfig).TLS.ServerName != "example.com" {
+		t.Errorf("ws config %+v %v", wc, err)
+	}
+
+	loadConfig(t, `{"unix": {"mode": "0999"}}`)
+	if _, err := protocol.ParseConfig("unix", viper.GetViper()); err == nil {
+		t.Error("invalid unix mode accepted")
+	}
+	if _, err := protocol.ParseConfig("missing", viper.GetViper()); err == nil {
+		t.Error("unknown transport accepted")
+	}
+}
+
+// TestClientsConfig 客户端密钥保留标识的大小写, 缺项, 重复与超长的标识被拒绝
+func TestClientsConfig(t *testing.T) {
+	loadConfig(t, `{"clients": [{"id": "Office", "secret": "a"}, {"id": "lab", "secret": "b"}]}`)
+	secrets, err := clientsConfig(viper.GetViper())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || secrets["Office"] != "a" || secrets["lab"] != "b" {
+		t.Errorf("secrets = %v", secrets)
+	}
+
+	for _, config := range []string{
+		`{"clients": {"office": "a"}}`,
+		`{"clients": [{"id": "office"}]}`,
+		`{"clients": [{"id": "office", "secret": ""}]}`,
+		`{"clients": [{"id": "office", "secret": "a"}, {"id": "office", "secret": "b"}]}`,
+		`{"clients": [{"id": "` + strings.Repeat("a", maxClientIDLen+1) + `", "secret": "a"}]}`,
+	} {
+		loadConfig(t, config)
+		if _, err := clientsConfig(viper.GetViper()); err == nil {
+			t.Errorf("accepted %.80s", config)
+		}
+	}
+}
+
+// TestFrontendConfig 本地socks5入口只能用于 proxy_mode 1
+func TestFrontendConfig(t *testing.T) {
+	loadConfig(t, `{"frontend": {"listen": "127.0.0.1:1080", "username": "u"}}`)
+	config, err := frontendSettings(1)
+	if err != nil || config.Listen != "127.0.0.1:1080" || config.Username != "u" {
+		t.Errorf("frontend %+v %v", config, err)
+	}
+	if _, err := frontendSettings(0); err == nil {
+		t.Error("frontend accepted in proxy_mode 0")
+	}
+	loadConfig(t, `{}`)
+	if _, err := frontendSettings(0); err != nil {
+		t.Errorf("unset frontend rejected in proxy_mode 0: %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"socks5/rule"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	mux "github.com/xtaci/smux/v2"
+)
+
+/*
+路由注册(模式0): 内网客户端在smux会话上打开一条控制流, 声明由服务端监听并经本端转发的路由(remote_router)
+	客户端 -> 服务端  {"routes": [{"in": "0.0.0.0:9000", "out": "10.0.0.2:80"}, ...]}
+	服务端 -> 客户端  {"routes": [{"in": "0.0.0.0:9000", "out": "10.0.0.2:80", "error": ""}, ...]}
+每条消息一行json. 服务端按 route_allow 校验后开启监听, 回复与请求一一对应, error为空表示成功.
+每次声明替换该客户端之前注册的全部路由, 客户端配置热加载后重新声明. 隧道断开时注册的路由随之删除.
+服务端只接受客户端打开的控制流, 未配置 route_allow 时拒绝所有注册.
+route_allow 中指定客户端的项只对以 clients 密钥认证的客户端生效, client为 * 的项对任意客户端生效
+*/
+
+const (
+	maxRegisterRoutes = 256              // 单次声明的路由数上限
+	controlTimeout    = time.Second * 10 // 等待服务端回复的时间, 超时说明服务端不支持注册
+)
+
+var errRouteNotAllowed = errors.New("<route not allowed>")
+
+// controlMessage 控制流上的消息
+type controlMessage struct {
+	Routes []controlRoute `json:"routes"`
+}
+
+type controlRoute struct {
+	In    string `json:"in"`
+	Out   string `json:"out"`
+	Error string `json:"error,omitempty"`
+}
+
+// routeAllow 允许客户端注册的监听地址, rule只使用cidrs与ports
+type routeAllow struct {
+	client string // "*" 匹配任意客户端
+	rule   *rule.Rule
+}
+
+// allowRoute 校验client注册in的权限, in必须为 ip:port, 省略ip时按0.0.0.0校验
+// client为客户端hello中的标识, 指定客户端的route_allow项要求该客户端以 clients 中当前的密钥认证
+func allowRoute(client, in string) error {
+	host, portStr, err := net.SplitHostPort(in)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("<listen host %s must be ip>", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return fmt.Errorf("<invalid port %s>", portStr)
+	}
+	named := false
+	for _, a := range currentRouteAllows() {
+		if !a.rule.Match(host, uint16(port)) {
+			continue
+		}
+		if a.client == "*" {
+			return nil
+		}
+		named = named || a.client == client
+	}
+	// client_id由客户端自行声明, 指定客户端的项只对以密钥认证的客户端生效
+	if named {
+		if clientAuthenticated(client) {
+			return nil
+		}
+		return fmt.Errorf("<client %s not authenticated> %w", client, errRouteNotAllowed)
+	}
+	return errRouteNotAllowed
+}
+
+// serveControl 服务端: 接受client打开的控制流
+// smux读取失败时不关闭会话, 直到keepalive超时, 此时AcceptStream返回错误, 关闭会话使muxClient立即退出并注销客户端
+func serveControl(session *mux.Session, client string) {
+	defer session.Close()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go handleControl(stream, client)
+	}
+}
+
+func handleControl(stream *mux.Stream, client string) {
+	defer stream.Close()
+	dec := json.NewDecoder(stream)
+	enc := json.NewEncoder(stream)
+	for {
+		var msg controlMessage
+		if err := dec.Decode(&msg); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Error("[control] client '", client, "' decode err: ", err)
+			}
+			return
+		}
+		if len(msg.Routes) > maxRegisterRoutes {
+			log.Error("[control] client '", client, "' declared ", len(msg.Routes), " routes, limit ", maxRegisterRoutes)
+			return
+		}
+		if err := enc.Encode(registerRoutes(client, msg.Routes)); err != nil {
+			log.Error("[control] client '", client, "' reply err: ", err)
+			return
+		}
+	}
+}
+
+// registerRoutes 校验并注册client声明的路由
+func registerRoutes(client string, decl []controlRoute) controlMessage {
+	reply := controlMessage{Routes: make([]controlRoute, len(decl))}
+	var accepted []route
+	var index []int // accepted[i] 对应 decl[index[i]]
+	seen := make(map[string]bool)
+	for i, d := range decl {
+		reply.Routes[i] = controlRoute{In: d.In, Out: d.Out}
+		err := allowRoute(client, d.In)
+		switch {
+		case d.Out == "":
+			err = errors.New("<out is required>")
+		case seen[d.In]:
+			err = errRouteExists
+		}
+		if err != nil {
+			reply.Routes[i].Error = err.Error()
+			continue
+		}
+		seen[d.In] = true
+		accepted = append(accepted, route{In: d.In, Out: d.Out})
+		index = append(index, i)
+	}
+
+	for i, err := range routes.register(client, accepted) {
+		if err != nil {
+			reply.Routes[index[i]].Error = err.Error()
+		}
+	}
+	for _, r := range reply.Routes {
+		if r.Error != "" {
+			log.Warn("[control] client '", client, "' register ", r.In, " -> ", r.Out, " rejected: ", r.Error)
+		} else {
+			log.Info("[control] client '", client, "' register ", r.In, " -> ", r.Out)
+		}
+	}
+	return reply
+}
+
+// controlNotify 客户端: 配置热加载后通知控制流重新声明
+var (
+	controlMu     sync.Mutex
+	controlNotify chan struct{}
+)
+
+func notifyControl() {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	if controlNotify == nil {
+		return
+	}
+	select {
+	case controlNotify <- struct{}{}:
+	default:
+	}
+}
+
+// declareRoutes 客户端: 打开控制流声明remote_router, 配置变化时重新声明, done关闭后返回
+func declareRoutes(session *mux.Session, done <-chan struct{}) {
+	notify := make(chan struct{}, 1)
+	controlMu.Lock()
+	controlNotify = notify
+	controlMu.Unlock()
+	defer func() {
+		controlMu.Lock()
+		if controlNotify == notify {
+			controlNotify = nil
+		}
+		controlMu.Unlock()
+	}()
+
+	decl := currentRemoteRoutes()
+	if len(decl) == 0 {
+		// 没有要声明的路由时等到配置中出现再打开控制流
+		select {
+		case <-notify:
+		case <-done:
+			return
+		}
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		log.Error("[control] OpenStream err: ", err)
+		return
+	}
+	defer stream.Close()
+
+	// 回复在单独的goroutine中读取
+	replied := make(chan struct{}, 1)
+	go func() {
+		dec := json.NewDecoder(stream)
+		for {
+			var msg controlMessage
+			if err := dec.Decode(&msg); err != nil {
+				return
+			}
+			select {
+			case replied <- struct{}{}:
+			default:
+			}
+			for _, r := range msg.Routes {
+				if r.Error != "" {
+					log.Error("[control] register ", r.In, " -> ", r.Out, " rejected: ", r.Error)
+				} else {
+					log.Info("[control] registered ", r.In, " -> ", r.Out)
+				}
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(stream)
+	for {
+		msg := controlMessage{Routes: make([]controlRoute, 0)}
+		for _, r := range currentRemoteRoutes() {
+			msg.Routes = append(msg.Routes, controlRoute{In: r.In, Out: r.Out})
+		}
+		log.Info("[control] declare ", len(msg.Routes), " routes")
+		if err := enc.Encode(msg); err != nil {
+			log.Error("[control] declare err: ", err)
+			return
+		}
+
+		timeout := time.NewTimer(controlTimeout)
+		select {
+		case <-replied:
+		case <-timeout.C:
+			log.Warn("[control] no reply in ", controlTimeout, ", server may not support route registration")
+		case <-done:
+		}
+		timeout.Stop()
+
+		select {
+		case <-notify:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// setRouteAllows 测试期间以json中的 route_allow 替换允许列表
+func setRouteAllows(t *testing.T, config string) {
+	t.Helper()
+	loadConfig(t, config)
+	allow, err := routeAllowConfig(viper.GetViper())
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveMu.Lock()
+	old := routeAllows
+	routeAllows = allow
+	liveMu.Unlock()
+	t.Cleanup(func() {
+		liveMu.Lock()
+		routeAllows = old
+		liveMu.Unlock()
+	})
+}
+
+// connectAgent 登记在线的客户端, secret为空表示未认证
+func connectAgent(t *testing.T, id, secret string) {
+	t.Helper()
+	a, err := registerAgent(id, "127.0.0.1:0", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterAgent(a) })
+}
+
+// replyErrors 各路由的注册结果, 成功为空
+func replyErrors(reply controlMessage) (errs []string) {
+	for _, r := range reply.Routes {
+		errs = append(errs, r.Error)
+	}
+	return
+}
+
+// TestRegisterRoutesNoAllow 未配置 route_allow 时拒绝所有注册
+func TestRegisterRoutesNoAllow(t *testing.T) {
+	setRouteAllows(t, `{}`)
+	withClientSecrets(t, map[string]string{"office": "s3cret"})
+	connectAgent(t, "office", "s3cret")
+	t.Cleanup(func() { routes.load(nil) })
+
+	reply := registerRoutes("office", []controlRoute{{In: "127.0.0.1:9000", Out: "10.0.0.1:80"}, {In: ":9001", Out: "10.0.0.1:80"}})
+	for i, e := range replyErrors(reply) {
+		if e != errRouteNotAllowed.Error() {
+			t.Errorf("route %d: %q, want %q", i, e, errRouteNotAllowed)
+		}
+	}
+	if len(routes.list()) != 0 {
+		t.Errorf("routes = %+v", routes.list())
+	}
+}
+
+// TestRegisterRoutes 指定客户端的允许项只对认证的客户端生效, 冲突的路由被拒绝, 允许列表或密钥变化后撤销
+func TestRegisterRoutes(t *testing.T) {
+	const allow = `{"route_allow": [
+		{"client": "office", "cidrs": ["127.0.0.1/32"], "ports": ["9000-9009"]},
+		{"client": "lab", "cidrs": ["127.0.0.1/32"], "ports": ["9010-9019"]},
+		{"client": "*", "cidrs": ["127.0.0.1/32"], "ports": ["9020"]}
+	]}`
+	setRouteAllows(t, allow)
+	withClientSecrets(t, map[string]string{"office": "s3cret"})
+	connectAgent(t, "office", "s3cret")
+	connectAgent(t, "lab", "") // 未配置密钥, 标识未经认证
+	routes.load([]route{{In: "127.0.0.1:9005", Out: "10.0.0.1:22"}})
+	t.Cleanup(func() { routes.load(nil) })
+
+	tests := []struct {
+		name   string
+		client string
+		decl   []controlRoute
+		errs   []string
+	}{
+		{"authenticated", "office", []controlRoute{
+			{In: "127.0.0.1:9000", Out: "10.0.0.1:80"},
+			{In: "127.0.0.1:9000", Out: "10.0.0.1:81"},
+			{In: "127.0.0.1:9005", Out: "10.0.0.1:80"},
+			{In: "127.0.0.1:9001"},
+			{In: "127.0.0.2:9002", Out: "10.0.0.1:80"},
+			{In: "localhost:9003", Out: "10.0.0.1:80"},
+		}, []string{
+			"",
+			errRouteExists.Error(),
+			errRouteExists.Error(),
+			"<out is required>",
+			errRouteNotAllowed.Error(),
+			"<listen host localhost must be ip>",
+		}},
+		{"unauthenticated named entry", "lab", []controlRoute{
+			{In: "127.0.0.1:9010", Out: "10.0.0.2:80"},
+			{In: "127.0.0.1:9000", Out: "10.0.0.2:80"},
+			{In: "127.0.0.1:9020", Out: "10.0.0.2:80"},
+		}, []string{
+			"<client lab not authenticated> " + errRouteNotAllowed.Error(),
+			errRouteNotAllowed.Error(),
+			"",
+		}},
+		{"claimed id without tunnel", "ghost", []controlRoute{
+			{In: "127.0.0.1:9011", Out: "10.0.0.2:80"},
+		}, []string{
+			errRouteNotAllowed.Error(),
+		}},
+		{"wildcard taken", "office", []controlRoute{
+			{In: "127.0.0.1:9000", Out: "10.0.0.1:80"},
+			{In: "127.0.0.1:9020", Out: "10.0.0.1:80"},
+		}, []string{
+			"",
+			errRouteExists.Error(),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := replyErrors(registerRoutes(tt.client, tt.decl))
+			if len(got) != len(tt.errs) {
+				t.Fatalf("errors = %q, want %q", got, tt.errs)
+			}
+			for i := range got {
+				if got[i] != tt.errs[i] {
+					t.Errorf("route %s: %q, want %q", tt.decl[i].In, got[i], tt.errs[i])
+				}
+			}
+		})
+	}
+	if got := routes.registered("office"); len(got) != 1 || got["127.0.0.1:9000"] != "10.0.0.1:80" {
+		t.Fatalf("office registered %v", got)
+	}
+	if got := routes.registered("lab"); len(got) != 1 || got["127.0.0.1:9020"] != "10.0.0.2:80" {
+		t.Fatalf("lab registered %v", got)
+	}
+
+	// 热加载修改密钥: office的认证失效, 其注册的路由被撤销
+	withClientSecrets(t, map[string]string{"office": "rotated"})
+	if changes := routes.prune(allowRoute); len(changes) != 1 {
+		t.Errorf("prune after secret change = %v", changes)
+	}
+	if got := routes.registered("office"); len(got) != 0 {
+		t.Errorf("office registered %v after its secret changed", got)
+	}
+
+	// 热加载收紧 route_allow: 不再允许的路由被撤销, 配置中的路由不受影响
+	setRouteAllows(t, `{"route_allow": [{"client": "*", "cidrs": ["127.0.0.1/32"], "ports": ["9021"]}]}`)
+	routes.prune(allowRoute)
+	if got := routes.registered("lab"); len(got) != 0 {
+		t.Errorf("lab registered %v after route_allow was narrowed", got)
+	}
+	if got := routes.list(); len(got) != 1 || got[0].In != "127.0.0.1:9005" {
+		t.Errorf("routes = %+v", got)
+	}
+
+	if err := allowRoute("office", "127.0.0.1:9021"); err != nil {
+		t.Errorf("wildcard entry: %v", err)
+	}
+	if err := allowRoute("office", "127.0.0.1:9000"); !errors.Is(err, errRouteNotAllowed) {
+		t.Errorf("removed entry: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"socks5"
+	"socks5/rule"
+
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	mux "github.com/xtaci/smux/v2"
+)
+
+/*
+本地socks5入口(客户端): 本地程序以socks5连接 frontend.listen, 每个CONNECT按 outbound 规则
+	tunnel 经隧道由服务端连接目标
+	direct 本端直接连接目标
+	reject 回复 ConnectionNotAllowByRuleset
+隧道可用时开启监听, 断开时关闭
+*/
+
+// frontendConfig 本地socks5入口的配置, 修改需要重启
+type frontendConfig struct {
+	Listen             string
+	Username, Password string
+}
+
+var frontend frontendConfig
+
+// frontendSettings 读取本地socks5入口配置, 入口经客户端发起的隧道流转发, 仅支持 proxy_mode 1
+func frontendSettings(mode int) (config frontendConfig, err error) {
+	if viper.IsSet("frontend.listen") {
+		config.Listen = viper.GetString("frontend.listen")
+	}
+	if config.Listen != "" && mode != 1 {
+		return config, errors.New("<config frontend err, requires proxy_mode 1>")
+	}
+	if viper.IsSet("frontend.username") {
+		config.Username = viper.GetString("frontend.username")
+	}
+	if viper.IsSet("frontend.password") {
+		config.Password = viper.GetString("frontend.password")
+	}
+	return
+}
+
+// serveFrontend 在隧道可用期间开启本地socks5入口, quit关闭后返回
+func serveFrontend(session *mux.Session, quit <-chan struct{}) {
+	l, err := socks5.ListenAddr(frontend.Listen)
+	if err != nil {
+		log.Error("[frontend] listen ", frontend.Listen, " err: ", err)
+		return
+	}
+	log.Info("[frontend] listen at ", frontend.Listen)
+	go func() {
+		<-quit
+		l.Close()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Info("[frontend] listener closed ", frontend.Listen)
+			return
+		}
+		if isStopping() {
+			c.Close()
+			continue
+		}
+		go handleFrontend(session, c)
+	}
+}
+
+// handleFrontend 与本地程序完成socks5握手, 连接目标时按出站规则选择
+func handleFrontend(session *mux.Session, c net.Conn) {
+	// 每条连接使用建立时的配置, 热加载只影响之后的连接
+	p, outbound := current()
+	local := &socks5.S5Protocol{
+		Version:           5,
+		AuthMethodSupport: []byte{socks5.AuthNoAuthRequired},
+		DirectMode:        true,
+		Username:          frontend.Username,
+		Password:          frontend.Password,
+	}
+	if frontend.Username != "" {
+		local.AuthMethodSupport = []byte{socks5.AuthUsernamePasswd}
+	}
+	local.DialTarget = func(addr string) (net.Conn, error) {
+		return dialOutbound(session, p, outbound, addr)
+	}
+	local.Server(c)
+}
+
+// dialOutbound 按出站规则连接addr
+func dialOutbound(session *mux.Session, p *socks5.S5Protocol, outbound *rule.Router, addr string) (net.Conn, error) {
+	action := outbound.Match(addr)
+	metricRouteSessions.With(frontend.Listen, action.String()).Inc()
+	switch action {
+	case rule.ActionReject:
+		log.Info("[frontend] reject ", addr)
+		return nil, socks5.ErrNotAllowed
+	case rule.ActionDirect:
+		log.Info("[frontend] direct ", addr)
+		return socks5.DialAddr(addr)
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.Dial(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if _, err := p.Connect(conn, proxyServer, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("<tunnel connect %s err> %w", addr, err)
+	}
+	return streamConn{ReadWriteCloser: conn, stream: stream}, nil
+}
+
+// streamConn 隧道上完成socks5握手的链接, 地址与超时取自smux流
+type streamConn struct {
+	io.ReadWriteCloser
+	stream *mux.Stream
+}
+
+func (c streamConn) LocalAddr() net.Addr                { return c.stream.LocalAddr() }
+func (c streamConn) RemoteAddr() net.Addr               { return c.stream.RemoteAddr() }
+func (c streamConn) SetDeadline(t time.Time) error      { return c.stream.SetDeadline(t) }
+func (c streamConn) SetReadDeadline(t time.Time) error  { return c.stream.SetReadDeadline(t) }
+func (c streamConn) SetWriteDeadline(t time.Time) error { return c.stream.SetWriteDeadline(t) }
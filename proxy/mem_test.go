@@ -0,0 +1,240 @@
+package main
+
+import (
+	"socks5/protocol"
+
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mux "github.com/xtaci/smux/v2"
+)
+
+// memName 每个测试使用独立的进程内监听名称
+func memName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+}
+
+// tcpEcho 本地回显服务, 返回监听地址
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// echoCheck 写入随机数据并校验回显
+func echoCheck(c io.ReadWriter, size int, seed int64) error {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Write(data)
+		errc <- err
+	}()
+	got := make([]byte, size)
+	if _, err := io.ReadFull(c, got); err != nil {
+		return err
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("echo corrupted")
+	}
+	return nil
+}
+
+// TestSmuxOverMem smux会话在有损的进程内链路上并发多条流
+func TestSmuxOverMem(t *testing.T) {
+	name := memName(t)
+	lis := protocol.New(&protocol.MemConfig{Latency: time.Millisecond, Loss: 0.05, Bandwidth: 8 << 20, Seed: 3})
+	if err := lis.Listen(name); err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetReadTimeout(0)
+		session, err := mux.Server(conn, smuxConfig())
+		if err != nil {
+			return
+		}
+		defer session.Close()
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	conn := protocol.New(&protocol.MemConfig{})
+	if err := conn.Dial(name); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadTimeout(0)
+	session, err := mux.Client(conn, smuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := session.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+			stream.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := echoCheck(stream, 128*1024, int64(i)); err != nil {
+				t.Error("stream ", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// memTunnel 经进程内链路建立模式1的完整隧道: 客户端路由监听 -> smux -> 服务端socks5 -> 回显服务
+// 返回路由监听的unix socket路径与断开隧道的函数, 断开后等待客户端退出
+func memTunnel(t *testing.T) (sock string, disconnect func()) {
+	t.Helper()
+	echo := tcpEcho(t)
+	name := memName(t)
+	sock = filepath.Join(t.TempDir(), "in.sock")
+	loadConfig(t, fmt.Sprintf(`{
+		"proxy_mode": 1,
+		"proxy_server": %q,
+		"socks5": {"username": "u", "password": "p"},
+		"proxy_router": [{"in": "unix:%s", "out": %q}]
+	}`, name, sock, echo))
+	baseConfig()
+	// mem不能在配置文件中选择, 由测试替换传输层配置
+	s5.ConnConfig = &protocol.MemConfig{Latency: time.Millisecond, Loss: 0.02, Seed: 5}
+	t.Cleanup(func() { routes.load(nil) })
+
+	// 服务端
+	lis := protocol.New(s5.ConnConfig)
+	if err := lis.Listen(name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	accepted := make(chan protocol.Conn, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetReadTimeout(0)
+		conn.SetWriteTimeout(0)
+		accepted <- conn
+		muxServer(conn, "")
+	}()
+
+	// 客户端, 隧道断开后返回
+	clientDone := make(chan error, 1)
+	go func() { clientDone <- clientConn() }()
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel not established")
+	}
+
+	// 等待客户端开启路由监听
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("route listener not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	disconnect = func() {
+		// smux在keepalive超时后才关闭读取失败的会话, 直接关闭会话使客户端退出并关闭路由监听
+		tunnelsMu.Lock()
+		for tun := range tunnels {
+			tun.session.Close()
+		}
+		tunnelsMu.Unlock()
+		select {
+		case err := <-clientDone:
+			if err != nil {
+				t.Error("clientConn ", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("client did not quit")
+		}
+	}
+	return
+}
+
+// echoConns 经路由监听并发建立n条连接, 每条回显size字节
+func echoConns(t *testing.T, sock string, n, size int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := net.Dial("unix", sock)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := echoCheck(c, size, int64(i)); err != nil {
+				t.Error("conn ", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestProxyOverMem 模式1的完整隧道, 断开后客户端关闭路由监听
+func TestProxyOverMem(t *testing.T) {
+	sock, disconnect := memTunnel(t)
+	echoConns(t, sock, 4, 64*1024)
+	disconnect()
+	if _, err := net.Dial("unix", sock); err == nil {
+		t.Error("route listener still open after disconnect")
+	}
+}
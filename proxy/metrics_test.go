@@ -0,0 +1,252 @@
+package main
+
+import (
+	"socks5/metrics"
+	"socks5/protocol"
+	"socks5/rule"
+
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	mux "github.com/xtaci/smux/v2"
+)
+
+var (
+	metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	sampleRe     = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[^{}]*\})? (\S+)$`)
+)
+
+// scrape 请求/metrics, 校验文本格式并返回以"名称{标签}"为键的样本值
+func scrape(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+
+	samples := make(map[string]float64)
+	help := make(map[string]bool)
+	types := make(map[string]string)
+	sc := bufio.NewScanner(resp.Body)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if strings.HasPrefix(text, "# ") {
+			f := strings.SplitN(text, " ", 4)
+			if len(f) < 4 || !metricNameRe.MatchString(f[2]) {
+				t.Fatalf("line %d: malformed comment %q", line, text)
+			}
+			switch f[1] {
+			case "HELP":
+				help[f[2]] = true
+			case "TYPE":
+				if !help[f[2]] {
+					t.Errorf("line %d: TYPE before HELP for %s", line, f[2])
+				}
+				switch f[3] {
+				case "counter", "gauge", "histogram":
+				default:
+					t.Errorf("line %d: unknown type %q", line, f[3])
+				}
+				types[f[2]] = f[3]
+			default:
+				t.Fatalf("line %d: unknown comment %q", line, text)
+			}
+			continue
+		}
+		m := sampleRe.FindStringSubmatch(text)
+		if m == nil {
+			t.Fatalf("line %d: malformed sample %q", line, text)
+		}
+		family := m[1]
+		if _, ok := types[family]; !ok {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if base := strings.TrimSuffix(family, suffix); base != family && types[base] == "histogram" {
+					family = base
+				}
+			}
+		}
+		if _, ok := types[family]; !ok {
+			t.Errorf("line %d: sample %s without TYPE", line, m[1])
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("line %d: value %q: %v", line, m[3], err)
+		}
+		samples[m[1]+m[2]] = v
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+// TestMetricsScrape 经隧道代理连接后抓取/metrics, 路由的连接数与字节数与实际传输一致
+func TestMetricsScrape(t *testing.T) {
+	srv := httptest.NewServer(metrics.Handler())
+	defer srv.Close()
+	url := srv.URL + "/metrics"
+
+	const conns, size = 3, 32 * 1024
+	sock, disconnect := memTunnel(t)
+	echoConns(t, sock, conns, size)
+
+	route := "unix:" + sock
+	want := map[string]float64{
+		fmt.Sprintf(`proxy_route_sessions_total{route=%q,action=%q}`, route, rule.ActionTunnel.String()): conns,
+		fmt.Sprintf(`proxy_route_bytes_total{route=%q,direction="upload"}`, route):                       conns * size,
+		fmt.Sprintf(`proxy_route_bytes_total{route=%q,direction="download"}`, route):                     conns * size,
+		fmt.Sprintf(`proxy_route_active_sessions{route=%q}`, route):                                      0,
+		`proxy_tunnel_up`: 1,
+	}
+	// 连接关闭后活动连接数异步减少
+	var samples map[string]float64
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		samples = scrape(t, url)
+		if samples[fmt.Sprintf(`proxy_route_active_sessions{route=%q}`, route)] == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for k, v := range want {
+		got, ok := samples[k]
+		if !ok {
+			t.Errorf("missing %s", k)
+		} else if got != v {
+			t.Errorf("%s = %v, want %v", k, got, v)
+		}
+	}
+	if samples["proxy_tunnels"] < 1 {
+		t.Errorf("proxy_tunnels = %v with a connected tunnel", samples["proxy_tunnels"])
+	}
+
+	disconnect()
+	if got := scrape(t, url)["proxy_tunnel_up"]; got != 0 {
+		t.Errorf("proxy_tunnel_up = %v after disconnect", got)
+	}
+}
+
+// kcpTunnel 本地kcp连接上的一对smux会话, 登记为隧道, 返回两端各自打开/接受的流
+func kcpTunnel(t *testing.T) (server, client *mux.Stream) {
+	t.Helper()
+	// kcp监听不导出地址, 先取一个空闲的udp端口
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	lis := protocol.New(&protocol.KcpConfig{})
+	if err := lis.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	dialer := protocol.New(&protocol.KcpConfig{})
+	if err := dialer.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []protocol.Conn{accepted, dialer} {
+		c.SetReadTimeout(0)
+		c.SetWriteTimeout(0)
+	}
+	serverSess, err := mux.Server(accepted, smuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSess, err := mux.Client(dialer, smuxConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tun := range []*tunnel{addTunnel(accepted, serverSess), addTunnel(dialer, clientSess)} {
+		tun := tun
+		t.Cleanup(func() {
+			removeTunnel(tun)
+			tun.session.Close()
+			tun.conn.Close()
+		})
+	}
+
+	if client, err = clientSess.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = serverSess.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// TestStatsHandler /stats 返回每条隧道的流数量与kcp会话统计
+func TestStatsHandler(t *testing.T) {
+	server, client := kcpTunnel(t)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(statsHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q", ct)
+	}
+	var stats []tunnelStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("tunnels %d, want 2", len(stats))
+	}
+	for _, st := range stats {
+		if st.Streams != 1 || st.Remote == "" || st.Kcp == nil {
+			t.Fatalf("tunnel %+v", st)
+		}
+		if st.Kcp.MTU != 1400 || st.Kcp.SndWnd != 128 || st.Kcp.RcvWnd != 1024 || st.Kcp.Snmp.OutPkts == 0 {
+			t.Errorf("kcp %+v", st.Kcp)
+		}
+		if len(st.Kcp.Sessions) != 1 {
+			t.Fatalf("sessions %+v", st.Kcp.Sessions)
+		}
+		sess := st.Kcp.Sessions[0]
+		// smux帧头计入传输层字节数
+		if !sess.Attached || sess.ID == "" || sess.Tx < uint64(len(buf)) || sess.Rx < uint64(len(buf)) {
+			t.Errorf("session %+v", sess)
+		}
+	}
+	client.Close()
+	server.Close()
+}
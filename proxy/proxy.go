@@ -2,13 +2,23 @@ package main
 
 import (
 	"socks5"
+	"socks5/metrics"
 	"socks5/protocol"
+	"socks5/rule"
 
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
@@ -30,8 +40,10 @@ proxyMode=1:
 */
 
 type route struct {
-	In  string
-	Out string
+	In         string
+	Out        string
+	Client     string // 模式0服务端: 负责转发的内网客户端的 client_id
+	Registered bool   // 由客户端经控制流注册, 不写回配置文件
 }
 
 const (
@@ -45,32 +57,122 @@ var (
 
 	s5                *socks5.S5Protocol
 	proxyRouter       []route
+	remoteRouter      []route
+	routeAllows       []routeAllow
+	clientSecrets     map[string]string
+	outboundRouter    *rule.Router
 	httpServer        string
+	httpToken         string
+	clientID          string
+	clientSecret      string
 	proxyMode         int
 	proxyServer       string
+	transport         = protocol.DefaultTransport
 	serverPprofServer string
 	clientPprofServer string
+	reconnect         reconnectPolicy
 )
 
+// 指标, route标签取proxy_router中的in地址, 数量受配置限制
+var (
+	metricRouteActive = metrics.NewGauge("proxy_route_active_sessions",
+		"Connections currently being proxied, by route.", "route")
+	metricRouteSessions = metrics.NewCounter("proxy_route_sessions_total",
+		"Connections accepted on a route, by outbound action.", "route", "action")
+	metricRouteBytes = metrics.NewCounter("proxy_route_bytes_total",
+		"Bytes relayed for local connections, by route and direction.", "route", "direction")
+	metricTunnelReconnects = metrics.NewCounter("proxy_tunnel_reconnects_total",
+		"Reconnect attempts scheduled by the client supervisor.")
+	metricTunnelUp = metrics.NewGauge("proxy_tunnel_up",
+		"Whether the client tunnel is connected.")
+)
+
+func init() {
+	metrics.NewGaugeFunc("proxy_tunnels", "Tunnels with an open smux session.", func() float64 {
+		tunnelsMu.Lock()
+		defer tunnelsMu.Unlock()
+		return float64(len(tunnels))
+	})
+}
+
 func baseConfig() {
-	s5 = socks5Config()
-	proxyRouter = routeConfig()
+	live, err := parseLiveConfig(viper.GetViper(), transportConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s5, proxyRouter, outboundRouter = live.s5, live.routes, live.outbound
+	remoteRouter, routeAllows, clientSecrets = live.remote, live.allow, live.clients
+	routes.load(proxyRouter)
 
 	if viper.IsSet("http_server") {
 		httpServer = viper.GetString("http_server")
 	}
+	if viper.IsSet("http_token") {
+		httpToken = viper.GetString("http_token")
+	}
 	if viper.IsSet("proxy_mode") {
 		proxyMode = viper.GetInt("proxy_mode")
 	}
 	if viper.IsSet("proxy_server") {
 		proxyServer = viper.GetString("proxy_server")
 	}
+	if viper.IsSet("client_id") {
+		clientID = viper.GetString("client_id")
+		if len(clientID) > maxClientIDLen {
+			log.Fatal("config client_id err, longer than ", maxClientIDLen)
+		}
+	}
+	if viper.IsSet("client_secret") {
+		clientSecret = viper.GetString("client_secret")
+		if clientSecret != "" && clientID == "" {
+			log.Fatal("config client_secret err, requires client_id")
+		}
+	}
 	if viper.IsSet("server_pprof_server") {
 		serverPprofServer = viper.GetString("server_pprof_server")
 	}
 	if viper.IsSet("client_pprof_server") {
 		clientPprofServer = viper.GetString("client_pprof_server")
 	}
+	if viper.IsSet("unix.mode") {
+		socks5.UnixSocketMode = unixMode()
+	}
+	if viper.IsSet("shutdown_timeout") {
+		shutdownTimeout = viper.GetDuration("shutdown_timeout") * time.Second
+	}
+	reconnect = reconnectConfig()
+	if frontend, err = frontendSettings(proxyMode); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// reconnectConfig 客户端重连参数, 时间单位为秒
+func reconnectConfig() (reconnect reconnectPolicy) {
+	reconnect = reconnectPolicy{
+		Initial:    time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+	if viper.IsSet("reconnect.initial") {
+		reconnect.Initial = time.Duration(viper.GetFloat64("reconnect.initial") * float64(time.Second))
+	}
+	if viper.IsSet("reconnect.max") {
+		reconnect.Max = time.Duration(viper.GetFloat64("reconnect.max") * float64(time.Second))
+	}
+	if viper.IsSet("reconnect.multiplier") {
+		reconnect.Multiplier = viper.GetFloat64("reconnect.multiplier")
+	}
+	if viper.IsSet("reconnect.jitter") {
+		reconnect.Jitter = viper.GetFloat64("reconnect.jitter")
+	}
+	if viper.IsSet("reconnect.max_retries") {
+		reconnect.MaxRetries = viper.GetInt("reconnect.max_retries")
+	}
+	if reconnect.Multiplier < 1 || reconnect.Jitter < 0 || reconnect.Jitter > 1 || reconnect.Initial <= 0 {
+		log.Fatal("config reconnect err: ", reconnect)
+	}
+	return
 }
 
 func logConfig() {
@@ -79,139 +181,427 @@ func logConfig() {
 	log.Info("httpServer     : ", httpServer)
 	log.Info("proxyMode      : ", proxyMode)
 	log.Info("proxyServer    : ", proxyServer)
+	log.Info("clientID       : ", clientID)
 	log.Info("serverPprofServer: ", serverPprofServer)
 	log.Info("clientPprofServer: ", clientPprofServer)
 	log.Info("socks5         : ", s5)
-	log.Info("kcp            : ", s5.ConnConfig)
+	log.Info("transport      : ", transport)
+	log.Info("transport conf : ", s5.ConnConfig)
+	log.Info("addr map       : ", s5.AddrMap.Len(), " entries")
 	log.Info("proxy router   : ", proxyRouter)
+	log.Info("remote router  : ", remoteRouter)
+	log.Info("route allow    : ", len(routeAllows), " entries")
+	log.Info("clients        : ", len(clientSecrets), " with secret")
+	log.Info("frontend       : ", frontend.Listen)
+	log.Info("reconnect      : ", reconnect)
+	log.Info("shutdown       : ", shutdownTimeout)
+	if outboundRouter != nil {
+		log.Info("outbound       : default ", outboundRouter.Default, ", ", len(outboundRouter.Rules), " rules")
+	}
 	log.Info("================================")
 }
 
-func routeConfig() (r []route) {
-	if !viper.IsSet("proxy_router") {
+func routeConfig(src *viper.Viper) ([]route, error) {
+	return routeList(src, "proxy_router")
+}
+
+// remoteRouteConfig 模式0客户端注册到服务端的路由, in为服务端的监听地址, out为本端连接的目标地址
+func remoteRouteConfig(src *viper.Viper) ([]route, error) {
+	return routeList(src, "remote_router")
+}
+
+// routeList 解析 {"in": .., "out": .., "client": ..} 数组
+func routeList(src *viper.Viper, key string) (r []route, err error) {
+	if !src.IsSet(key) {
 		return
 	}
-	sub := viper.Get("proxy_router")
+	sub := src.Get(key)
 	a, ok := sub.([]interface{})
 	if !ok {
-		log.Error("config proxy router err, should be []interface{}")
+		return nil, fmt.Errorf("<config %s err, should be []interface{}>", key)
 	}
 
-	// 解析 proxy_router 项
+	// 解析各项
+	seen := make(map[string]bool)
 	for _, val := range a {
 		v, ok := val.(map[string]interface{})
 		if !ok {
-			log.Error("config proxy router err, should be {string: string}")
+			return nil, fmt.Errorf("<config %s err, should be {string: string}>", key)
 		}
 		var rt route
 		in, ok := v["in"]
 		if !ok {
-			log.Fatal("config proxy router err, must have key 'in'")
+			return nil, fmt.Errorf("<config %s err, must have key 'in'>", key)
 		}
 		inStr, ok := in.(string)
 		if !ok {
-			log.Fatal("config proxy router err, key 'in' must have string value")
+			return nil, fmt.Errorf("<config %s err, key 'in' must have string value>", key)
 		}
 		rt.In = inStr
 
 		out, ok := v["out"]
 		if !ok {
-			log.Fatal("config proxy router err, must have key 'out'")
+			return nil, fmt.Errorf("<config %s err, must have key 'out'>", key)
 		}
 		outStr, ok := out.(string)
 		if !ok {
-			log.Fatal("config proxy router err, key 'out' must have string value")
+			return nil, fmt.Errorf("<config %s err, key 'out' must have string value>", key)
 		}
 		rt.Out = outStr
 
+		if client, ok := v["client"]; ok {
+			if rt.Client, ok = client.(string); !ok {
+				return nil, fmt.Errorf("<config %s err, key 'client' must have string value>", key)
+			}
+		}
+
+		if seen[rt.In] {
+			return nil, fmt.Errorf("<config %s err, duplicate in %s>", key, rt.In)
+		}
+		seen[rt.In] = true
 		r = append(r, rt)
 	}
 	return
 }
 
-func socks5Config() (s5 *socks5.S5Protocol) {
-	s5 = &socks5.S5Protocol{
-		Version:           5,
-		AuthMethodSupport: []byte{socks5.AuthNoAuthRequired},
-		DirectMode:        true,
-		ConnConfig:        kcpConfig(),
+// routeAllowConfig 服务端允许客户端注册的路由
+func routeAllowConfig(src *viper.Viper) (list []routeAllow, err error) {
+	if !src.IsSet("route_allow") {
+		return
+	}
+	a, ok := src.Get("route_allow").([]interface{})
+	if !ok {
+		return nil, errors.New("<config route allow err, should be []interface{}>")
 	}
-	if !viper.IsSet("socks5") {
+
+	// 解析 route_allow 项
+	for _, val := range a {
+		v, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("<config route allow err, should be {string: interface{}}>")
+		}
+		allow := routeAllow{rule: &rule.Rule{}}
+		if allow.client, ok = v["client"].(string); !ok {
+			return nil, errors.New("<config route allow err, must have string key 'client'>")
+		}
+		cidrs, err := stringList(v, "cidrs")
+		if err != nil {
+			return nil, fmt.Errorf("<config route allow err> %w", err)
+		}
+		for _, cidr := range cidrs {
+			if err := allow.rule.AddCIDR(cidr); err != nil {
+				return nil, fmt.Errorf("<config route allow err> %w", err)
+			}
+		}
+		ports, err := stringList(v, "ports")
+		if err != nil {
+			return nil, fmt.Errorf("<config route allow err> %w", err)
+		}
+		if len(ports) == 0 {
+			return nil, errors.New("<config route allow err, must have key 'ports'>")
+		}
+		for _, p := range ports {
+			if err := allow.rule.AddPorts(p); err != nil {
+				return nil, fmt.Errorf("<config route allow err> %w", err)
+			}
+		}
+		list = append(list, allow)
+	}
+	return
+}
+
+// clientsConfig 服务端内网客户端的认证密钥, client_id -> secret
+func clientsConfig(src *viper.Viper) (map[string]string, error) {
+	if !src.IsSet("clients") {
+		return nil, nil
+	}
+	a, ok := src.Get("clients").([]interface{})
+	if !ok {
+		return nil, errors.New("<config clients err, should be []interface{}>")
+	}
+	secrets := make(map[string]string, len(a))
+	for _, val := range a {
+		v, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("<config clients err, should be {string: string}>")
+		}
+		id, _ := v["id"].(string)
+		secret, _ := v["secret"].(string)
+		if id == "" || secret == "" {
+			return nil, errors.New("<config clients err, must have string keys 'id' and 'secret'>")
+		}
+		if len(id) > maxClientIDLen {
+			return nil, fmt.Errorf("<config clients err, id %s longer than %d>", id, maxClientIDLen)
+		}
+		if _, ok := secrets[id]; ok {
+			return nil, fmt.Errorf("<config clients err, duplicate id %s>", id)
+		}
+		secrets[id] = secret
+	}
+	return secrets, nil
+}
+
+func outboundConfig(src *viper.Viper) (r *rule.Router, err error) {
+	if !src.IsSet("outbound") {
 		return
 	}
-	// 此项不起作用
-	if viper.IsSet("socks5.version") {
-		s5.Version = byte(viper.GetInt("socks5.version"))
+	r = &rule.Router{Default: rule.ActionTunnel}
+	if src.IsSet("outbound.default") {
+		action, err := rule.ParseAction(src.GetString("outbound.default"))
+		if err != nil {
+			return nil, fmt.Errorf("<config outbound err> %w", err)
+		}
+		r.Default = action
 	}
-	if viper.IsSet("socks5.username") {
-		s5.Username = viper.GetString("socks5.username")
-		s5.AuthMethodSupport = append(s5.AuthMethodSupport, socks5.AuthUsernamePasswd)
+	if !src.IsSet("outbound.rules") {
+		return
 	}
-	if viper.IsSet("socks5.password") {
-		s5.Password = viper.GetString("socks5.password")
+	a, ok := src.Get("outbound.rules").([]interface{})
+	if !ok {
+		return nil, errors.New("<config outbound rules err, should be []interface{}>")
+	}
+
+	// 解析 outbound.rules 项
+	for _, val := range a {
+		v, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("<config outbound rules err, should be {string: interface{}}>")
+		}
+		rl, err := outboundRule(v)
+		if err != nil {
+			return nil, fmt.Errorf("<config outbound rules err> %w", err)
+		}
+		r.Rules = append(r.Rules, rl)
 	}
 	return
 }
 
-func kcpConfig() (config *protocol.KcpConfig) {
-	if !viper.IsSet("kcp") {
+// outboundRule 解析单条 outbound.rules 项
+func outboundRule(v map[string]interface{}) (*rule.Rule, error) {
+	rl := &rule.Rule{}
+	actionStr, ok := v["action"].(string)
+	if !ok {
+		return nil, errors.New("<must have string key 'action'>")
+	}
+	action, err := rule.ParseAction(actionStr)
+	if err != nil {
+		return nil, err
+	}
+	rl.Action = action
+
+	lists := make(map[string][]string)
+	for _, key := range []string{"domains", "domain_files", "cidrs", "cidr_files", "ports"} {
+		if lists[key], err = stringList(v, key); err != nil {
+			return nil, err
+		}
+	}
+	for _, domain := range lists["domains"] {
+		rl.AddDomain(domain)
+	}
+	for _, path := range lists["domain_files"] {
+		if err := rl.LoadDomainFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, cidr := range lists["cidrs"] {
+		if err := rl.AddCIDR(cidr); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range lists["cidr_files"] {
+		if err := rl.LoadCIDRFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, ports := range lists["ports"] {
+		if err := rl.AddPorts(ports); err != nil {
+			return nil, err
+		}
+	}
+	return rl, nil
+}
+
+// stringList 读取配置项中的字符串数组, 数字元素会被转为字符串
+func stringList(v map[string]interface{}, key string) (list []string, err error) {
+	val, ok := v[key]
+	if !ok {
 		return
 	}
-	config = &protocol.KcpConfig{}
-	if viper.IsSet("kcp.key") {
-		config.Key = viper.GetString("kcp.key")
+	a, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("<key '%s' must be array>", key)
+	}
+	for _, item := range a {
+		switch t := item.(type) {
+		case string:
+			list = append(list, t)
+		case float64:
+			list = append(list, strconv.Itoa(int(t)))
+		default:
+			return nil, fmt.Errorf("<key '%s' must be string array>", key)
+		}
+	}
+	return
+}
+
+// socks5Config connConfig为传输层配置, 重新加载时沿用已有的传输层
+func socks5Config(src *viper.Viper, connConfig protocol.Config) (s5 *socks5.S5Protocol, err error) {
+	addrMap, err := addrMapConfig(src)
+	if err != nil {
+		return nil, err
 	}
-	if viper.IsSet("kcp.salt") {
-		config.Salt = viper.GetString("kcp.salt")
+	s5 = &socks5.S5Protocol{
+		Version:           5,
+		AuthMethodSupport: []byte{socks5.AuthNoAuthRequired},
+		DirectMode:        true,
+		ConnConfig:        connConfig,
+		AddrMap:           addrMap,
 	}
-	if viper.IsSet("kcp.crypt") {
-		config.Crypt = viper.GetString("kcp.crypt")
+	if !src.IsSet("socks5") {
+		return
 	}
-	if viper.IsSet("kcp.mode") {
-		config.Mode = viper.GetString("kcp.mode")
+	// 此项不起作用
+	if src.IsSet("socks5.version") {
+		s5.Version = byte(src.GetInt("socks5.version"))
 	}
-	if viper.IsSet("kcp.mtu") {
-		config.MTU = viper.GetInt("kcp.mtu")
+	if src.IsSet("socks5.username") {
+		s5.Username = src.GetString("socks5.username")
 	}
-	if viper.IsSet("kcp.sndwnd") {
-		config.SndWnd = viper.GetInt("kcp.sndwnd")
+	if src.IsSet("socks5.password") {
+		s5.Password = src.GetString("socks5.password")
 	}
-	if viper.IsSet("kcp.rcvwnd") {
-		config.RcvWnd = viper.GetInt("kcp.rcvwnd")
+	if src.IsSet("socks5.secret") {
+		s5.Secret = src.GetString("socks5.secret")
 	}
-	if viper.IsSet("kcp.datashard") {
-		config.DataShard = viper.GetInt("kcp.datashard")
+	if src.IsSet("socks5.require_auth") {
+		s5.RequireAuth = src.GetBool("socks5.require_auth")
 	}
-	if viper.IsSet("kcp.parityshard") {
-		config.ParityShard = viper.GetInt("kcp.parityshard")
+	if src.IsSet("socks5.unix_targets") {
+		for _, pattern := range src.GetStringSlice("socks5.unix_targets") {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("<config socks5 err, unix target %q> %w", pattern, err)
+			}
+			s5.UnixTargets = append(s5.UnixTargets, pattern)
+		}
 	}
-	if viper.IsSet("kcp.dscp") {
-		config.DSCP = viper.GetInt("kcp.dscp")
+	if src.IsSet("socks5.gssapi") {
+		g, err := gssapiConfig(src)
+		if err != nil {
+			return nil, err
+		}
+		s5.Authenticators = append(s5.Authenticators, g)
 	}
-	if viper.IsSet("kcp.acknodelay") {
-		config.AckNodelay = viper.GetBool("kcp.acknodelay")
+
+	// 认证方法优先级, 默认按安全性从高到低
+	if src.IsSet("socks5.auth_methods") {
+		s5.AuthMethodSupport = nil
+		for _, name := range src.GetStringSlice("socks5.auth_methods") {
+			method, ok := authMethodByName(name)
+			if !ok {
+				return nil, fmt.Errorf("<config socks5 err, unknown auth method %s>", name)
+			}
+			if method == socks5.AuthHMACChallenge && s5.Secret == "" {
+				return nil, errors.New("<config socks5 err, auth method hmac requires secret>")
+			}
+			s5.AuthMethodSupport = append(s5.AuthMethodSupport, method)
+		}
+	} else {
+		s5.AuthMethodSupport = nil
+		if len(s5.Authenticators) > 0 {
+			s5.AuthMethodSupport = append(s5.AuthMethodSupport, socks5.AuthGSSAPI)
+		}
+		if s5.Secret != "" {
+			s5.AuthMethodSupport = append(s5.AuthMethodSupport, socks5.AuthHMACChallenge)
+		}
+		if s5.Username != "" {
+			s5.AuthMethodSupport = append(s5.AuthMethodSupport, socks5.AuthUsernamePasswd)
+		}
+		// 配置了认证信息时不允许跳过认证, 需要无认证时在auth_methods中显式列出none
+		if len(s5.AuthMethodSupport) == 0 {
+			s5.AuthMethodSupport = append(s5.AuthMethodSupport, socks5.AuthNoAuthRequired)
+		}
 	}
-	if viper.IsSet("kcp.interval") {
-		config.Interval = viper.GetInt("kcp.interval")
+	return
+}
+
+// gssapiConfig socks5.gssapi, mechanism为已登记的机制名称
+func gssapiConfig(src *viper.Viper) (*socks5.GSSAPIAuth, error) {
+	protection := socks5.ProtectionNone
+	if src.IsSet("socks5.gssapi.protection") {
+		level, err := socks5.ProtectionLevel(src.GetString("socks5.gssapi.protection"))
+		if err != nil {
+			return nil, fmt.Errorf("<config socks5 gssapi err> %w", err)
+		}
+		protection = level
 	}
-	if viper.IsSet("kcp.resend") {
-		config.Resend = viper.GetInt("kcp.resend")
+	g, err := socks5.NewGSSAPIAuth(src.GetString("socks5.gssapi.mechanism"), protection)
+	if err != nil {
+		return nil, fmt.Errorf("<config socks5 gssapi err> %w", err)
 	}
-	if viper.IsSet("kcp.nc") {
-		config.NoCongestion = viper.GetInt("kcp.nc")
+	return g, nil
+}
+
+func authMethodByName(name string) (byte, bool) {
+	for method, n := range socks5.AuthMethodName {
+		if n == name {
+			return method, true
+		}
 	}
-	if viper.IsSet("kcp.sockbuf") {
-		config.SockBuf = viper.GetInt("kcp.sockbuf")
+	return 0, false
+}
+
+func addrMapConfig(src *viper.Viper) (m *socks5.AddrMap, err error) {
+	if !src.IsSet("addr_map") {
+		return
 	}
-	if viper.IsSet("kcp.ping_interval") {
-		config.PingInterval = viper.GetDuration("kcp.ping_interval") * time.Second
+	a, ok := src.Get("addr_map").([]interface{})
+	if !ok {
+		return nil, errors.New("<config addr map err, should be []interface{}>")
 	}
-	if viper.IsSet("kcp.pong_timeout") {
-		config.PongTimeout = viper.GetDuration("kcp.pong_timeout") * time.Second
+
+	// 解析 addr_map 项
+	m = socks5.NewAddrMap()
+	for _, val := range a {
+		v, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("<config addr map err, should be {string: string}>")
+		}
+		from, ok := v["from"].(string)
+		if !ok {
+			return nil, errors.New("<config addr map err, must have string key 'from'>")
+		}
+		to, ok := v["to"].(string)
+		if !ok {
+			return nil, errors.New("<config addr map err, must have string key 'to'>")
+		}
+		if err := m.Add(from, to); err != nil {
+			return nil, fmt.Errorf("<config addr map err> %w", err)
+		}
 	}
 	return
 }
 
+// transportConfig 根据 transport 项选择传输层, 由传输层注册的解析读取对应的配置
+func transportConfig() protocol.Config {
+	if viper.IsSet("transport") {
+		transport = viper.GetString("transport")
+	}
+	config, err := protocol.ParseConfig(transport, viper.GetViper())
+	if err != nil {
+		log.Fatal("config transport err: ", err, ", configurable: ", protocol.Configurable())
+	}
+	return config
+}
+
+// unixMode 八进制的socket文件权限, 例如 "0660"
+func unixMode() os.FileMode {
+	mode, err := protocol.ParseFileMode(viper.GetString("unix.mode"))
+	if err != nil {
+		log.Fatal("config unix mode err: ", err)
+	}
+	return mode
+}
+
 func smuxConfig() (config *mux.Config) {
 	config = mux.DefaultConfig()
 	if !viper.IsSet("smux") {
@@ -254,6 +644,7 @@ func main() {
 
 	baseConfig()
 	logConfig()
+	watchConfig()
 
 	var pprofServer string
 	if *isServer {
@@ -263,30 +654,44 @@ func main() {
 		go client()
 		pprofServer = clientPprofServer
 	}
-	// TODO: HTTP API 动态修改路由
-	// log.Fatal(http.ListenAndServe(httpServer, nil))
-	log.Fatal(http.ListenAndServe(pprofServer, nil)) // pprof
+	if httpServer != "" {
+		go serveAdmin(httpServer, httpToken)
+	}
+	http.HandleFunc("/stats", statsHandler)
+	http.Handle("/metrics", metrics.Handler())
+	go func() {
+		log.Fatal(http.ListenAndServe(pprofServer, nil)) // pprof
+	}()
+
+	os.Exit(waitShutdown())
 }
 
-func muxClient(conn io.ReadWriteCloser, die <-chan struct{}) {
+// muxClient 在隧道上开启client的路由监听, 调用前已读取对端的hello
+func muxClient(conn io.ReadWriteCloser, client string, die <-chan struct{}) {
 	log.Info("muxClient start")
 	defer log.Info("muxClient quit")
 
-	buff := make([]byte, 1)
-	if _, err := conn.Read(buff); err != nil {
-		log.Error("[muxClient] ping recv err: ", err)
-		return
-	}
-
 	session, err := mux.Client(conn, nil)
 	if err != nil {
 		log.Error("[muxClient] Client err: ", err)
 		return
 	}
 	defer session.Close()
+	defer removeTunnel(addTunnel(conn, session))
 
 	// 根据socks5协议转发
-	proxyConn := func(dst io.ReadWriteCloser, remoteAddr string) {
+	proxyConn := func(dst net.Conn, routeName, remoteAddr string) {
+		active := metricRouteActive.With(routeName)
+		active.Inc()
+		defer active.Dec()
+		dst = socks5.NewMeteredConn(dst, metricRouteBytes.With(routeName, "upload"), metricRouteBytes.With(routeName, "download"))
+		defer dst.Close()
+
+		// 每条连接使用建立时的配置, 热加载只影响之后的连接
+		p, _ := current()
+		sess := &socks5.Session{User: p.Username, Dest: remoteAddr, Route: routeName}
+		metricRouteSessions.With(routeName, rule.ActionTunnel.String()).Inc()
+
 		stream, err := session.OpenStream()
 		if err != nil {
 			log.Error("[muxClient] OpenStream err: ", err)
@@ -294,77 +699,97 @@ func muxClient(conn io.ReadWriteCloser, die <-chan struct{}) {
 		}
 		defer stream.Close()
 
-		if err := s5.Dial(stream); err != nil {
+		conn, err := p.Dial(stream)
+		if err != nil {
 			log.Error("[muxClient] Dial err: ", err)
 			return
 		}
 
-		if _, err := s5.Connect(stream, proxyServer, remoteAddr); err != nil {
+		if _, err := p.Connect(conn, proxyServer, remoteAddr); err != nil {
 			log.Error("[muxClient] Connect err: ", err)
 			return
 		}
 
 		// 桥接流量
-		socks5.ProxyStream(dst, stream)
-	}
-
-	// 在公网机器上开启本地端口转发
-	var wg sync.WaitGroup
-	for _, route := range proxyRouter {
-		localAddr := route.In
-		remoteAddr := route.Out
-		wg.Add(1)
-		go func(localAddr, remoteAddr string) {
-			defer wg.Done()
-
-			if serv, err := net.Listen("tcp", localAddr); err == nil {
-				defer serv.Close()
-				log.Info("[muxClient] listen at ", localAddr)
-				go func() {
-					if die != nil {
-						<-die
-						serv.Close()
-					}
-				}()
-
-				for {
-					servConn, err := serv.Accept()
-					if err != nil {
-						log.Error("[muxClient] Inner accept err: ", err)
-						return
-					}
-					// socks5操作
-					go proxyConn(servConn, remoteAddr)
+		socks5.ProxySession(sess, dst, conn)
+	}
+
+	// 会话断开或收到退出通知时关闭本地监听
+	quit := make(chan struct{})
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-die:
+				close(quit)
+				return
+			case <-t.C:
+				if session.IsClosed() {
+					close(quit)
+					return
 				}
-			} else {
-				log.Fatal("[muxClient] tcp server start err: ", err)
 			}
-		}(localAddr, remoteAddr)
+		}
+	}()
+
+	// 在公网机器上开启本地端口转发, 隧道断开时关闭
+	gen := routes.attach(client, proxyConn)
+	if *isServer && proxyMode == 0 {
+		go serveControl(session, client)
 	}
-	wg.Wait()
+	if !*isServer && frontend.Listen != "" {
+		go serveFrontend(session, quit)
+	}
+	<-quit
+	routes.detach(client, gen)
 }
 
-func muxServer(conn io.ReadWriteCloser) {
+// muxServer 接受隧道上的流并按socks5协议转发, id为模式0下本端的 client_id
+// 握手失败时返回错误, 隧道建立后断开时返回nil
+func muxServer(conn io.ReadWriteCloser, id string) error {
 	log.Info("muxServer start")
 	defer log.Info("muxServer quit")
 
-	if _, err := conn.Write([]byte{byte(0x01)}); err != nil {
+	if err := writeHello(conn, id, clientSecret); err != nil {
 		log.Error("[muxServer] ping err: ", err)
-		return
+		return err
 	}
-	muxer, err := mux.Server(conn, smuxConfig())
+	// 模式0内网客户端: 服务端可能以拒绝代替smux数据
+	reject := &rejectReader{ReadWriteCloser: conn}
+	var rw io.ReadWriteCloser = conn
+	if proxyMode == 0 && !*isServer {
+		rw = reject
+	}
+	muxer, err := mux.Server(rw, smuxConfig())
 	if err != nil {
 		log.Error("[muxServer] Server ", err)
-		return
+		return err
 	}
 	defer muxer.Close()
+	defer removeTunnel(addTunnel(conn, muxer))
+	if proxyMode == 0 && !*isServer {
+		done := make(chan struct{})
+		defer close(done)
+		go declareRoutes(muxer, done)
+	}
 
 	// 接收代理链接
 	for {
 		stream, err := muxer.AcceptStream()
 		if err != nil {
+			// 被拒绝时返回错误, 不重置重连间隔
+			if err := reject.rejected(); err != nil {
+				log.Error("[muxServer] ", err)
+				return err
+			}
 			log.Error("[muxServer] Accept ", err)
-			return
+			return nil
+		}
+		// 退出中不再接受新的流, 已有的流继续转发
+		if isStopping() {
+			stream.Close()
+			continue
 		}
 
 		go func() {
@@ -372,7 +797,8 @@ func muxServer(conn io.ReadWriteCloser) {
 			defer stream.Close()
 
 			// 根据socks5协议 代理流量
-			s5.Server(stream)
+			p, _ := current()
+			p.Server(stream)
 		}()
 	}
 }
@@ -381,50 +807,191 @@ func server() {
 	log.Info("proxy server start")
 	defer log.Info("proxy server quit")
 
-	var die chan struct{}
-	if proxyMode == 0 {
-		die = make(chan struct{})
-	}
-	lis := protocol.New(s5.ConnConfig)
+	p, _ := current()
+	lis := protocol.New(p.ConnConfig)
 	if err := lis.Listen(proxyServer); err == nil {
 		defer lis.Close()
+		defer trackTransport(lis)()
+		// 退出中保持监听, kcp的监听关闭后其上的会话也随之断开
+		closeOnExit(lis)
 		for {
 			conn, err := lis.Accept()
 			if err != nil {
 				log.Error("[server] Outside accept err: ", err)
 				return
 			}
+			if isStopping() {
+				conn.Close()
+				continue
+			}
 			conn.SetReadTimeout(0)
 			conn.SetWriteTimeout(0)
 
 			if proxyMode == 0 {
-				close(die)              // 反方向代理时, <[内网]服务器>重启时会重新连接上<[公网]服务器>, <[公网]服务器>需要关闭上一条连接里开启的本地端口监听
-				time.Sleep(time.Second) // 等待清理完成
-				die = make(chan struct{})
-				go muxClient(conn, die)
+				// 反方向代理时按内网客户端的标识开启各自的本地端口监听, 同一客户端重新连接时替换旧隧道
+				go serveAgent(conn)
 			} else if proxyMode == 1 {
-				go muxServer(conn)
+				go muxServer(conn, "")
 			}
 		}
 	}
 }
 
+// client 保持到服务端的隧道, 断开后按指数退避重连, 重连后重新开启本地监听
 func client() {
 	log.Info("proxy client start")
 	defer log.Info("proxy client quit")
 
-	conn := protocol.New(s5.ConnConfig)
-	err := conn.Dial(proxyServer)
-	if err != nil {
-		log.Error("[client] Dial err: ", err)
-		return
+	b := &backoff{config: reconnect}
+	for !isStopping() {
+		log.Info("[client] state: connecting ", proxyServer)
+		start := time.Now()
+		err := clientConn()
+		if err != nil {
+			log.Error("[client] state: dial failed: ", err)
+		} else {
+			log.Warn("[client] state: disconnected after ", time.Since(start).Round(time.Second))
+		}
+
+		delay, ok := b.after(err)
+		if !ok {
+			log.Fatal("[client] state: give up after ", reconnect.MaxRetries, " retries")
+		}
+		if isStopping() {
+			return
+		}
+		metricTunnelReconnects.With().Inc()
+		log.Info("[client] state: reconnect in ", delay.Round(time.Millisecond), " (attempt ", b.attempt, ")")
+		select {
+		case <-time.After(delay):
+		case <-stopping:
+		}
+	}
+}
+
+// clientConn 建立一次隧道, 握手失败或被服务端拒绝时返回错误, 隧道建立后断开时返回nil
+func clientConn() error {
+	p, _ := current()
+	conn := protocol.New(p.ConnConfig)
+	if err := conn.Dial(proxyServer); err != nil {
+		return err
 	}
 	defer conn.Close()
+	defer trackTransport(conn)()
 	conn.SetReadTimeout(0)
 	conn.SetWriteTimeout(0)
+
+	log.Info("[client] state: connected ", proxyServer)
+	metricTunnelUp.With().Set(1)
+	defer metricTunnelUp.With().Set(0)
 	if proxyMode == 0 {
-		muxServer(conn)
+		return muxServer(conn, clientID)
 	} else if proxyMode == 1 {
-		muxClient(conn, nil)
+		if _, err := readHello(conn); err != nil {
+			return err
+		}
+		muxClient(conn, "", nil)
+	}
+	return nil
+}
+
+// reconnectPolicy 客户端重连策略
+type reconnectPolicy struct {
+	Initial    time.Duration // 首次重连等待
+	Max        time.Duration // 等待上限
+	Multiplier float64
+	Jitter     float64 // 随机抖动比例 0~1
+	MaxRetries int     // 连续重连次数上限, 0不限
+}
+
+// backoff 指数退避
+type backoff struct {
+	config  reconnectPolicy
+	attempt int
+}
+
+func (b *backoff) reset() { b.attempt = 0 }
+
+// after 一次连接结束后的等待时间, 握手成功(err为nil)即视为恢复正常, 从initial重新退避
+func (b *backoff) after(err error) (time.Duration, bool) {
+	if err == nil {
+		b.reset()
+	}
+	return b.next()
+}
+
+// next 下一次重连的等待时间, 超过重连次数上限时返回false
+func (b *backoff) next() (time.Duration, bool) {
+	if b.config.MaxRetries > 0 && b.attempt >= b.config.MaxRetries {
+		return 0, false
+	}
+	delay := float64(b.config.Initial) * math.Pow(b.config.Multiplier, float64(b.attempt))
+	if delay > float64(b.config.Max) {
+		delay = float64(b.config.Max)
+	}
+	delay *= 1 + b.config.Jitter*(2*rand.Float64()-1)
+	b.attempt++
+	return time.Duration(delay), true
+}
+
+// tunnel 一条隧道及其smux会话
+type tunnel struct {
+	conn    io.ReadWriteCloser
+	session *mux.Session
+}
+
+var (
+	tunnelsMu sync.Mutex
+	tunnels   = make(map[*tunnel]struct{})
+)
+
+func addTunnel(conn io.ReadWriteCloser, session *mux.Session) *tunnel {
+	t := &tunnel{conn: conn, session: session}
+	tunnelsMu.Lock()
+	tunnels[t] = struct{}{}
+	tunnelsMu.Unlock()
+	return t
+}
+
+func removeTunnel(t *tunnel) {
+	tunnelsMu.Lock()
+	delete(tunnels, t)
+	tunnelsMu.Unlock()
+}
+
+// tunnelStats 单条隧道的统计
+type tunnelStats struct {
+	Remote  string
+	Streams int
+	Kcp     *protocol.KcpStats `json:",omitempty"`
+}
+
+// statsHandler GET /stats 各隧道的smux流数量与传输层统计(目前只有kcp), 时间单位为纳秒
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	tunnelsMu.Lock()
+	list := make([]*tunnel, 0, len(tunnels))
+	for t := range tunnels {
+		list = append(list, t)
+	}
+	tunnelsMu.Unlock()
+
+	stats := make([]tunnelStats, 0, len(list))
+	for _, t := range list {
+		st := tunnelStats{Streams: t.session.NumStreams()}
+		if c, ok := t.conn.(protocol.CommonConn); ok {
+			st.Remote = c.RemoteAddr().String()
+		}
+		if k, ok := t.conn.(*protocol.KcpConn); ok {
+			kst := k.Stats()
+			st.Kcp = &kst
+		}
+		stats = append(stats, st)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(stats); err != nil {
+		log.Error("[stats] encode err: ", err)
 	}
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"socks5"
+	"socks5/protocol"
+	"socks5/rule"
+
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+/*
+配置热加载: SIGHUP 或配置文件变化时重新读取配置, 隧道与已建立的连接不受影响
+	proxy_router  增删改路由, 删除的路由关闭监听及其上的连接
+	socks5        认证用户与认证方法, 对之后的握手生效
+	addr_map      目标地址改写, 对之后的连接生效
+	outbound      出站规则, 对之后的连接生效
+	remote_router 内网客户端重新声明注册的路由
+	route_allow   撤销不再允许的注册路由
+	clients       内网客户端的认证密钥, 对之后的hello生效, 密钥变化的客户端注册的路由被撤销
+	kcp.key/keys  密钥环, 当前隧道立即生效
+配置无效时保留正在使用的配置. 其余配置项的修改需要重启
+*/
+
+// liveConfig 可在运行中替换的配置
+type liveConfig struct {
+	s5       *socks5.S5Protocol
+	routes   []route
+	remote   []route
+	allow    []routeAllow
+	clients  map[string]string
+	outbound *rule.Router
+}
+
+var (
+	// configMu 串行化配置的重新加载与管理接口对配置文件的修改
+	configMu sync.Mutex
+	// liveMu 保护s5, outboundRouter, proxyRouter, remoteRouter, routeAllows, clientSecrets
+	liveMu sync.RWMutex
+	// startSettings 启动时需要重启才能生效的配置项
+	startSettings map[string]interface{}
+	// kcpKeys 当前使用的kcp.key与kcp.keys
+	kcpKeys []string
+)
+
+// reloadDelay 配置文件变化后等待的时间, 编辑器保存时可能先清空文件再写入
+const reloadDelay = time.Millisecond * 200
+
+// parseLiveConfig 从viper读取可热加载的配置, connConfig为使用的传输层配置
+func parseLiveConfig(src *viper.Viper, connConfig protocol.Config) (*liveConfig, error) {
+	p, err := socks5Config(src, connConfig)
+	if err != nil {
+		return nil, err
+	}
+	r, err := routeConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := remoteRouteConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := routeAllowConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := clientsConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	outbound, err := outboundConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	return &liveConfig{s5: p, routes: r, remote: remote, allow: allow, clients: clients, outbound: outbound}, nil
+}
+
+// current 当前的socks5协议与出站路由
+func current() (*socks5.S5Protocol, *rule.Router) {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+	return s5, outboundRouter
+}
+
+// currentRemoteRoutes 当前要注册到服务端的路由
+func currentRemoteRoutes() []route {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+	return remoteRouter
+}
+
+// currentRouteAllows 当前允许客户端注册的路由
+func currentRouteAllows() []routeAllow {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+	return routeAllows
+}
+
+// currentClientSecrets 当前内网客户端的认证密钥
+func currentClientSecrets() map[string]string {
+	liveMu.RLock()
+	defer liveMu.RUnlock()
+	return clientSecrets
+}
+
+// watchConfig 收到SIGHUP或配置文件变化时重新加载
+func watchConfig() {
+	startSettings = restartSettings(viper.GetViper())
+	kcpKeys = configKcpKeys(viper.GetViper())
+
+	// 连续的变化只加载一次
+	var timer *time.Timer
+	_, err := watchFile(viper.ConfigFileUsed(), func() {
+		if timer == nil {
+			timer = time.AfterFunc(reloadDelay, func() { reload("config file changed") })
+		} else {
+			timer.Reset(reloadDelay)
+		}
+	})
+	if err != nil {
+		log.Error("[reload] watch config err: ", err, ", reload with SIGHUP only")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload("SIGHUP")
+		}
+	}()
+}
+
+// watchFile 文件被写入或替换时调用changed, 监听所在目录以发现编辑器的重命名保存
+func watchFile(path string, changed func()) (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Clean(path)
+	if err := w.Add(filepath.Dir(file)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) == file && e.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					changed()
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Error("[reload] watch config err: ", err)
+			}
+		}
+	}()
+	return w, nil
+}
+
+// reload 重新读取配置文件并应用可热加载的部分, 任何一项无效时整体放弃
+// 文件先解析到单独的viper实例, 全部应用成功后才替换全局配置
+func reload(reason string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	data, err := os.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		log.Error("[reload] ", reason, ": config rejected, keep current: ", err)
+		return
+	}
+	src := viper.New()
+	src.SetConfigFile(viper.ConfigFileUsed())
+	if err := src.ReadConfig(bytes.NewReader(data)); err != nil {
+		log.Error("[reload] ", reason, ": config rejected, keep current: ", err)
+		return
+	}
+	old, _ := current()
+	keys := configKcpKeys(src)
+	connConfig, keysChanged := reloadKcpKeys(old.ConnConfig, keys)
+	next, err := parseLiveConfig(src, connConfig)
+	if err != nil {
+		log.Error("[reload] ", reason, ": config rejected, keep current: ", err)
+		return
+	}
+
+	// 路由需要开启监听, 可能失败, 先于其它配置应用
+	changes, err := routes.sync(next.routes)
+	if err != nil {
+		log.Error("[reload] ", reason, ": config rejected, keep current: ", err)
+		return
+	}
+
+	// 与解析时读取的内容相同, 不会失败
+	if err := viper.ReadConfig(bytes.NewReader(data)); err != nil {
+		log.Error("[reload] ", reason, ": replace config err: ", err)
+	}
+	liveMu.Lock()
+	remoteChanged := !reflect.DeepEqual(remoteRouter, next.remote)
+	s5, proxyRouter, outboundRouter = next.s5, next.routes, next.outbound
+	remoteRouter, routeAllows, clientSecrets = next.remote, next.allow, next.clients
+	liveMu.Unlock()
+
+	// 不再被允许的注册路由被撤销, 客户端的路由变化时重新注册
+	changes = append(changes, routes.prune(allowRoute)...)
+	if remoteChanged {
+		notifyControl()
+		changes = append(changes, "remote router re-registered")
+	}
+
+	if keysChanged {
+		kcpKeys = keys
+		setTransportKeys(keys[0], keys[1:]...)
+		changes = append(changes, "kcp keys rotated")
+	}
+	for _, key := range changedSettings(startSettings, restartSettings(src)) {
+		log.Warn("[reload] ", key, " changed, restart required to apply")
+	}
+
+	log.Info("[reload] ", reason, ": applied, socks5 auth ", authMethodNames(next.s5.AuthMethodSupport),
+		", addr map ", next.s5.AddrMap.Len(), " entries, ", outboundSummary(next.outbound))
+	for _, c := range changes {
+		log.Info("[reload] ", c)
+	}
+}
+
+// configKcpKeys 配置文件中的kcp.key与kcp.keys, 第一个为当前密钥
+func configKcpKeys(src *viper.Viper) []string {
+	return append([]string{src.GetString("kcp.key")}, src.GetStringSlice("kcp.keys")...)
+}
+
+// reloadKcpKeys kcp密钥变化时返回更新了密钥的配置副本, 之后建立的连接使用新密钥, 原配置不被修改
+func reloadKcpKeys(connConfig interface{}, keys []string) (protocol.Config, bool) {
+	kc, ok := connConfig.(*protocol.KcpConfig)
+	if !ok || kc == nil {
+		config, _ := connConfig.(protocol.Config)
+		return config, false
+	}
+	if strings.Join(keys, "\x00") == strings.Join(kcpKeys, "\x00") {
+		return kc, false
+	}
+	next := *kc
+	next.Key, next.Keys = keys[0], keys[1:]
+	return &next, true
+}
+
+// keyedConn 可在运行中替换密钥的传输层
+type keyedConn interface {
+	SetKeys(key string, keys ...string)
+}
+
+var (
+	keyedMu    sync.Mutex
+	keyedConns = make(map[keyedConn]struct{})
+)
+
+// trackTransport 登记传输层, 热加载时替换其密钥, 返回注销函数
+func trackTransport(conn protocol.Conn) func() {
+	k, ok := conn.(keyedConn)
+	if !ok {
+		return func() {}
+	}
+	keyedMu.Lock()
+	keyedConns[k] = struct{}{}
+	keyedMu.Unlock()
+	return func() {
+		keyedMu.Lock()
+		delete(keyedConns, k)
+		keyedMu.Unlock()
+	}
+}
+
+func setTransportKeys(key string, keys ...string) {
+	keyedMu.Lock()
+	defer keyedMu.Unlock()
+	for k := range keyedConns {
+		k.SetKeys(key, keys...)
+	}
+}
+
+// restartSettings 需要重启才能生效的配置项
+func restartSettings(src *viper.Viper) map[string]interface{} {
+	all := src.AllSettings()
+	for _, key := range []string{"proxy_router", "remote_router", "route_allow", "clients", "socks5", "addr_map", "outbound"} {
+		delete(all, key)
+	}
+	if kcp, ok := all["kcp"].(map[string]interface{}); ok {
+		delete(kcp, "key")
+		delete(kcp, "keys")
+	}
+	return all
+}
+
+// changedSettings a与b中值不同的顶层配置项
+func changedSettings(a, b map[string]interface{}) (keys []string) {
+	for k, v := range a {
+		if !reflect.DeepEqual(v, b[k]) {
+			keys = append(keys, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+func authMethodNames(methods []byte) []string {
+	names := make([]string, 0, len(methods))
+	for _, m := range methods {
+		names = append(names, socks5.AuthMethodName[m])
+	}
+	return names
+}
+
+func outboundSummary(r *rule.Router) string {
+	if r == nil {
+		return "outbound none"
+	}
+	return fmt.Sprint("outbound default ", r.Default, ", ", len(r.Rules), " rules")
+}
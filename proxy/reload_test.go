@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestReloadRejectsInvalid 无效的配置整体放弃, 保留正在使用的配置; 有效的配置随后正常应用
+func TestReloadRejectsInvalid(t *testing.T) {
+	const valid = `{
+		"socks5": {"username": "u", "password": "p"},
+		"proxy_router": [{"in": "127.0.0.1:1080", "out": "10.0.0.1:22"}]
+	}`
+	path := filepath.Join(t.TempDir(), "server.json")
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(valid)
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	baseConfig()
+	t.Cleanup(func() { routes.load(nil) })
+	startSettings, kcpKeys = restartSettings(viper.GetViper()), configKcpKeys(viper.GetViper())
+	t.Cleanup(func() { startSettings, kcpKeys = nil, nil })
+
+	old, oldOutbound := current()
+	oldRoutes := routes.list()
+
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"malformed json", `{"socks5": {"username": "v"`},
+		{"route without out", `{
+			"socks5": {"username": "v", "password": "p"},
+			"proxy_router": [{"in": "127.0.0.1:1081"}]
+		}`},
+		{"outbound rules not a list", `{
+			"socks5": {"username": "v", "password": "p"},
+			"outbound": {"rules": "direct"}
+		}`},
+		{"invalid unix target", `{
+			"socks5": {"username": "v", "password": "p", "unix_targets": ["/run/[app.sock"]}
+		}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write(tt.config)
+			reload("test")
+			if p, outbound := current(); p != old || outbound != oldOutbound {
+				t.Error("socks5 or outbound config replaced by an invalid config")
+			}
+			if got := routes.list(); !reflect.DeepEqual(got, oldRoutes) {
+				t.Errorf("routes = %+v, want %+v", got, oldRoutes)
+			}
+			if got := viper.GetString("socks5.username"); got != "u" {
+				t.Errorf("viper username %q after an invalid reload, want u", got)
+			}
+		})
+	}
+
+	write(`{
+		"socks5": {"username": "v", "password": "p"},
+		"proxy_router": [{"in": "127.0.0.1:1081", "out": "10.0.0.1:22"}]
+	}`)
+	reload("test")
+	if p, _ := current(); p.Username != "v" || viper.GetString("socks5.username") != "v" {
+		t.Errorf("username %q, viper %q after a valid reload, want v", p.Username, viper.GetString("socks5.username"))
+	}
+	if got := routes.list(); len(got) != 1 || got[0].In != "127.0.0.1:1081" {
+		t.Errorf("routes after a valid reload = %+v", got)
+	}
+}
+
+// TestWatchConfig 文件写入触发重新加载, 无效的内容不进入全局配置
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"socks5": {"username": "u", "password": "p"}}`)
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	baseConfig()
+	t.Cleanup(func() { routes.load(nil) })
+	startSettings, kcpKeys = restartSettings(viper.GetViper()), configKcpKeys(viper.GetViper())
+	t.Cleanup(func() { startSettings, kcpKeys = nil, nil })
+
+	reloaded := make(chan struct{}, 16)
+	w, err := watchFile(path, func() {
+		reload("test")
+		reloaded <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	wait := func() {
+		t.Helper()
+		select {
+		case <-reloaded:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reload after write")
+		}
+		// 一次写入可能产生多个事件
+		for {
+			select {
+			case <-reloaded:
+			case <-time.After(200 * time.Millisecond):
+				return
+			}
+		}
+	}
+
+	old, _ := current()
+	write(`{"socks5": {"username": "x", "auth_methods": ["kerberos"]}}`)
+	wait()
+	if p, _ := current(); p != old {
+		t.Error("live config replaced by an invalid file")
+	}
+	if got := viper.GetString("socks5.username"); got != "u" {
+		t.Errorf("viper username %q after an invalid file, want u", got)
+	}
+
+	write(`{"socks5": {"username": "v", "password": "p"}}`)
+	wait()
+	if p, _ := current(); p.Username != "v" || viper.GetString("socks5.username") != "v" {
+		t.Errorf("username %q, viper %q after a valid file, want v", p.Username, viper.GetString("socks5.username"))
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"socks5"
+
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	errRouteExists     = errors.New("<route already exists>")
+	errRouteNotFound   = errors.New("<route not found>")
+	errRouteRegistered = errors.New("<route registered by client>")
+)
+
+// routeServe 经当前隧道转发一条本地连接
+type routeServe func(conn net.Conn, routeName, remoteAddr string)
+
+// routeTunnel 某个客户端当前的隧道
+type routeTunnel struct {
+	serve routeServe
+	gen   int
+}
+
+// routeManager proxy_router 路由表, 路由所属客户端的隧道可用时开启本地监听
+// 路由可以在运行中增删改, 修改同步到对应隧道的监听.
+// 模式0的服务端可以接入多个内网客户端, 路由的Client为负责转发的客户端标识, 为空时属于未设置 client_id 的客户端.
+// 客户端经控制流注册的路由(Registered)只在其隧道可用期间存在
+type routeManager struct {
+	mu        sync.Mutex
+	routes    []route                   // 配置顺序
+	listeners map[string]*routeListener // in -> 监听, 所属隧道不可用时没有
+	tunnels   map[string]*routeTunnel   // 客户端标识 -> 当前隧道
+	gen       int                       // 每次attach递增, 避免旧隧道关闭新隧道的监听
+	stopped   bool                      // 进程退出中, 不再开启监听
+}
+
+var routes = &routeManager{
+	listeners: make(map[string]*routeListener),
+	tunnels:   make(map[string]*routeTunnel),
+}
+
+// load 以配置中的路由替换路由表, 只在启动时调用
+func (m *routeManager) load(r []route) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes = append([]route(nil), r...)
+}
+
+// list 路由表副本
+func (m *routeManager) list() []route {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]route(nil), m.routes...)
+}
+
+// attach 客户端的隧道可用, 开启其所有路由的监听, 同一客户端之前的隧道的监听被关闭, 返回的gen用于detach
+// 监听失败的路由记录错误日志, 不影响其它路由
+func (m *routeManager) attach(client string, serve routeServe) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeListeners(client, 0)
+	m.dropRegistered(client)
+	m.gen++
+	if m.stopped {
+		return m.gen
+	}
+	m.tunnels[client] = &routeTunnel{serve: serve, gen: m.gen}
+	for _, r := range m.routes {
+		if r.Client != client {
+			continue
+		}
+		rl, err := m.listen(r, serve)
+		if err != nil {
+			log.Error("[route] ", err)
+			continue
+		}
+		m.listeners[r.In] = rl
+	}
+	return m.gen
+}
+
+// detach 隧道断开, 关闭其监听及监听上的连接
+func (m *routeManager) detach(client string, gen int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tunnels[client]; !ok || t.gen != gen {
+		return
+	}
+	delete(m.tunnels, client)
+	m.closeListeners(client, 0)
+	m.dropRegistered(client)
+}
+
+// dropRegistered 从路由表删除client注册的路由, 调用时持有mu且其监听已关闭
+func (m *routeManager) dropRegistered(client string) {
+	kept := m.routes[:0]
+	for _, r := range m.routes {
+		if !r.Registered || r.Client != client {
+			kept = append(kept, r)
+		}
+	}
+	m.routes = kept
+}
+
+// register 以decl替换client注册的路由, 返回各路由的结果(与decl一一对应)
+// 与其它路由的in冲突的路由被拒绝, 隧道可用时立即开启监听
+func (m *routeManager) register(client string, decl []route) []error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs := make([]error, len(decl))
+	declared := make(map[string]bool)
+	for i, r := range decl {
+		r.Client, r.Registered = client, true
+		j := m.index(r.In)
+		if j >= 0 {
+			if old := m.routes[j]; !old.Registered || old.Client != client {
+				errs[i] = errRouteExists
+				continue
+			}
+			declared[r.In] = true
+			m.routes[j] = r
+			if rl, ok := m.listeners[r.In]; ok {
+				rl.setOut(r.Out)
+			}
+			continue
+		}
+		if serve := m.serving(client); serve != nil {
+			rl, err := m.listen(r, serve)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			m.listeners[r.In] = rl
+		}
+		declared[r.In] = true
+		m.routes = append(m.routes, r)
+	}
+
+	// 本次未声明的路由视为取消注册
+	m.removeWhere(func(r route) bool {
+		return r.Registered && r.Client == client && !declared[r.In]
+	})
+	return errs
+}
+
+// prune 删除allow返回错误的注册路由, 用于允许列表变化后, 返回变化的说明
+func (m *routeManager) prune(allow func(client, in string) error) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removeWhere(func(r route) bool {
+		return r.Registered && allow(r.Client, r.In) != nil
+	})
+}
+
+// removeWhere 删除满足match的路由并关闭其监听及连接, 调用时持有mu
+func (m *routeManager) removeWhere(match func(route) bool) (changes []string) {
+	kept := m.routes[:0]
+	for _, r := range m.routes {
+		if !match(r) {
+			kept = append(kept, r)
+			continue
+		}
+		changes = append(changes, "route remove "+r.In+clientSuffix(r.Client))
+		if rl, ok := m.listeners[r.In]; ok {
+			rl.close(0)
+			delete(m.listeners, r.In)
+		}
+	}
+	m.routes = kept
+	return
+}
+
+// serving 客户端当前隧道的转发函数, 隧道不可用或退出中时返回nil, 调用时持有mu
+func (m *routeManager) serving(client string) routeServe {
+	if t, ok := m.tunnels[client]; ok && !m.stopped {
+		return t.serve
+	}
+	return nil
+}
+
+// stop 停止接受新连接, 已建立的连接继续转发直到隧道断开, 之后不再开启监听
+func (m *routeManager) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	for _, rl := range m.listeners {
+		rl.lis.Close()
+	}
+}
+
+// active 各路由上尚未结束的连接数
+func (m *routeManager) active() (n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, rl := range m.listeners {
+		rl.mu.Lock()
+		n += len(rl.conns)
+		rl.mu.Unlock()
+	}
+	return
+}
+
+// closeListeners 关闭属于client的监听, 调用时持有mu
+func (m *routeManager) closeListeners(client string, drain time.Duration) {
+	for in, rl := range m.listeners {
+		if rl.client() == client {
+			rl.close(drain)
+			delete(m.listeners, in)
+		}
+	}
+}
+
+// listen 开启一条路由的监听, 调用时持有mu
+func (m *routeManager) listen(r route, serve routeServe) (*routeListener, error) {
+	lis, err := socks5.ListenAddr(r.In)
+	if err != nil {
+		return nil, fmt.Errorf("<[listen] %s %w>", r.In, err)
+	}
+	rl := &routeListener{route: r, lis: lis, conns: make(map[net.Conn]struct{})}
+	log.Info("[route] listen at ", r.In, clientSuffix(r.Client))
+	go rl.serve(serve)
+	return rl, nil
+}
+
+// add 新增路由, 所属客户端的隧道可用时立即开启监听
+func (m *routeManager) add(r route) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.index(r.In) >= 0 {
+		return errRouteExists
+	}
+	if serve := m.serving(r.Client); serve != nil {
+		rl, err := m.listen(r, serve)
+		if err != nil {
+			return err
+		}
+		m.listeners[r.In] = rl
+	}
+	m.routes = append(m.routes, r)
+	return nil
+}
+
+// update 修改路由的出口地址与所属客户端, 只影响之后的连接
+// 所属客户端改变时关闭原监听及其上的连接, 在新客户端的隧道上重新监听
+func (m *routeManager) update(r route) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(r.In)
+	if i < 0 {
+		return errRouteNotFound
+	}
+	if m.routes[i].Registered {
+		return errRouteRegistered
+	}
+	if m.routes[i].Client != r.Client {
+		if err := m.move(r); err != nil {
+			return err
+		}
+	} else if rl, ok := m.listeners[r.In]; ok {
+		rl.setOut(r.Out)
+	}
+	m.routes[i] = r
+	return nil
+}
+
+// move 将路由的监听转移到r.Client的隧道, 调用时持有mu
+func (m *routeManager) move(r route) error {
+	if rl, ok := m.listeners[r.In]; ok {
+		rl.close(0)
+		delete(m.listeners, r.In)
+	}
+	if serve := m.serving(r.Client); serve != nil {
+		rl, err := m.listen(r, serve)
+		if err != nil {
+			return err
+		}
+		m.listeners[r.In] = rl
+	}
+	return nil
+}
+
+// remove 删除路由并关闭监听, drain>0时已建立的连接最多再保持drain, 否则立即关闭
+// 返回关闭时仍在转发的连接数
+func (m *routeManager) remove(in string, drain time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(in)
+	if i < 0 {
+		return 0, errRouteNotFound
+	}
+	if m.routes[i].Registered {
+		return 0, errRouteRegistered
+	}
+	m.routes = append(m.routes[:i], m.routes[i+1:]...)
+	rl, ok := m.listeners[in]
+	if !ok {
+		return 0, nil
+	}
+	delete(m.listeners, in)
+	return rl.close(drain), nil
+}
+
+// index 路由在路由表中的位置, 调用时持有mu
+func (m *routeManager) index(in string) int {
+	for i, r := range m.routes {
+		if r.In == in {
+			return i
+		}
+	}
+	return -1
+}
+
+// sync 以新的路由表替换配置中的路由, 客户端注册的路由保持不变, 返回变化的说明
+// 新增路由的监听全部开启成功后才会生效, 否则路由表保持不变
+func (m *routeManager) sync(next []route) (changes []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var registered []route
+	for _, r := range m.routes {
+		if r.Registered {
+			registered = append(registered, r)
+		}
+	}
+	for _, r := range next {
+		if i := m.index(r.In); i >= 0 && m.routes[i].Registered {
+			return nil, fmt.Errorf("<route %s registered by client '%s'>", r.In, m.routes[i].Client)
+		}
+	}
+
+	opened := make(map[string]*routeListener)
+	for _, r := range next {
+		if m.index(r.In) >= 0 {
+			continue
+		}
+		serve := m.serving(r.Client)
+		if serve == nil {
+			continue
+		}
+		rl, err := m.listen(r, serve)
+		if err != nil {
+			for _, rl := range opened {
+				rl.close(0)
+			}
+			return nil, err
+		}
+		opened[r.In] = rl
+	}
+
+	keep := make(map[string]bool)
+	for _, r := range next {
+		keep[r.In] = true
+		i := m.index(r.In)
+		switch {
+		case i < 0:
+			changes = append(changes, "route add "+r.In+" -> "+r.Out+clientSuffix(r.Client))
+			if rl, ok := opened[r.In]; ok {
+				m.listeners[r.In] = rl
+			}
+		case m.routes[i].Client != r.Client:
+			changes = append(changes, "route move "+r.In+" -> "+r.Out+clientSuffix(r.Client))
+			if err := m.move(r); err != nil {
+				log.Error("[route] ", err)
+			}
+		case m.routes[i].Out != r.Out:
+			changes = append(changes, "route update "+r.In+" -> "+r.Out+clientSuffix(r.Client))
+			if rl, ok := m.listeners[r.In]; ok {
+				rl.setOut(r.Out)
+			}
+		}
+	}
+	for _, r := range m.routes {
+		if keep[r.In] || r.Registered {
+			continue
+		}
+		changes = append(changes, "route remove "+r.In)
+		if rl, ok := m.listeners[r.In]; ok {
+			rl.close(0)
+			delete(m.listeners, r.In)
+		}
+	}
+	m.routes = append(append([]route(nil), next...), registered...)
+	return changes, nil
+}
+
+// clientSuffix 日志中的客户端标识
+func clientSuffix(client string) string {
+	if client == "" {
+		return ""
+	}
+	return " (client " + client + ")"
+}
+
+// save 将路由表写回配置文件, 只修改proxy_router项
+// 使用单独的viper实例, 避免Set的值覆盖之后重新加载的配置
+func (m *routeManager) save() error {
+	list := m.list()
+	conf := make([]interface{}, 0, len(list))
+	for _, r := range list {
+		if r.Registered {
+			continue
+		}
+		item := map[string]interface{}{"in": r.In, "out": r.Out}
+		if r.Client != "" {
+			item["client"] = r.Client
+		}
+		conf = append(conf, item)
+	}
+	v := viper.New()
+	v.SetConfigFile(viper.ConfigFileUsed())
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	v.Set("proxy_router", conf)
+	return v.WriteConfig()
+}
+
+// routeListener 一条路由的本地监听及其上的连接
+type routeListener struct {
+	mu    sync.Mutex
+	route route
+	lis   net.Listener
+	conns map[net.Conn]struct{}
+}
+
+func (rl *routeListener) serve(serve routeServe) {
+	for {
+		conn, err := rl.lis.Accept()
+		if err != nil {
+			log.Info("[route] listener closed ", rl.route.In)
+			return
+		}
+
+		rl.mu.Lock()
+		rl.conns[conn] = struct{}{}
+		out := rl.route.Out
+		rl.mu.Unlock()
+
+		go func() {
+			defer func() {
+				rl.mu.Lock()
+				delete(rl.conns, conn)
+				rl.mu.Unlock()
+			}()
+			// socks5操作
+			serve(conn, rl.route.In, out)
+		}()
+	}
+}
+
+func (rl *routeListener) client() string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.route.Client
+}
+
+func (rl *routeListener) setOut(out string) {
+	rl.mu.Lock()
+	rl.route.Out = out
+	rl.mu.Unlock()
+}
+
+// close 关闭监听, drain>0时等待连接结束, 超时后关闭剩余连接, 返回关闭监听时的连接数
+func (rl *routeListener) close(drain time.Duration) int {
+	rl.lis.Close()
+
+	rl.mu.Lock()
+	n := len(rl.conns)
+	rl.mu.Unlock()
+	if drain > 0 {
+		time.AfterFunc(drain, rl.closeConns)
+	} else {
+		rl.closeConns()
+	}
+	return n
+}
+
+func (rl *routeListener) closeConns() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for conn := range rl.conns {
+		conn.Close()
+	}
+}
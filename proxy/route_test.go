@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testRoutes 独立的路由表, 测试结束时关闭全部监听
+func testRoutes(t *testing.T, r ...route) *routeManager {
+	m := &routeManager{
+		listeners: make(map[string]*routeListener),
+		tunnels:   make(map[string]*routeTunnel),
+	}
+	m.load(r)
+	t.Cleanup(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for in, rl := range m.listeners {
+			rl.close(0)
+			delete(m.listeners, in)
+		}
+	})
+	return m
+}
+
+func discard(conn net.Conn, routeName, remoteAddr string) { conn.Close() }
+
+// listening 路由当前是否有监听
+func (m *routeManager) listening(in string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.listeners[in]
+	return ok
+}
+
+// TestAttachListenError 某条路由监听失败只记录日志, 其它路由照常开启
+func TestAttachListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	free := "unix:" + filepath.Join(t.TempDir(), "free.sock")
+
+	m := testRoutes(t, route{In: busy.Addr().String(), Out: "127.0.0.1:1"}, route{In: free, Out: "127.0.0.1:1"})
+	m.attach("", discard)
+	if m.listening(busy.Addr().String()) {
+		t.Error("listener recorded for an address in use")
+	}
+	if !m.listening(free) {
+		t.Error("route after the failed one not listening")
+	}
+}
+
+// registered client注册的路由, in -> out
+func (m *routeManager) registered(client string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := make(map[string]string)
+	for _, rt := range m.routes {
+		if rt.Registered && rt.Client == client {
+			r[rt.In] = rt.Out
+		}
+	}
+	return r
+}
+
+// TestRegister 注册的路由不能与其它路由的in冲突, 再次声明时替换该客户端之前注册的全部路由
+func TestRegister(t *testing.T) {
+	dir := t.TempDir()
+	sock := func(name string) string { return "unix:" + filepath.Join(dir, name+".sock") }
+	m := testRoutes(t, route{In: sock("config"), Out: "127.0.0.1:1", Client: "office"})
+	m.attach("office", discard)
+
+	errs := m.register("office", []route{
+		{In: sock("a"), Out: "127.0.0.1:80"},
+		{In: sock("config"), Out: "127.0.0.1:80"},
+	})
+	if errs[0] != nil || errs[1] != errRouteExists {
+		t.Errorf("register errs = %v, want [nil %v]", errs, errRouteExists)
+	}
+	if !m.listening(sock("a")) {
+		t.Error("registered route not listening while the tunnel is attached")
+	}
+
+	// 其它客户端不能占用
+	if errs := m.register("lab", []route{{In: sock("a"), Out: "127.0.0.1:22"}}); errs[0] != errRouteExists {
+		t.Errorf("lab took office's route: %v", errs[0])
+	}
+
+	// 替换: a修改out, 新增c
+	m.register("office", []route{{In: sock("a"), Out: "127.0.0.1:82"}, {In: sock("c"), Out: "127.0.0.1:83"}})
+	want := map[string]string{sock("a"): "127.0.0.1:82", sock("c"): "127.0.0.1:83"}
+	if got := m.registered("office"); !reflect.DeepEqual(got, want) {
+		t.Errorf("registered = %v, want %v", got, want)
+	}
+	if !m.listening(sock("a")) || !m.listening(sock("c")) {
+		t.Error("replaced routes not listening")
+	}
+	// 未再声明的a被删除
+	m.register("office", []route{{In: sock("c"), Out: "127.0.0.1:83"}})
+	if got := m.registered("office"); len(got) != 1 || got[sock("c")] == "" {
+		t.Errorf("registered = %v, want only %s", got, sock("c"))
+	}
+	if m.listening(sock("a")) {
+		t.Error("undeclared route still listening")
+	}
+	if !m.listening(sock("config")) {
+		t.Error("configured route closed by registration")
+	}
+
+	// 隧道断开时注册的路由随之删除, 配置中的路由保留
+	m.detach("office", m.gen)
+	if got := m.registered("office"); len(got) != 0 {
+		t.Errorf("registered after detach = %v", got)
+	}
+	if len(m.list()) != 1 {
+		t.Errorf("routes after detach = %+v", m.list())
+	}
+}
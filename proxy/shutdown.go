@@ -0,0 +1,125 @@
+package main
+
+import (
+	"socks5"
+
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+优雅退出: 收到SIGTERM/SIGINT后
+	1. 停止接受新的本地连接, 新隧道与新的smux流
+	2. 等待正在转发的连接结束, 最多shutdown_timeout秒, 期间再次收到信号时立即进入下一步
+	3. 关闭剩余连接, smux会话与传输层后退出
+*/
+
+// 退出码
+const (
+	exitDrained = 0 // 所有连接已正常结束
+	exitForced  = 2 // 超时或再次收到信号, 剩余连接被强制关闭
+)
+
+var (
+	shutdownTimeout = time.Second * 30
+	// stopping 收到退出信号后关闭
+	stopping = make(chan struct{})
+
+	exitMu      sync.Mutex
+	exitClosers []io.Closer
+)
+
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeOnExit 退出时在关闭隧道之后关闭c, 用于传输层的监听
+func closeOnExit(c io.Closer) {
+	exitMu.Lock()
+	exitClosers = append(exitClosers, c)
+	exitMu.Unlock()
+}
+
+// waitShutdown 等待退出信号并完成退出流程, 返回退出码
+func waitShutdown() int {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	s := <-sig
+
+	log.Info("[shutdown] ", s, " received, stop accepting, drain up to ", shutdownTimeout)
+	close(stopping)
+	routes.stop()
+
+	code := exitDrained
+	if !drain(shutdownTimeout, sig) {
+		code = exitForced
+		for _, sess := range socks5.Sessions.List(nil) {
+			socks5.Sessions.Kill(sess.ID)
+		}
+	}
+	closeTunnels()
+	exitMu.Lock()
+	for _, c := range exitClosers {
+		c.Close()
+	}
+	exitMu.Unlock()
+
+	log.Info("[shutdown] exit ", code)
+	return code
+}
+
+// drain 等待连接结束, 全部结束时返回true
+func drain(timeout time.Duration, sig <-chan os.Signal) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(time.Millisecond * 100)
+	defer tick.Stop()
+	report := time.Now()
+	for {
+		sessions, conns := socks5.Sessions.Len(), routes.active()
+		if sessions == 0 && conns == 0 {
+			log.Info("[shutdown] all connections drained")
+			return true
+		}
+		if time.Since(report) >= time.Second*5 {
+			report = time.Now()
+			log.Info("[shutdown] waiting for ", sessions, " sessions")
+		}
+
+		select {
+		case <-tick.C:
+		case <-deadline.C:
+			log.Warn("[shutdown] drain timeout, closing ", sessions, " sessions")
+			return false
+		case s := <-sig:
+			log.Warn("[shutdown] ", s, " received again, closing ", sessions, " sessions")
+			return false
+		}
+	}
+}
+
+// closeTunnels 关闭所有smux会话及其传输层连接
+func closeTunnels() {
+	tunnelsMu.Lock()
+	list := make([]*tunnel, 0, len(tunnels))
+	for t := range tunnels {
+		list = append(list, t)
+	}
+	tunnelsMu.Unlock()
+
+	for _, t := range list {
+		t.session.Close()
+		t.conn.Close()
+	}
+}
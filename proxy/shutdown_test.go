@@ -0,0 +1,62 @@
+package main
+
+import (
+	"socks5"
+
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestDrain 连接全部结束时返回true, 超时或再次收到信号时返回false
+func TestDrain(t *testing.T) {
+	if !drain(time.Second, nil) {
+		t.Fatal("drain with no sessions returned false")
+	}
+
+	// 一条转发中的会话
+	client, clientPeer := net.Pipe()
+	target, targetPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer targetPeer.Close()
+	go io.Copy(io.Discard, targetPeer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		socks5.ProxySession(&socks5.Session{User: "TestDrain"}, client, target)
+	}()
+	for deadline := time.Now().Add(2 * time.Second); socks5.Sessions.Len() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("session not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if drain(200*time.Millisecond, nil) {
+		t.Error("drain returned true with a live session")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("drain returned after %v, before the timeout", d)
+	}
+
+	sig := make(chan os.Signal, 1)
+	sig <- syscall.SIGTERM
+	start = time.Now()
+	if drain(time.Minute, sig) {
+		t.Error("drain returned true with a live session")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("second signal took %v to end the drain", d)
+	}
+
+	// 会话在等待期间结束
+	time.AfterFunc(150*time.Millisecond, func() { clientPeer.Close() })
+	if !drain(5*time.Second, nil) {
+		t.Error("drain returned false after the session ended")
+	}
+	<-done
+}
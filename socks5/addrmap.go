@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AddrMap 目标地址改写表, 服务端在connect前改写客户端请求的目标地址
+// from/to 支持三种格式:
+//
+//	"host:port" 精确匹配
+//	"host"      匹配该主机任意端口
+//	":port"     匹配任意主机的该端口
+//
+// 查找顺序为 host:port > host > :port, 只改写一次, to中为空的部分保持原值
+type AddrMap struct {
+	entries map[string]mapTarget
+}
+
+type mapTarget struct {
+	host, port string
+}
+
+// NewAddrMap 空映射表
+func NewAddrMap() *AddrMap {
+	return &AddrMap{entries: make(map[string]mapTarget)}
+}
+
+// Add 添加映射 from -> to
+func (m *AddrMap) Add(from, to string) (err error) {
+	fromHost, fromPort, err := splitMapAddr(from)
+	if err != nil {
+		return
+	}
+	if fromHost == "" && fromPort == "" {
+		return fmt.Errorf("<empty map source %s>", from)
+	}
+
+	var t mapTarget
+	if t.host, t.port, err = splitMapAddr(to); err != nil {
+		return
+	}
+	if t.host == "" && t.port == "" {
+		return fmt.Errorf("<empty map target %s>", to)
+	}
+
+	m.entries[mapKey(fromHost, fromPort)] = t
+	return
+}
+
+// Len 映射条目数
+func (m *AddrMap) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.entries)
+}
+
+// Rewrite 改写目标地址, 未命中时原样返回
+func (m *AddrMap) Rewrite(addr, port string) (string, string) {
+	if m == nil || len(m.entries) == 0 {
+		return addr, port
+	}
+
+	host := addr
+	if !strings.HasPrefix(addr, UnixPrefix) {
+		host = strings.ToLower(addr)
+	}
+	for _, key := range []string{mapKey(host, port), mapKey(host, ""), mapKey("", port)} {
+		t, ok := m.entries[key]
+		if !ok {
+			continue
+		}
+		if t.host != "" {
+			addr = t.host
+		}
+		if t.port != "" {
+			port = t.port
+		}
+		break
+	}
+	return addr, port
+}
+
+func mapKey(host, port string) string {
+	return host + "|" + port
+}
+
+// splitMapAddr 拆分 "host:port" / "host" / ":port"
+func splitMapAddr(s string) (host, port string, err error) {
+	// unix socket路径区分大小写且不带端口
+	if strings.HasPrefix(s, UnixPrefix) {
+		return s, "", nil
+	}
+	if h, p, e := net.SplitHostPort(s); e == nil {
+		host, port = h, p
+	} else {
+		host = strings.Trim(s, "[]")
+	}
+
+	if port != "" {
+		if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", fmt.Errorf("<invalid port in %s> %w", s, err)
+		}
+	}
+	return strings.ToLower(host), port, nil
+}
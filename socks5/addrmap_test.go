@@ -0,0 +1,54 @@
+package socks5
+
+import "testing"
+
+func TestAddrMapRewrite(t *testing.T) {
+	m := NewAddrMap()
+	for _, e := range [][2]string{
+		{"db.internal:5432", "10.0.0.5:6432"},
+		{"db.internal", "10.0.0.5"},
+		{":8080", ":18080"},
+		{"Web.Internal", ":9000"},
+		{"[::1]:53", "127.0.0.1"},
+		{"unix:/run/App.sock", "unix:/run/app2.sock"},
+	} {
+		if err := m.Add(e[0], e[1]); err != nil {
+			t.Fatal(e, err)
+		}
+	}
+
+	tests := []struct {
+		name             string
+		addr, port       string
+		wantAddr, wantPt string
+	}{
+		{"host:port first", "db.internal", "5432", "10.0.0.5", "6432"},
+		{"host before port", "db.internal", "8080", "10.0.0.5", "8080"},
+		{"port only", "other.host", "8080", "other.host", "18080"},
+		{"host keeps port", "db.internal", "22", "10.0.0.5", "22"},
+		{"case insensitive host", "WEB.internal", "80", "WEB.internal", "9000"},
+		{"ipv6 host:port", "::1", "53", "127.0.0.1", "53"},
+		{"unix path", "unix:/run/App.sock", "", "unix:/run/app2.sock", ""},
+		{"unix path case", "unix:/run/app.sock", "", "unix:/run/app.sock", ""},
+		{"no match", "example.com", "443", "example.com", "443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, port := m.Rewrite(tt.addr, tt.port)
+			if addr != tt.wantAddr || port != tt.wantPt {
+				t.Errorf("Rewrite(%s, %s) = %s, %s, want %s, %s",
+					tt.addr, tt.port, addr, port, tt.wantAddr, tt.wantPt)
+			}
+		})
+	}
+
+	var empty *AddrMap
+	if addr, port := empty.Rewrite("a", "1"); addr != "a" || port != "1" || empty.Len() != 0 {
+		t.Errorf("nil map rewrote to %s, %s", addr, port)
+	}
+	for _, e := range [][2]string{{"", "a"}, {"a", ""}, {"a:99999", "b"}, {"a", "b:x"}} {
+		if err := NewAddrMap().Add(e[0], e[1]); err == nil {
+			t.Errorf("Add(%q, %q) accepted", e[0], e[1])
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"io"
+)
+
+// Authenticator 认证方法
+// 方法协商完成后由S5Protocol调用, 可在conn上进行任意轮次的消息交换.
+// 返回的链接用于后续command及数据传输, 认证方法可借此对链接做完整性/机密性封装, 不需要封装时原样返回conn.
+type Authenticator interface {
+	Method() byte
+	ServerAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error)
+	ClientAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error)
+}
+
+// AuthenticatedConn 认证方法返回的链接可实现此接口, 提供认证得到的用户, 用于会话与指标
+type AuthenticatedConn interface {
+	io.ReadWriteCloser
+	AuthUser() string
+}
+
+// 内置认证方法
+var builtinAuthenticators = []Authenticator{
+	noAuth{},
+	usernamePasswdAuth{},
+	hmacAuth{},
+}
+
+// authenticator 查找认证方法实现, S5Protocol.Authenticators 优先于内置实现
+func (s *S5Protocol) authenticator(method byte) Authenticator {
+	for _, a := range s.Authenticators {
+		if a.Method() == method {
+			return a
+		}
+	}
+	for _, a := range builtinAuthenticators {
+		if a.Method() == method {
+			return a
+		}
+	}
+	return nil
+}
+
+// 无认证
+type noAuth struct{}
+
+func (noAuth) Method() byte { return AuthNoAuthRequired }
+
+func (noAuth) ServerAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	return conn, nil
+}
+
+func (noAuth) ClientAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	return conn, nil
+}
+
+// 用户名密码认证
+type usernamePasswdAuth struct{}
+
+func (usernamePasswdAuth) Method() byte { return AuthUsernamePasswd }
+
+func (usernamePasswdAuth) ServerAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	var totalBuff [256]byte
+	return conn, s.servAuthUsernamePasswd(conn, totalBuff[:], &Frame{})
+}
+
+func (usernamePasswdAuth) ClientAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	var totalBuff [8]byte
+	return conn, s.clientAuthUsernamePasswd(conn, totalBuff[:], &Frame{})
+}
+
+// HMAC挑战应答认证
+type hmacAuth struct{}
+
+func (hmacAuth) Method() byte { return AuthHMACChallenge }
+
+func (hmacAuth) ServerAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	var totalBuff [256]byte
+	return conn, s.servAuthHMAC(conn, totalBuff[:], &Frame{})
+}
+
+func (hmacAuth) ClientAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	return conn, s.clientAuthHMAC(conn, &Frame{})
+}
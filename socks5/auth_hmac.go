@@ -0,0 +1,123 @@
+package socks5
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// HMAC挑战应答认证 (AuthHMACChallenge)
+// 1. 服务端下发随机数
+// +-----+-----------+-------+
+// | VER | NONCE_LEN | NONCE |
+// +-----+-----------+-------+
+// |   1 |         1 |    32 |
+// +-----+-----------+-------+
+// 2. 客户端应答 MAC = HMAC-SHA256(secret, NONCE | USERNAME)
+// +-----+-----------------+----------+---------+-----+
+// | VER | USERNAME_LENGTH | USERNAME | MAC_LEN | MAC |
+// +-----+-----------------+----------+---------+-----+
+// |   1 |               1 | 0-255    |       1 |  32 |
+// +-----+-----------------+----------+---------+-----+
+// 3. 服务端返回结果, 与账号密码认证相同
+// +-----+--------+
+// | VER | STATUS |
+// +-----+--------+
+// |   1 |      1 |
+// +-----+--------+
+
+const hmacNonceSize = 32
+
+func hmacSum(secret string, nonce []byte, uname string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(nonce)
+	h.Write([]byte(uname))
+	return h.Sum(nil)
+}
+
+func (s *S5Protocol) servAuthHMAC(conn io.ReadWriteCloser, totalBuff []byte, frame *Frame) (err error) {
+	nonce := make([]byte, hmacNonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return fmt.Errorf("<nonce error> %w", err)
+	}
+	if _, err = conn.Write(frame.ServerHMACChallenge(s.Version, nonce)); err != nil {
+		return fmt.Errorf("<Write error> %w", err)
+	}
+
+	buff := totalBuff[:2]
+	if _, err = s.ReadFull(conn, buff); err != nil {
+		return
+	}
+	if err = s.isSameVersion(buff[0]); err != nil {
+		return
+	}
+
+	// 读取username
+	buff = totalBuff[:buff[1]]
+	if _, err = s.ReadFull(conn, buff); err != nil {
+		return
+	}
+	username := string(buff)
+
+	// 读取mac
+	buff = totalBuff[:1]
+	if _, err = s.ReadFull(conn, buff); err != nil {
+		return
+	}
+	buff = totalBuff[:buff[0]]
+	if _, err = s.ReadFull(conn, buff); err != nil {
+		return
+	}
+
+	if username == s.Username && hmac.Equal(buff, hmacSum(s.Secret, nonce, username)) {
+		if _, err = conn.Write(frame.ServerUsernamePasswdResponse(s.Version, 0)); err != nil {
+			return fmt.Errorf("<Write error> %w", err)
+		}
+		return nil
+	}
+
+	if _, err = conn.Write(frame.ServerUsernamePasswdResponse(s.Version, 100)); err != nil {
+		return fmt.Errorf("<Write error> %w", err)
+	}
+	return errors.New("<hmac dismatch>")
+}
+
+func (s *S5Protocol) clientAuthHMAC(conn io.ReadWriteCloser, frame *Frame) (err error) {
+	var totalBuff [2 + hmacNonceSize]byte
+
+	// 服务端随机数
+	buff := totalBuff[:2]
+	if _, err = s.ReadFull(conn, buff); err != nil {
+		return fmt.Errorf("<hmac challenge readFull failed> %w", err)
+	}
+	if err = s.isSameVersion(buff[0]); err != nil {
+		return fmt.Errorf("<hmac challenge> %w", err)
+	}
+	if buff[1] != hmacNonceSize {
+		return fmt.Errorf("<hmac challenge invalid nonce length %d>", buff[1])
+	}
+	nonce := totalBuff[2:]
+	if _, err = s.ReadFull(conn, nonce); err != nil {
+		return fmt.Errorf("<hmac challenge readFull failed> %w", err)
+	}
+
+	mac := hmacSum(s.Secret, nonce, s.Username)
+	if _, err = conn.Write(frame.ClientHMACResponse(s.Version, s.Username, mac)); err != nil {
+		return fmt.Errorf("<hmac write err> %w", err)
+	}
+
+	buff = totalBuff[:2]
+	if _, err = s.ReadFull(conn, buff); err != nil {
+		return errors.New("<hmac readFull failed>")
+	}
+	if err = s.isSameVersion(buff[0]); err != nil {
+		return fmt.Errorf("<hmac version incorrect> %w", err)
+	}
+	if buff[1] != 0 {
+		return errors.New("<hmac auth failed>")
+	}
+	return nil
+}
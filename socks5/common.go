@@ -3,10 +3,20 @@ package socks5
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
+	"os"
 	"strconv"
 	"strings"
+
+	"socks5/protocol"
 )
 
+// UnixPrefix unix domain socket地址前缀, 例如 "unix:/run/app.sock"
+const UnixPrefix = "unix:"
+
+// UnixSocketMode 监听unix socket时的文件权限
+var UnixSocketMode os.FileMode = 0600
+
 func byteContain(s1 []byte, s2 byte) bool {
 	for _, v := range s1 {
 		if s2 == v {
@@ -92,3 +102,34 @@ func Uint16ToByte(a uint16) []byte {
 func ByteToUint16(a []byte) uint16 {
 	return binary.BigEndian.Uint16(a)
 }
+
+// SplitNetwork 拆分地址中的网络类型, "unix:/path" 返回 ("unix", "/path"), 其余为tcp
+func SplitNetwork(addr string) (network, address string) {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		return "unix", strings.TrimPrefix(addr, UnixPrefix)
+	}
+	return "tcp", addr
+}
+
+// JoinAddr 拼接地址端口, unix socket地址忽略端口
+func JoinAddr(addr, port string) string {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		return addr
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+// DialAddr 按地址的网络类型连接
+func DialAddr(addr string) (net.Conn, error) {
+	network, address := SplitNetwork(addr)
+	return net.Dial(network, address)
+}
+
+// ListenAddr 按地址的网络类型监听, unix socket会清理残留的socket文件并设置权限
+func ListenAddr(addr string) (net.Listener, error) {
+	network, address := SplitNetwork(addr)
+	if network == "unix" {
+		return protocol.ListenUnix(address, UnixSocketMode)
+	}
+	return net.Listen(network, address)
+}
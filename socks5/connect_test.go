@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+// TestUnixTargets 客户端请求的unix socket目标须匹配UnixTargets, 否则回复规则拒绝且不连接
+func TestUnixTargets(t *testing.T) {
+	addrMap := NewAddrMap()
+	if err := addrMap.Add("db:5432", "unix:/var/run/postgresql/.s.PGSQL.5432"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		allow   []string
+		target  string
+		dialed  string // 为空表示不应连接
+		refused bool
+	}{
+		{"allowed pattern", []string{"/run/app/*.sock"}, "unix:/run/app/db.sock", "unix:/run/app/db.sock", false},
+		{"exact path", []string{"/run/app.sock"}, "unix:/run/app.sock", "unix:/run/app.sock", false},
+		{"not in list", []string{"/run/app/*.sock"}, "unix:/var/run/docker.sock", "", true},
+		{"dot dot escape", []string{"/run/app/*"}, "unix:/run/app/../docker.sock", "", true},
+		{"empty list", nil, "unix:/run/app.sock", "", true},
+		{"tcp unaffected", nil, "127.0.0.1:80", "127.0.0.1:80", false},
+		{"addr map rewrite", nil, "db:5432", "unix:/var/run/postgresql/.s.PGSQL.5432", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dialed string
+			server := &S5Protocol{
+				Version:           5,
+				AuthMethodSupport: []byte{AuthNoAuthRequired},
+				DirectMode:        true,
+				AddrMap:           addrMap,
+				UnixTargets:       tt.allow,
+				DialTarget: func(addr string) (net.Conn, error) {
+					dialed = addr
+					a, b := net.Pipe()
+					b.Close()
+					return a, nil
+				},
+			}
+			a, b := net.Pipe()
+			defer b.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				server.Server(a)
+			}()
+
+			client := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthNoAuthRequired}, DirectMode: true}
+			conn, err := client.Dial(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Connect(conn, "127.0.0.1:1080", tt.target)
+			b.Close()
+			<-done
+			if tt.refused {
+				if err == nil || err.Error() != ReplyMessage[ReplyConnectionNotAllowByRuleset] {
+					t.Errorf("connect err %v, want ruleset refusal", err)
+				}
+			} else if err != nil {
+				t.Errorf("connect err %v", err)
+			}
+			if dialed != tt.dialed {
+				t.Errorf("dialed %q, want %q", dialed, tt.dialed)
+			}
+		})
+	}
+}
@@ -21,6 +21,21 @@ const (
 	AuthNoAcceptMethods      byte = 0xff
 )
 
+// 私有认证方法 0x80 - 0xfe
+const (
+	AuthHMACChallenge byte = AuthRSVForPrivateMethods // HMAC挑战应答, 共享密钥不在链路上传输
+)
+
+// AuthMethodName 认证方法名称
+var (
+	AuthMethodName = map[byte]string{
+		AuthNoAuthRequired: "none",
+		AuthGSSAPI:         "gssapi",
+		AuthUsernamePasswd: "username",
+		AuthHMACChallenge:  "hmac",
+	}
+)
+
 // COMMAND
 const (
 	CmdConnect byte = 0x01
@@ -99,6 +114,15 @@ func (f *Frame) ClientUsernamePasswdRequest(version byte, uname, passwd string)
 	return f.Get()
 }
 
+// ClientHMACResponse 客户端HMAC挑战应答
+func (f *Frame) ClientHMACResponse(version byte, uname string, mac []byte) []byte {
+	f.Init()
+	f.wVersion(version)
+	f.wUsername(uname)
+	f.wBytes(mac)
+	return f.Get()
+}
+
 // ClientCommandRequest 客户端发送命令
 func (f *Frame) ClientCommandRequest(version byte, command, rsv byte, dstAddr, dstPort string) []byte {
 	f.Init()
@@ -128,6 +152,14 @@ func (f *Frame) ServerUsernamePasswdResponse(version byte, status int) []byte {
 	return f.Get()
 }
 
+// ServerHMACChallenge 服务端下发HMAC挑战随机数
+func (f *Frame) ServerHMACChallenge(version byte, nonce []byte) []byte {
+	f.Init()
+	f.wVersion(version)
+	f.wBytes(nonce)
+	return f.Get()
+}
+
 // ServerCommandResponse 服务端命令执行响应
 func (f *Frame) ServerCommandResponse(version, reply, rsv byte, bindAddr string, bindPort string) []byte {
 	f.Init()
@@ -155,6 +187,12 @@ func (f *Frame) wPasswd(passwd string) {
 	f.data = append(f.data, []byte(passwd)...)
 }
 
+// LEN DATA
+func (f *Frame) wBytes(data []byte) {
+	f.data = append(f.data, byte(len(data)))
+	f.data = append(f.data, data...)
+}
+
 func (f *Frame) wStatus(status int) { f.data = append(f.data, byte(status)) }
 
 func (f *Frame) wMethod(method byte) { f.data = append(f.data, method) }
@@ -3,9 +3,11 @@ module test/testsocks5/socks5
 go 1.13
 
 require (
+	github.com/gorilla/websocket v1.4.1
 	github.com/klauspost/cpuid v1.2.1 // indirect
 	github.com/klauspost/reedsolomon v1.9.3 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
+	github.com/quic-go/quic-go v0.45.2
 	github.com/sirupsen/logrus v1.4.2 // indirect
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
 	github.com/templexxx/xor v0.0.0-20181023030647-4e92f724b73b // indirect
@@ -0,0 +1,346 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// GSSAPI认证 (RFC 1961)
+// 认证及封装阶段的所有消息格式:
+// +-----+------+-----+-------+
+// | VER | MTYP | LEN | TOKEN |
+// +-----+------+-----+-------+
+// |   1 |    1 |   2 | 0-64K |
+// +-----+------+-----+-------+
+
+// GSSAPI 消息
+const (
+	gssapiVersion byte = 0x01
+
+	GSSAPIMsgAuth       byte = 0x01 // 安全上下文建立
+	GSSAPIMsgProtection byte = 0x02 // 保护级别协商
+	GSSAPIMsgEncap      byte = 0x03 // 封装的用户数据
+	GSSAPIMsgAbort      byte = 0xff // 中止
+)
+
+// PROTECTION LEVEL
+const (
+	ProtectionNone         byte = 0x00 // 不封装
+	ProtectionIntegrity    byte = 0x01 // 完整性
+	ProtectionConfidential byte = 0x02 // 完整性 + 机密性
+)
+
+// gssapiMaxChunk 封装时单个消息的明文上限, 预留机制附加开销
+const gssapiMaxChunk = 16 * 1024
+
+// Mechanism GSSAPI风格的安全机制, 每条链接使用独立实例
+// 客户端先以nil调用InitSecContext, 之后双方交替交换token, 直至服务端AcceptSecContext返回done.
+// 客户端每发出一个token都会读取服务端的应答.
+type Mechanism interface {
+	// InitSecContext 客户端处理服务端token, 返回发往服务端的token, done表示客户端上下文建立完成
+	InitSecContext(in []byte) (out []byte, done bool, err error)
+	// AcceptSecContext 服务端处理客户端token, 返回应答token, done表示服务端上下文建立完成
+	AcceptSecContext(in []byte) (out []byte, done bool, err error)
+}
+
+// Wrapper 机制可选实现, 提供消息保护能力
+type Wrapper interface {
+	Wrap(msg []byte, confidential bool) ([]byte, error)
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// PeerNamer 机制可选实现, 返回上下文建立后对端的身份(例如Kerberos principal), 服务端以此作为会话用户
+type PeerNamer interface {
+	PeerName() string
+}
+
+var (
+	mechanismsMu sync.Mutex
+	mechanisms   = make(map[string]func() Mechanism)
+)
+
+// RegisterMechanism 登记GSSAPI机制供配置按名称选择, 通常在机制实现的init中调用
+func RegisterMechanism(name string, newMechanism func() Mechanism) {
+	mechanismsMu.Lock()
+	defer mechanismsMu.Unlock()
+	mechanisms[name] = newMechanism
+}
+
+// Mechanisms 已登记的机制名称
+func Mechanisms() []string {
+	mechanismsMu.Lock()
+	defer mechanismsMu.Unlock()
+	names := make([]string, 0, len(mechanisms))
+	for name := range mechanisms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ProtectionLevel 保护级别名称 "none", "integrity", "confidential"
+func ProtectionLevel(name string) (byte, error) {
+	switch name {
+	case "none":
+		return ProtectionNone, nil
+	case "integrity":
+		return ProtectionIntegrity, nil
+	case "confidential":
+		return ProtectionConfidential, nil
+	}
+	return 0, fmt.Errorf("<unknown gssapi protection %s>", name)
+}
+
+// NewGSSAPIAuth 使用已登记的机制创建GSSAPI认证方法
+func NewGSSAPIAuth(mechanism string, protection byte) (*GSSAPIAuth, error) {
+	mechanismsMu.Lock()
+	newMechanism, ok := mechanisms[mechanism]
+	mechanismsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("<unknown gssapi mechanism %s, registered: %v>", mechanism, Mechanisms())
+	}
+	return &GSSAPIAuth{NewMechanism: newMechanism, Protection: protection}, nil
+}
+
+// GSSAPIAuth GSSAPI认证方法 (AuthGSSAPI)
+// 安全上下文建立后双方协商保护级别, 取双方期望与机制能力的最小值, 为ProtectionNone时不封装链接
+type GSSAPIAuth struct {
+	NewMechanism func() Mechanism
+	Protection   byte // 期望的保护级别
+}
+
+// Method 认证方法号
+func (g *GSSAPIAuth) Method() byte { return AuthGSSAPI }
+
+// ServerAuth 服务端流程
+func (g *GSSAPIAuth) ServerAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	mech := g.NewMechanism()
+
+	// 安全上下文建立
+	for {
+		in, err := readGSSAPIMessage(conn, GSSAPIMsgAuth)
+		if err != nil {
+			return nil, err
+		}
+		out, done, err := mech.AcceptSecContext(in)
+		if err != nil {
+			writeGSSAPIMessage(conn, GSSAPIMsgAbort, nil)
+			return nil, fmt.Errorf("<gssapi accept> %w", err)
+		}
+		if err = writeGSSAPIMessage(conn, GSSAPIMsgAuth, out); err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+
+	// 保护级别协商
+	wrapper, _ := mech.(Wrapper)
+	token, err := readGSSAPIMessage(conn, GSSAPIMsgProtection)
+	if err != nil {
+		return nil, err
+	}
+	level, err := unwrapProtection(wrapper, token)
+	if err != nil {
+		writeGSSAPIMessage(conn, GSSAPIMsgAbort, nil)
+		return nil, err
+	}
+	if g.Protection < level {
+		level = g.Protection
+	}
+	if token, err = wrapProtection(wrapper, level); err != nil {
+		return nil, err
+	}
+	if err = writeGSSAPIMessage(conn, GSSAPIMsgProtection, token); err != nil {
+		return nil, err
+	}
+
+	var user string
+	if namer, ok := mech.(PeerNamer); ok {
+		user = namer.PeerName()
+	}
+	return newGSSAPIConn(conn, wrapper, level, user), nil
+}
+
+// ClientAuth 客户端流程
+func (g *GSSAPIAuth) ClientAuth(s *S5Protocol, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	mech := g.NewMechanism()
+
+	// 安全上下文建立
+	var in []byte
+	for first := true; ; first = false {
+		out, done, err := mech.InitSecContext(in)
+		if err != nil {
+			writeGSSAPIMessage(conn, GSSAPIMsgAbort, nil)
+			return nil, fmt.Errorf("<gssapi init> %w", err)
+		}
+		if done && len(out) == 0 && !first {
+			break
+		}
+		if err = writeGSSAPIMessage(conn, GSSAPIMsgAuth, out); err != nil {
+			return nil, err
+		}
+		if in, err = readGSSAPIMessage(conn, GSSAPIMsgAuth); err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+
+	// 保护级别协商
+	wrapper, _ := mech.(Wrapper)
+	level := g.Protection
+	if wrapper == nil {
+		level = ProtectionNone
+	}
+	token, err := wrapProtection(wrapper, level)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeGSSAPIMessage(conn, GSSAPIMsgProtection, token); err != nil {
+		return nil, err
+	}
+	if token, err = readGSSAPIMessage(conn, GSSAPIMsgProtection); err != nil {
+		return nil, err
+	}
+	chosen, err := unwrapProtection(wrapper, token)
+	if err != nil {
+		return nil, err
+	}
+	if chosen > level {
+		return nil, fmt.Errorf("<gssapi server chose protection %d, requested %d>", chosen, level)
+	}
+
+	return newGSSAPIConn(conn, wrapper, chosen, ""), nil
+}
+
+// 保护级别消息在机制支持时封装传输
+func wrapProtection(wrapper Wrapper, level byte) ([]byte, error) {
+	if wrapper == nil {
+		return []byte{level}, nil
+	}
+	return wrapper.Wrap([]byte{level}, false)
+}
+
+func unwrapProtection(wrapper Wrapper, token []byte) (level byte, err error) {
+	if wrapper != nil {
+		if token, err = wrapper.Unwrap(token); err != nil {
+			return 0, fmt.Errorf("<gssapi protection unwrap> %w", err)
+		}
+	}
+	if len(token) != 1 || token[0] > ProtectionConfidential {
+		return 0, errors.New("<gssapi invalid protection level>")
+	}
+	if wrapper == nil {
+		return ProtectionNone, nil
+	}
+	return token[0], nil
+}
+
+func writeGSSAPIMessage(w io.Writer, mtyp byte, token []byte) (err error) {
+	if len(token) > 0xffff {
+		return fmt.Errorf("<gssapi token too large %d>", len(token))
+	}
+	msg := make([]byte, 4+len(token))
+	msg[0], msg[1] = gssapiVersion, mtyp
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	copy(msg[4:], token)
+	if _, err = w.Write(msg); err != nil {
+		return fmt.Errorf("<gssapi write> %w", err)
+	}
+	return
+}
+
+func readGSSAPIMessage(r io.Reader, mtyp byte) (token []byte, err error) {
+	var header [4]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("<gssapi read> %w", err)
+	}
+	if header[0] != gssapiVersion {
+		return nil, fmt.Errorf("<gssapi version incorrect %d>", header[0])
+	}
+	if header[1] == GSSAPIMsgAbort {
+		return nil, errors.New("<gssapi aborted by peer>")
+	}
+	if header[1] != mtyp {
+		return nil, fmt.Errorf("<gssapi unexpected message type %d, need %d>", header[1], mtyp)
+	}
+	token = make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err = io.ReadFull(r, token); err != nil {
+		return nil, fmt.Errorf("<gssapi read> %w", err)
+	}
+	return
+}
+
+// gssapiConn 按协商的保护级别封装用户数据, wrapper为nil时不封装, 只携带对端身份
+type gssapiConn struct {
+	io.ReadWriteCloser
+	wrapper      Wrapper
+	confidential bool
+	user         string
+	rbuf         []byte
+}
+
+func newGSSAPIConn(conn io.ReadWriteCloser, wrapper Wrapper, level byte, user string) io.ReadWriteCloser {
+	if level == ProtectionNone {
+		if user == "" {
+			return conn
+		}
+		wrapper = nil
+	}
+	return &gssapiConn{
+		ReadWriteCloser: conn,
+		wrapper:         wrapper,
+		confidential:    level == ProtectionConfidential,
+		user:            user,
+	}
+}
+
+// AuthUser 安全上下文中对端的身份
+func (c *gssapiConn) AuthUser() string { return c.user }
+
+func (c *gssapiConn) Read(buff []byte) (nread int, err error) {
+	if c.wrapper == nil {
+		return c.ReadWriteCloser.Read(buff)
+	}
+	if len(c.rbuf) == 0 {
+		token, err := readGSSAPIMessage(c.ReadWriteCloser, GSSAPIMsgEncap)
+		if err != nil {
+			return 0, err
+		}
+		if c.rbuf, err = c.wrapper.Unwrap(token); err != nil {
+			return 0, fmt.Errorf("<gssapi unwrap> %w", err)
+		}
+	}
+	nread = copy(buff, c.rbuf)
+	c.rbuf = c.rbuf[nread:]
+	return
+}
+
+func (c *gssapiConn) Write(data []byte) (nwrite int, err error) {
+	if c.wrapper == nil {
+		return c.ReadWriteCloser.Write(data)
+	}
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > gssapiMaxChunk {
+			chunk = chunk[:gssapiMaxChunk]
+		}
+		token, err := c.wrapper.Wrap(chunk, c.confidential)
+		if err != nil {
+			return nwrite, fmt.Errorf("<gssapi wrap> %w", err)
+		}
+		if err = writeGSSAPIMessage(c.ReadWriteCloser, GSSAPIMsgEncap, token); err != nil {
+			return nwrite, err
+		}
+		nwrite += len(chunk)
+		data = data[len(chunk):]
+	}
+	return
+}
@@ -0,0 +1,379 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubMechanism 测试用机制: 客户端依次发送 c0..c(n-1), 服务端应答 s0..s(n-1), 服务端发出最后一个应答时完成
+type stubMechanism struct {
+	rounds   int
+	step     int
+	peer     string
+	failStep int // 服务端在该轮返回错误, 0不失败
+	accepted []string
+}
+
+func (m *stubMechanism) InitSecContext(in []byte) ([]byte, bool, error) {
+	if in != nil {
+		if want := fmt.Sprint("s", m.step-1); string(in) != want {
+			return nil, false, fmt.Errorf("client got %q, want %q", in, want)
+		}
+		if m.step == m.rounds {
+			return nil, true, nil
+		}
+	}
+	out := fmt.Sprint("c", m.step)
+	m.step++
+	return []byte(out), false, nil
+}
+
+func (m *stubMechanism) AcceptSecContext(in []byte) ([]byte, bool, error) {
+	m.accepted = append(m.accepted, string(in))
+	if want := fmt.Sprint("c", m.step); string(in) != want {
+		return nil, false, fmt.Errorf("server got %q, want %q", in, want)
+	}
+	m.step++
+	if m.step == m.failStep {
+		return nil, false, errors.New("stub reject")
+	}
+	return []byte(fmt.Sprint("s", m.step-1)), m.step == m.rounds, nil
+}
+
+func (m *stubMechanism) PeerName() string { return m.peer }
+
+// stubWrapMechanism 支持消息保护的机制
+// token: FLAG | SUM | DATA, FLAG=1表示DATA被异或加密, SUM为明文字节和
+type stubWrapMechanism struct {
+	stubMechanism
+}
+
+const stubKey = 0x5a
+
+func (m *stubWrapMechanism) Wrap(msg []byte, confidential bool) ([]byte, error) {
+	token := make([]byte, 2+len(msg))
+	for i, b := range msg {
+		token[1] += b
+		if confidential {
+			b ^= stubKey
+		}
+		token[2+i] = b
+	}
+	if confidential {
+		token[0] = 1
+	}
+	return token, nil
+}
+
+func (m *stubWrapMechanism) Unwrap(token []byte) ([]byte, error) {
+	if len(token) < 2 {
+		return nil, errors.New("short token")
+	}
+	msg := make([]byte, len(token)-2)
+	var sum byte
+	for i, b := range token[2:] {
+		if token[0] == 1 {
+			b ^= stubKey
+		}
+		msg[i] = b
+		sum += b
+	}
+	if sum != token[1] {
+		return nil, errors.New("integrity check failed")
+	}
+	return msg, nil
+}
+
+// recordConn 记录写入的字节
+type recordConn struct {
+	io.ReadWriteCloser
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.ReadWriteCloser.Write(b)
+}
+
+func (c *recordConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.written.Bytes()...)
+}
+
+type authResult struct {
+	conn io.ReadWriteCloser
+	err  error
+}
+
+// gssapiPair 在net.Pipe上同时运行两端的认证
+func gssapiPair(t *testing.T, server, client *GSSAPIAuth) (srv, cli authResult, wire *recordConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	wire = &recordConn{ReadWriteCloser: b}
+
+	done := make(chan authResult, 1)
+	go func() {
+		c, err := server.ServerAuth(&S5Protocol{}, a)
+		if err != nil {
+			// 中止时对端可能还在等待读取
+			a.Close()
+		}
+		done <- authResult{c, err}
+	}()
+	c, err := client.ClientAuth(&S5Protocol{}, wire)
+	if err != nil {
+		b.Close()
+	}
+	cli = authResult{c, err}
+	select {
+	case srv = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server auth timeout")
+	}
+	return
+}
+
+func TestGSSAPIContextRounds(t *testing.T) {
+	for _, rounds := range []int{1, 2, 5} {
+		srvMech := &stubMechanism{rounds: rounds}
+		server := &GSSAPIAuth{NewMechanism: func() Mechanism { return srvMech }}
+		client := &GSSAPIAuth{NewMechanism: func() Mechanism { return &stubMechanism{rounds: rounds} }}
+
+		srv, cli, _ := gssapiPair(t, server, client)
+		if srv.err != nil || cli.err != nil {
+			t.Fatalf("rounds %d: server %v, client %v", rounds, srv.err, cli.err)
+		}
+		if len(srvMech.accepted) != rounds {
+			t.Errorf("rounds %d: server accepted %v", rounds, srvMech.accepted)
+		}
+	}
+}
+
+func TestGSSAPIAbort(t *testing.T) {
+	server := &GSSAPIAuth{NewMechanism: func() Mechanism { return &stubMechanism{rounds: 3, failStep: 2} }}
+	client := &GSSAPIAuth{NewMechanism: func() Mechanism { return &stubMechanism{rounds: 3} }}
+
+	srv, cli, _ := gssapiPair(t, server, client)
+	if srv.err == nil || !strings.Contains(srv.err.Error(), "stub reject") {
+		t.Errorf("server err = %v", srv.err)
+	}
+	if cli.err == nil || !strings.Contains(cli.err.Error(), "aborted by peer") {
+		t.Errorf("client err = %v", cli.err)
+	}
+}
+
+func TestGSSAPIProtectionNegotiation(t *testing.T) {
+	tests := []struct {
+		name           string
+		server, client byte
+		wrap           bool
+		want           byte
+	}{
+		{"both none", ProtectionNone, ProtectionNone, true, ProtectionNone},
+		{"server lower", ProtectionIntegrity, ProtectionConfidential, true, ProtectionIntegrity},
+		{"client lower", ProtectionConfidential, ProtectionIntegrity, true, ProtectionIntegrity},
+		{"both confidential", ProtectionConfidential, ProtectionConfidential, true, ProtectionConfidential},
+		{"no wrapper", ProtectionConfidential, ProtectionConfidential, false, ProtectionNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newMech := func() Mechanism {
+				if tt.wrap {
+					return &stubWrapMechanism{stubMechanism{rounds: 2}}
+				}
+				return &stubMechanism{rounds: 2}
+			}
+			server := &GSSAPIAuth{NewMechanism: newMech, Protection: tt.server}
+			client := &GSSAPIAuth{NewMechanism: newMech, Protection: tt.client}
+
+			srv, cli, wire := gssapiPair(t, server, client)
+			if srv.err != nil || cli.err != nil {
+				t.Fatalf("server %v, client %v", srv.err, cli.err)
+			}
+			if got := protectionOf(srv.conn); got != tt.want {
+				t.Errorf("server level %d, want %d", got, tt.want)
+			}
+			if got := protectionOf(cli.conn); got != tt.want {
+				t.Errorf("client level %d, want %d", got, tt.want)
+			}
+
+			// 封装的数据经对端解封后一致, 机密性保护时链路上没有明文
+			secret := []byte("attack at dawn")
+			authLen := len(wire.bytes())
+			got := make([]byte, len(secret))
+			errc := make(chan error, 1)
+			go func() {
+				_, err := cli.conn.Write(secret)
+				errc <- err
+			}()
+			if _, err := io.ReadFull(srv.conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, secret) {
+				t.Fatalf("server read %q", got)
+			}
+			onWire := wire.bytes()[authLen:]
+			if plain := bytes.Contains(onWire, secret); plain != (tt.want != ProtectionConfidential) {
+				t.Errorf("plaintext on wire = %v at level %d: % x", plain, tt.want, onWire)
+			}
+		})
+	}
+}
+
+func protectionOf(c io.ReadWriteCloser) byte {
+	g, ok := c.(*gssapiConn)
+	switch {
+	case !ok || g.wrapper == nil:
+		return ProtectionNone
+	case g.confidential:
+		return ProtectionConfidential
+	}
+	return ProtectionIntegrity
+}
+
+func TestGSSAPIEncapsulatedData(t *testing.T) {
+	newMech := func() Mechanism { return &stubWrapMechanism{stubMechanism{rounds: 1}} }
+	server := &GSSAPIAuth{NewMechanism: newMech, Protection: ProtectionConfidential}
+	client := &GSSAPIAuth{NewMechanism: newMech, Protection: ProtectionConfidential}
+	srv, cli, wire := gssapiPair(t, server, client)
+	if srv.err != nil || cli.err != nil {
+		t.Fatalf("server %v, client %v", srv.err, cli.err)
+	}
+
+	// 超过单个消息上限的数据被拆分封装, 双向传输
+	data := make([]byte, 3*gssapiMaxChunk+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	authLen := len(wire.bytes())
+	go func() {
+		cli.conn.Write(data)
+		echo := make([]byte, len(data))
+		io.ReadFull(cli.conn, echo)
+		cli.conn.Write(echo)
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(srv.conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("client -> server data mismatch")
+	}
+	if n := countEncap(wire.bytes()[authLen:]); n != 4 {
+		t.Errorf("client wrote %d encapsulated messages, want 4", n)
+	}
+
+	go srv.conn.Write(data)
+	back := make([]byte, len(data))
+	if _, err := io.ReadFull(srv.conn, back); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back, data) {
+		t.Fatal("echo mismatch")
+	}
+
+	// 被篡改的消息不能通过完整性校验
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	tampered := newGSSAPIConn(a, &stubWrapMechanism{}, ProtectionIntegrity, "")
+	go func() {
+		token, _ := (&stubWrapMechanism{}).Wrap([]byte("hello"), false)
+		token[3] ^= 1
+		writeGSSAPIMessage(b, GSSAPIMsgEncap, token)
+	}()
+	if _, err := tampered.Read(make([]byte, 16)); err == nil || !strings.Contains(err.Error(), "integrity") {
+		t.Errorf("tampered read err = %v", err)
+	}
+}
+
+// countEncap 统计链路上的封装消息数
+func countEncap(wire []byte) (n int) {
+	for len(wire) >= 4 {
+		if wire[1] == GSSAPIMsgEncap {
+			n++
+		}
+		wire = wire[4+int(wire[2])<<8+int(wire[3]):]
+	}
+	return
+}
+
+func TestGSSAPIServerUser(t *testing.T) {
+	RegisterMechanism("stub-test", func() Mechanism {
+		return &stubWrapMechanism{stubMechanism{rounds: 2, peer: "alice@EXAMPLE.COM"}}
+	})
+	if _, err := NewGSSAPIAuth("missing", ProtectionNone); err == nil {
+		t.Error("unknown mechanism accepted")
+	}
+	auth, err := NewGSSAPIAuth("stub-test", ProtectionIntegrity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, remote := net.Pipe()
+	defer target.Close()
+	server := &S5Protocol{
+		Version:           5,
+		AuthMethodSupport: []byte{AuthGSSAPI},
+		DirectMode:        true,
+		Authenticators:    []Authenticator{auth},
+		DialTarget:        func(string) (net.Conn, error) { return remote, nil },
+	}
+	client := &S5Protocol{
+		Version:           5,
+		AuthMethodSupport: []byte{AuthGSSAPI},
+		Authenticators:    []Authenticator{auth},
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	go server.Server(a)
+	conn, err := client.Dial(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protectionOf(conn) != ProtectionIntegrity {
+		t.Errorf("client protection %d", protectionOf(conn))
+	}
+	if _, err := client.Connect(conn, "127.0.0.1:1080", "example.com:80"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 转发开始后会话以安全上下文中的身份登记
+	go conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(target, buf); err != nil {
+		t.Fatal(err)
+	}
+	list := Sessions.List(func(s SessionInfo) bool { return s.Dest == "example.com:80" })
+	if len(list) != 1 || list[0].User != "alice@EXAMPLE.COM" {
+		t.Fatalf("sessions %+v", list)
+	}
+	Sessions.Kill(list[0].ID)
+}
+
+func TestProtectionLevel(t *testing.T) {
+	for name, want := range map[string]byte{"none": ProtectionNone, "integrity": ProtectionIntegrity, "confidential": ProtectionConfidential} {
+		if got, err := ProtectionLevel(name); err != nil || got != want {
+			t.Errorf("ProtectionLevel(%q) = %d, %v", name, got, err)
+		}
+	}
+	if _, err := ProtectionLevel("privacy"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
@@ -0,0 +1,99 @@
+package socks5
+
+import (
+	"socks5/protocol"
+
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpEcho 本地回显服务, 返回监听地址
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// TestSocks5OverMem 经进程内有损链路完成认证与CONNECT, 并发连接的数据完整
+func TestSocks5OverMem(t *testing.T) {
+	echo := tcpEcho(t)
+	name := fmt.Sprintf("socks5-mem-%d", time.Now().UnixNano())
+	lis := protocol.New(&protocol.MemConfig{Latency: time.Millisecond, Loss: 0.05, Seed: 7})
+	if err := lis.Listen(name); err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	server := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthUsernamePasswd}, Username: "u", Password: "p", DirectMode: true}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetReadTimeout(0)
+			go server.Server(conn)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn := protocol.New(&protocol.MemConfig{})
+			if err := conn.Dial(name); err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.SetReadTimeout(10 * time.Second)
+
+			client := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthUsernamePasswd}, Username: "u", Password: "p", DirectMode: true}
+			c, err := client.Dial(conn)
+			if err != nil {
+				t.Error("dial ", err)
+				return
+			}
+			if _, err := client.Connect(c, name, echo); err != nil {
+				t.Error("connect ", err)
+				return
+			}
+
+			data := make([]byte, 64*1024)
+			rand.New(rand.NewSource(int64(i))).Read(data)
+			go c.Write(data)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Error("read ", err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("echo corrupted")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
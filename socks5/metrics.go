@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"socks5/metrics"
+
+	"net"
+)
+
+var (
+	metricHandshakeFailures = metrics.NewCounter("socks5_handshake_failures_total",
+		"SOCKS5 handshakes failed on the server, by reason.", "reason")
+	metricReplies = metrics.NewCounter("socks5_replies_total",
+		"SOCKS5 command replies sent by the server, by reply code.", "code")
+	metricDialDuration = metrics.NewHistogram("socks5_dial_duration_seconds",
+		"Time for the server to dial the target, by result.", nil, "result")
+	metricUserBytes = metrics.NewCounter("socks5_user_bytes_total",
+		"Bytes relayed between clients and targets, by authenticated user and direction.", "user", "direction")
+)
+
+// meteredConn 统计读写字节数
+type meteredConn struct {
+	net.Conn
+	read, write *metrics.Counter
+}
+
+// NewMeteredConn 读取的字节数计入read, 写入的字节数计入write
+func NewMeteredConn(c net.Conn, read, write *metrics.Counter) net.Conn {
+	return &meteredConn{Conn: c, read: read, write: write}
+}
+
+func (c *meteredConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.read.Add(float64(n))
+	return
+}
+
+func (c *meteredConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.write.Add(float64(n))
+	return
+}
@@ -0,0 +1,395 @@
+// Package metrics Prometheus文本格式的指标, 只实现counter/gauge/histogram
+// 每个指标的标签组合数量不超过MaxSeries, 超出后的新组合计入标签值全为"other"的序列
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxSeries 每个指标的标签组合上限
+const MaxSeries = 1000
+
+// overflowValue 超出上限的标签组合使用的标签值
+const overflowValue = "other"
+
+// DefBuckets 默认histogram分桶, 单位秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric 注册到Registry的指标
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry 指标集合
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry 空的指标集合
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Default 默认指标集合, 包级别的New*函数注册到此处
+var Default = NewRegistry()
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic("[metrics] duplicate metric " + m.name())
+	}
+	r.metrics[m.name()] = m
+}
+
+// WriteTo 按名称顺序输出所有指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	list := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		list = append(list, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name() < list[j].name() })
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range list {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP 实现http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Handler 默认指标集合的http.Handler
+func Handler() http.Handler { return Default }
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc 指标名称, 说明与标签
+type desc struct {
+	fqName, help, typ string
+	labels            []string
+}
+
+func (d *desc) name() string { return d.fqName }
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.fqName, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.fqName, d.typ)
+}
+
+// labelString {k="v",...}, extra为附加的标签对(histogram的le)
+func (d *desc) labelString(values []string, extra ...string) string {
+	if len(d.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(extra[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec 按标签值索引的序列
+type vec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*series
+	newVal func() interface{}
+}
+
+type series struct {
+	values []string
+	val    interface{}
+}
+
+func newVec(name, help, typ string, labels []string, newVal func() interface{}) *vec {
+	return &vec{
+		desc:   desc{fqName: name, help: help, typ: typ, labels: labels},
+		series: make(map[string]*series),
+		newVal: newVal,
+	}
+}
+
+// with 查找或创建序列, 标签值数量必须与标签一致
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("[metrics] %s expects %d label values, got %d", v.fqName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.val
+	}
+	if len(v.series) >= MaxSeries {
+		values = make([]string, len(v.labels))
+		for i := range values {
+			values[i] = overflowValue
+		}
+		key = strings.Join(values, "\xff")
+		if s, ok := v.series[key]; ok {
+			return s.val
+		}
+	}
+	s := &series{values: append([]string(nil), values...), val: v.newVal()}
+	v.series[key] = s
+	return s.val
+}
+
+// sorted 按标签值排序的序列快照
+func (v *vec) sorted() []*series {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]*series, len(keys))
+	for i, k := range keys {
+		list[i] = v.series[k]
+	}
+	v.mu.Unlock()
+	return list
+}
+
+// value 可并发修改的float64
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (x *value) add(d float64) {
+	x.mu.Lock()
+	x.v += d
+	x.mu.Unlock()
+}
+
+func (x *value) set(v float64) {
+	x.mu.Lock()
+	x.v = v
+	x.mu.Unlock()
+}
+
+func (x *value) get() float64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.v
+}
+
+// Counter 只增的计数
+type Counter struct{ value }
+
+// Inc 加1
+func (c *Counter) Inc() { c.add(1) }
+
+// Add 增加d, d不能为负
+func (c *Counter) Add(d float64) {
+	if d < 0 {
+		panic("[metrics] counter cannot decrease")
+	}
+	c.add(d)
+}
+
+// CounterVec 带标签的Counter
+type CounterVec struct{ *vec }
+
+// NewCounter 注册到Default的Counter
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(name, help, "counter", labels, func() interface{} { return &Counter{} })}
+	Default.register(v)
+	return v
+}
+
+// With 对应标签值的Counter
+func (v *CounterVec) With(values ...string) *Counter { return v.with(values).(*Counter) }
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.header(w)
+	for _, s := range v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", v.fqName, v.labelString(s.values), formatFloat(s.val.(*Counter).get()))
+	}
+}
+
+// Gauge 可增减的值
+type Gauge struct{ value }
+
+// Set 设置为v
+func (g *Gauge) Set(v float64) { g.set(v) }
+
+// Add 增加d
+func (g *Gauge) Add(d float64) { g.add(d) }
+
+// Inc 加1
+func (g *Gauge) Inc() { g.add(1) }
+
+// Dec 减1
+func (g *Gauge) Dec() { g.add(-1) }
+
+// GaugeVec 带标签的Gauge
+type GaugeVec struct{ *vec }
+
+// NewGauge 注册到Default的Gauge
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newVec(name, help, "gauge", labels, func() interface{} { return &Gauge{} })}
+	Default.register(v)
+	return v
+}
+
+// With 对应标签值的Gauge
+func (v *GaugeVec) With(values ...string) *Gauge { return v.with(values).(*Gauge) }
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.header(w)
+	for _, s := range v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", v.fqName, v.labelString(s.values), formatFloat(s.val.(*Gauge).get()))
+	}
+}
+
+// Histogram 分桶统计
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // 与buckets对应, 非累计
+	count   uint64
+	sum     float64
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// HistogramVec 带标签的Histogram
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogram 注册到Default的Histogram, buckets为空时使用DefBuckets
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	v := &HistogramVec{buckets: buckets}
+	v.vec = newVec(name, help, "histogram", labels, func() interface{} {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})
+	Default.register(v)
+	return v
+}
+
+// With 对应标签值的Histogram
+func (v *HistogramVec) With(values ...string) *Histogram { return v.with(values).(*Histogram) }
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.header(w)
+	for _, s := range v.sorted() {
+		h := s.val.(*Histogram)
+		h.mu.Lock()
+		counts := append([]uint64(nil), h.counts...)
+		count, sum := h.count, h.sum
+		h.mu.Unlock()
+
+		var cumulative uint64
+		for i, le := range v.buckets {
+			cumulative += counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.fqName, v.labelString(s.values, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.fqName, v.labelString(s.values, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.fqName, v.labelString(s.values), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.fqName, v.labelString(s.values), count)
+	}
+}
+
+// funcMetric 抓取时由回调取值, 用于已有计数(如kcp.DefaultSnmp)
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+// NewCounterFunc 注册到Default, 抓取时调用fn, fn的返回值只增
+func NewCounterFunc(name, help string, fn func() float64) {
+	Default.register(&funcMetric{desc: desc{fqName: name, help: help, typ: "counter"}, fn: fn})
+}
+
+// NewGaugeFunc 注册到Default, 抓取时调用fn
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(&funcMetric{desc: desc{fqName: name, help: help, typ: "gauge"}, fn: fn})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w)
+	fmt.Fprintf(w, "%s %s\n", m.fqName, formatFloat(m.fn()))
+}
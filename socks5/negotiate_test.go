@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	gssapi := &GSSAPIAuth{NewMechanism: func() Mechanism { return &stubMechanism{rounds: 1} }}
+	tests := []struct {
+		name    string
+		server  []byte
+		require bool
+		auths   []Authenticator
+		client  []byte
+		want    byte
+	}{
+		{"server order wins", []byte{AuthHMACChallenge, AuthUsernamePasswd, AuthNoAuthRequired},
+			false, nil, []byte{AuthNoAuthRequired, AuthUsernamePasswd, AuthHMACChallenge}, AuthHMACChallenge},
+		{"first common method", []byte{AuthHMACChallenge, AuthUsernamePasswd, AuthNoAuthRequired},
+			false, nil, []byte{AuthNoAuthRequired, AuthUsernamePasswd}, AuthUsernamePasswd},
+		{"none when only common", []byte{AuthUsernamePasswd, AuthNoAuthRequired},
+			false, nil, []byte{AuthNoAuthRequired}, AuthNoAuthRequired},
+		{"no common method", []byte{AuthUsernamePasswd},
+			false, nil, []byte{AuthNoAuthRequired, AuthHMACChallenge}, AuthNoAcceptMethods},
+		{"zero offered methods", []byte{AuthNoAuthRequired},
+			false, nil, []byte{}, AuthNoAcceptMethods},
+		{"require auth skips none", []byte{AuthNoAuthRequired, AuthUsernamePasswd},
+			true, nil, []byte{AuthNoAuthRequired, AuthUsernamePasswd}, AuthUsernamePasswd},
+		{"require auth rejects none only", []byte{AuthNoAuthRequired, AuthUsernamePasswd},
+			true, nil, []byte{AuthNoAuthRequired}, AuthNoAcceptMethods},
+		{"unimplemented method skipped", []byte{AuthGSSAPI, AuthUsernamePasswd},
+			false, nil, []byte{AuthGSSAPI, AuthUsernamePasswd}, AuthUsernamePasswd},
+		{"registered authenticator", []byte{AuthGSSAPI, AuthUsernamePasswd},
+			false, []Authenticator{gssapi}, []byte{AuthUsernamePasswd, AuthGSSAPI}, AuthGSSAPI},
+		{"0xff never chosen", []byte{AuthNoAcceptMethods, AuthNoAuthRequired},
+			false, nil, []byte{AuthNoAcceptMethods, AuthNoAuthRequired}, AuthNoAuthRequired},
+		{"empty server list", nil,
+			false, nil, []byte{AuthNoAuthRequired}, AuthNoAcceptMethods},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &S5Protocol{AuthMethodSupport: tt.server, RequireAuth: tt.require, Authenticators: tt.auths}
+			if got := s.negotiate(tt.client); got != tt.want {
+				t.Errorf("negotiate(%v) = %#x, want %#x", tt.client, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestServerMethodReply 服务端对方法协商的应答, 没有可接受的方法时回复0xFF并关闭连接
+func TestServerMethodReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  []byte
+		require bool
+		request []byte
+		reply   []byte // nil表示不应答直接关闭
+		closed  bool
+	}{
+		{"username preferred", []byte{AuthUsernamePasswd, AuthNoAuthRequired}, false,
+			[]byte{5, 2, AuthNoAuthRequired, AuthUsernamePasswd}, []byte{5, AuthUsernamePasswd}, false},
+		{"no acceptable", []byte{AuthUsernamePasswd}, false,
+			[]byte{5, 1, AuthNoAuthRequired}, []byte{5, AuthNoAcceptMethods}, true},
+		{"zero methods", []byte{AuthNoAuthRequired}, false,
+			[]byte{5, 0}, []byte{5, AuthNoAcceptMethods}, true},
+		{"require auth", []byte{AuthNoAuthRequired}, true,
+			[]byte{5, 1, AuthNoAuthRequired}, []byte{5, AuthNoAcceptMethods}, true},
+		{"wrong version", []byte{AuthNoAuthRequired}, false,
+			[]byte{4, 1, AuthNoAuthRequired}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &S5Protocol{Version: 5, AuthMethodSupport: tt.server, RequireAuth: tt.require, Username: "u", Password: "p"}
+			a, b := net.Pipe()
+			defer b.Close()
+			go s.Server(a)
+
+			// 版本错误时服务端不读取剩余的请求
+			b.SetDeadline(time.Now().Add(2 * time.Second))
+			go b.Write(tt.request)
+			if tt.reply != nil {
+				got := make([]byte, 2)
+				if _, err := io.ReadFull(b, got); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.reply) {
+					t.Fatalf("reply % x, want % x", got, tt.reply)
+				}
+			}
+			// 服务端关闭后读取返回EOF, 继续认证时服务端等待数据而超时
+			b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, err := b.Read(make([]byte, 1))
+			if closed := err == io.EOF; closed != tt.closed {
+				t.Errorf("closed = %v (err %v), want %v", closed, err, tt.closed)
+			}
+		})
+	}
+}
+
+// TestClientNoAcceptable 客户端收到0xFF时报错
+func TestClientNoAcceptable(t *testing.T) {
+	server := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthUsernamePasswd}, Username: "u", Password: "p"}
+	client := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthNoAuthRequired}}
+	a, b := net.Pipe()
+	defer b.Close()
+	go server.Server(a)
+
+	if _, err := client.Dial(b); err == nil || !strings.Contains(err.Error(), "no acceptable methods") {
+		t.Fatalf("dial err %v", err)
+	}
+}
+
+// TestUsernameAuth 用户名密码认证的成功与失败
+func TestUsernameAuth(t *testing.T) {
+	for _, tt := range []struct {
+		password string
+		ok       bool
+	}{{"p", true}, {"wrong", false}} {
+		server := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthUsernamePasswd}, Username: "u", Password: "p"}
+		client := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthUsernamePasswd}, Username: "u", Password: tt.password}
+		a, b := net.Pipe()
+		go server.Server(a)
+		_, err := client.Dial(b)
+		if (err == nil) != tt.ok {
+			t.Errorf("password %q: err %v", tt.password, err)
+		}
+		b.Close()
+	}
+}
+
+// TestHMACAuth HMAC挑战应答认证的成功, 密钥错误与用户名错误
+func TestHMACAuth(t *testing.T) {
+	for _, tt := range []struct {
+		username, secret string
+		ok               bool
+	}{{"u", "s", true}, {"u", "wrong", false}, {"other", "s", false}, {"", "s", false}} {
+		server := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthHMACChallenge}, Username: "u", Secret: "s"}
+		client := &S5Protocol{Version: 5, AuthMethodSupport: []byte{AuthHMACChallenge}, Username: tt.username, Secret: tt.secret}
+		a, b := net.Pipe()
+		go server.Server(a)
+		_, err := client.Dial(b)
+		if (err == nil) != tt.ok {
+			t.Errorf("username %q secret %q: err %v", tt.username, tt.secret, err)
+		}
+		b.Close()
+	}
+}
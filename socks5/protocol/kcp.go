@@ -1,21 +1,22 @@
 package protocol
 
 import (
-	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/segmentio/ksuid"
 	"github.com/xtaci/kcp-go"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 // KcpConfig KCP配置
 type KcpConfig struct {
 	Key  string
+	Keys []string // 服务端额外接受的密钥, 用于密钥轮换, 与Key共用Salt/Crypt
 	Salt string
 	// "aes", aes-"128", aes-"192", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4", "none"
 	Crypt                                   string
@@ -28,25 +29,34 @@ type KcpConfig struct {
 	SockBuf                                 int
 	DataShard, ParityShard                  int
 	PingInterval, PongTimeout               time.Duration
+	ResumeTimeout                           time.Duration // 链路断开后等待恢复的时间, 负数关闭恢复
+	ResumeBuffer                            int           // 未确认数据的发送缓冲上限
+	HandshakeTimeout                        time.Duration // 服务端读取握手与等待data/keep链路配对的时间
+	PendingHandshakeSize                    int           // 服务端握手中的链路数上限
+	ReplayWindow                            time.Duration // 握手时间戳允许的偏差, 窗口内重复的握手视为重放
 }
 
 // KcpConn Kcp连接
 type KcpConn struct {
-	sess       *kcpSession            // client
-	synConn    map[string]*kcpSession // server
-	blockCrypt *kcp.BlockCrypt
+	sess   *kcpSession // client
+	ring   *kcpKeyring
+	auth   *kcpAuth
+	config *KcpConfig
+
+	// server
 	listener   *kcp.Listener
-	config     *KcpConfig
+	synConn    map[string]*kcpSyn
+	synMu      sync.Mutex
+	sessions   map[string]*kcpSession // 可恢复的会话
+	sessionsMu sync.Mutex
+	accept     chan *KcpConn
+	die        chan struct{}
+	dieOnce    sync.Once
 
 	readTimeout, writeTimeout time.Duration
 	pingInterval, pongTimeout time.Duration
 }
 
-type kcpSession struct {
-	sid                string
-	dataConn, keepConn *kcp.UDPSession
-}
-
 func defaultConfig() (config *KcpConfig) {
 	return &KcpConfig{
 		Key:          "creeper",
@@ -67,6 +77,13 @@ func defaultConfig() (config *KcpConfig) {
 		SockBuf:      204800,
 		PingInterval: time.Second * 3,
 		PongTimeout:  time.Second * 3,
+
+		ResumeTimeout: time.Second * 30,
+		ResumeBuffer:  4 * 1024 * 1024,
+
+		HandshakeTimeout:     time.Second * 10,
+		PendingHandshakeSize: 128,
+		ReplayWindow:         time.Minute,
 	}
 }
 
@@ -123,56 +140,130 @@ func combineConfig(c1 *KcpConfig, c2 *KcpConfig) (config *KcpConfig) {
 	if c1.PongTimeout == 0 {
 		config.PongTimeout = c2.PongTimeout
 	}
+	if c1.ResumeTimeout == 0 {
+		config.ResumeTimeout = c2.ResumeTimeout
+	}
+	if c1.ResumeBuffer == 0 {
+		config.ResumeBuffer = c2.ResumeBuffer
+	}
+	if c1.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = c2.HandshakeTimeout
+	}
+	if c1.PendingHandshakeSize == 0 {
+		config.PendingHandshakeSize = c2.PendingHandshakeSize
+	}
+	if c1.ReplayWindow == 0 {
+		config.ReplayWindow = c2.ReplayWindow
+	}
 	return
 }
 
-// New KcpConn对象
-func New(args ...interface{}) Conn {
-	var config *KcpConfig
-	// 默认参数
-	if len(args) <= 0 || args[0] == nil {
+func init() {
+	Register("kcp", func(config Config) (Conn, error) {
+		if config == nil {
+			return newKcpConn(nil), nil
+		}
+		kcpConfig, ok := config.(*KcpConfig)
+		if !ok {
+			return nil, fmt.Errorf("<kcp config invalid %T>", config)
+		}
+		return newKcpConn(kcpConfig), nil
+	})
+	RegisterConfig("kcp", parseKcpConfig)
+}
+
+// parseKcpConfig 未配置kcp项时返回nil, 使用默认配置
+func parseKcpConfig(src ConfigSource) (Config, error) {
+	if !src.IsSet("kcp") {
+		return nil, nil
+	}
+	config := &KcpConfig{}
+	if src.IsSet("kcp.key") {
+		config.Key = src.GetString("kcp.key")
+	}
+	if src.IsSet("kcp.keys") {
+		config.Keys = src.GetStringSlice("kcp.keys")
+	}
+	if src.IsSet("kcp.salt") {
+		config.Salt = src.GetString("kcp.salt")
+	}
+	if src.IsSet("kcp.crypt") {
+		config.Crypt = src.GetString("kcp.crypt")
+	}
+	if src.IsSet("kcp.mode") {
+		config.Mode = src.GetString("kcp.mode")
+	}
+	if src.IsSet("kcp.mtu") {
+		config.MTU = src.GetInt("kcp.mtu")
+	}
+	if src.IsSet("kcp.sndwnd") {
+		config.SndWnd = src.GetInt("kcp.sndwnd")
+	}
+	if src.IsSet("kcp.rcvwnd") {
+		config.RcvWnd = src.GetInt("kcp.rcvwnd")
+	}
+	if src.IsSet("kcp.datashard") {
+		config.DataShard = src.GetInt("kcp.datashard")
+	}
+	if src.IsSet("kcp.parityshard") {
+		config.ParityShard = src.GetInt("kcp.parityshard")
+	}
+	if src.IsSet("kcp.dscp") {
+		config.DSCP = src.GetInt("kcp.dscp")
+	}
+	if src.IsSet("kcp.acknodelay") {
+		config.AckNodelay = src.GetBool("kcp.acknodelay")
+	}
+	if src.IsSet("kcp.interval") {
+		config.Interval = src.GetInt("kcp.interval")
+	}
+	if src.IsSet("kcp.resend") {
+		config.Resend = src.GetInt("kcp.resend")
+	}
+	if src.IsSet("kcp.nc") {
+		config.NoCongestion = src.GetInt("kcp.nc")
+	}
+	if src.IsSet("kcp.sockbuf") {
+		config.SockBuf = src.GetInt("kcp.sockbuf")
+	}
+	if src.IsSet("kcp.ping_interval") {
+		config.PingInterval = seconds(src, "kcp.ping_interval")
+	}
+	if src.IsSet("kcp.pong_timeout") {
+		config.PongTimeout = seconds(src, "kcp.pong_timeout")
+	}
+	if src.IsSet("kcp.resume_timeout") {
+		config.ResumeTimeout = seconds(src, "kcp.resume_timeout")
+	}
+	if src.IsSet("kcp.resume_buffer") {
+		config.ResumeBuffer = src.GetInt("kcp.resume_buffer")
+	}
+	if src.IsSet("kcp.handshake_timeout") {
+		config.HandshakeTimeout = seconds(src, "kcp.handshake_timeout")
+	}
+	if src.IsSet("kcp.pending_handshake") {
+		config.PendingHandshakeSize = src.GetInt("kcp.pending_handshake")
+	}
+	if src.IsSet("kcp.replay_window") {
+		config.ReplayWindow = seconds(src, "kcp.replay_window")
+	}
+	return config, nil
+}
+
+// Transport 传输层名称
+func (c *KcpConfig) Transport() string { return "kcp" }
+
+// newKcpConn KcpConn对象
+func newKcpConn(config *KcpConfig) *KcpConn {
+	if config == nil {
+		// 默认参数
 		config = defaultConfig()
 	} else {
-		// 非法参数校验
-		var ok bool
-		if config, ok = args[0].(*KcpConfig); !ok {
-			panic("[protocol.New] args invalid!")
-		}
 		// 合并默认项
 		config = combineConfig(config, defaultConfig())
 	}
 
-	pass := pbkdf2.Key([]byte(config.Key), []byte(config.Salt), 4096, 32, sha1.New)
-	var block kcp.BlockCrypt
-	switch config.Crypt {
-	case "sm4":
-		block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-	case "tea":
-		block, _ = kcp.NewTEABlockCrypt(pass[:16])
-	case "xor":
-		block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-	case "none":
-		block, _ = kcp.NewNoneBlockCrypt(pass)
-	case "aes-128":
-		block, _ = kcp.NewAESBlockCrypt(pass[:16])
-	case "aes-192":
-		block, _ = kcp.NewAESBlockCrypt(pass[:24])
-	case "blowfish":
-		block, _ = kcp.NewBlowfishBlockCrypt(pass)
-	case "twofish":
-		block, _ = kcp.NewTwofishBlockCrypt(pass)
-	case "cast5":
-		block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-	case "3des":
-		block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-	case "xtea":
-		block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-	case "salsa20":
-		block, _ = kcp.NewSalsa20BlockCrypt(pass)
-	default:
-		config.Crypt = "aes"
-		block, _ = kcp.NewAESBlockCrypt(pass)
-	}
+	ring := newKcpKeyring(config)
 
 	switch config.Mode {
 	case "normal":
@@ -186,7 +277,8 @@ func New(args ...interface{}) Conn {
 	}
 
 	return &KcpConn{
-		blockCrypt:   &block,
+		ring:         ring,
+		auth:         newKcpAuth(ring, config.ReplayWindow),
 		config:       config,
 		readTimeout:  time.Second * 3,
 		writeTimeout: time.Second * 3,
@@ -202,11 +294,16 @@ func (s5 *KcpConn) configBaseConn(sess *kcp.UDPSession) {
 	sess.SetACKNoDelay(s5.config.AckNodelay)
 }
 
+// configMtu 加密头部由kcpCryptConn附加, 不计入kcp的mtu, data/keep链路一致
+func (s5 *KcpConn) configMtu(sess *kcp.UDPSession) {
+	sess.SetMtu(s5.config.MTU - kcpCryptHeaderSize)
+}
+
 // 设置连接windowSize buffer Mtu
 func (s5 *KcpConn) configSizeConn(conn interface{}) {
 	if sess, ok := conn.(*kcp.UDPSession); ok {
 		sess.SetWindowSize(s5.config.SndWnd, s5.config.RcvWnd)
-		sess.SetMtu(s5.config.MTU)
+		s5.configMtu(sess)
 		if err := sess.SetDSCP(s5.config.DSCP); err != nil {
 			log.Println("SetDSCP:", err)
 		}
@@ -241,47 +338,20 @@ func (s5 *KcpConn) SetReadTimeout(timeout time.Duration) { s5.readTimeout = time
 func (s5 *KcpConn) SetWriteTimeout(timeout time.Duration) { s5.writeTimeout = timeout }
 
 // RemoteAddr 返回raw conn
-func (s5 *KcpConn) RemoteAddr() net.Addr { return s5.sess.dataConn.RemoteAddr() }
+func (s5 *KcpConn) RemoteAddr() net.Addr { return s5.sess.addr().dataConn.RemoteAddr() }
 
 // LocalAddr 返回raw conn
-func (s5 *KcpConn) LocalAddr() net.Addr { return s5.sess.dataConn.LocalAddr() }
-
-func (s5 *KcpConn) internalSetWriteTimeout() (err error) {
-	if s5.writeTimeout > 0 {
-		if err = s5.sess.dataConn.SetWriteDeadline(time.Now().Add(s5.writeTimeout)); err != nil {
-			return
-		}
-	} else if s5.writeTimeout == 0 {
-		if err = s5.sess.dataConn.SetWriteDeadline(time.Time{}); err != nil {
-			return
-		}
-	}
-	return
-}
+func (s5 *KcpConn) LocalAddr() net.Addr { return s5.sess.addr().dataConn.LocalAddr() }
 
-func (s5 *KcpConn) internalSetReadTimeout() (err error) {
-	if s5.readTimeout > 0 {
-		if err = s5.sess.dataConn.SetReadDeadline(time.Now().Add(s5.readTimeout)); err != nil {
-			return
-		}
-	} else if s5.readTimeout == 0 {
-		if err = s5.sess.dataConn.SetReadDeadline(time.Time{}); err != nil {
-			return
-		}
+// dialLink 建立data/keep链路, 各发送一条认证的握手消息(格式见kcpauth.go)
+// TYPE 新建为0x00/0x01, 恢复为0x02/0x03, 恢复时data链路附带本端rx并读取服务端的回复
+func (s5 *KcpConn) dialLink(addr string, sid []byte, resume bool, rx uint64) (link *kcpLink, peerRx uint64, err error) {
+	dataType, keepType := kcpNewData, kcpNewKeep
+	if resume {
+		dataType, keepType = kcpResumeData, kcpResumeKeep
 	}
-	return
-}
 
-// Dial Kcp发起连接
-// +--------------+------------+
-// |     TYPE     | SESSION_ID |
-// +--------------+------------+
-// | 1(0x00/0x01) |         20 |
-// +--------------+------------+
-func (s5 *KcpConn) Dial(addr string) (err error) {
-	sid := ksuid.New().Bytes()
-
-	dataConn, err := kcp.DialWithOptions(addr, *s5.blockCrypt, s5.config.DataShard, s5.config.ParityShard)
+	dataConn, err := s5.dialKcp(addr)
 	if err != nil {
 		err = fmt.Errorf("<[Dial] %s %w>", addr, err)
 		return
@@ -289,189 +359,362 @@ func (s5 *KcpConn) Dial(addr string) (err error) {
 	s5.configBaseConn(dataConn)
 	s5.configSizeConn(dataConn)
 
-	if _, err = dataConn.Write(append([]byte{0x00}, sid...)); err != nil {
+	hello, nonce := s5.auth.sealHello(dataType, sid, rx)
+	if _, err = dataConn.Write(hello); err != nil {
 		err = fmt.Errorf("<[Dial] %s -> %s %w>", dataConn.RemoteAddr().String(), dataConn.LocalAddr().String(), err)
+		dataConn.Close()
 		return
 	}
 
-	keepConn, err := kcp.DialWithOptions(addr, *s5.blockCrypt, s5.config.DataShard, s5.config.ParityShard)
+	keepConn, err := s5.dialKcp(addr)
 	if err != nil {
-		err = fmt.Errorf("<[Dial] %s -> %s %w>", keepConn.RemoteAddr().String(), keepConn.LocalAddr().String(), err)
+		err = fmt.Errorf("<[Dial] %s %w>", addr, err)
+		dataConn.Close()
 		return
 	}
 	s5.configBaseConn(keepConn)
+	s5.configMtu(keepConn)
+	link = newKcpLink(dataConn, keepConn)
 
-	if _, err = keepConn.Write(append([]byte{0x01}, sid...)); err != nil {
+	hello, _ = s5.auth.sealHello(keepType, sid, 0)
+	if _, err = keepConn.Write(hello); err != nil {
 		err = fmt.Errorf("<[Dial] %s -> %s %w>", keepConn.RemoteAddr().String(), keepConn.LocalAddr().String(), err)
+		link.close()
 		return
 	}
 
-	// ping
-	go func() {
-		defer s5.Close()
-		t := time.NewTicker(s5.pingInterval)
-		defer t.Stop()
-
-		var err error
-		var nwrite int
-		var buff [1]byte
-		for {
-			<-t.C
-			for {
-				if err = keepConn.SetWriteDeadline(time.Now().Add(s5.pingInterval)); err != nil {
-					return
-				}
-				if nwrite, err = keepConn.Write([]byte{0x01}); err != nil {
-					return
-				}
-				if nwrite > 0 {
-					break
-				}
-			}
-			if err = keepConn.SetReadDeadline(time.Now().Add(s5.pingInterval + s5.pongTimeout)); err != nil {
-				return
-			}
-			if _, err = io.ReadFull(keepConn, buff[:]); err != nil {
-				return
-			}
-
+	if resume {
+		var reply [kcpReplySize]byte
+		var status byte
+		if err = dataConn.SetReadDeadline(time.Now().Add(s5.pingInterval + s5.pongTimeout)); err == nil {
+			_, err = io.ReadFull(dataConn, reply[:])
 		}
-	}()
+		if err == nil {
+			status, peerRx, err = s5.auth.openReply(nonce, reply[:])
+		}
+		if err != nil {
+			err = fmt.Errorf("<[Dial] %s resume %w>", addr, err)
+			link.close()
+			return
+		}
+		if status != kcpResumeOK {
+			link.close()
+			return nil, 0, errKcpResumeRejected
+		}
+	}
+	return
+}
 
-	s5.sess = &kcpSession{
-		dataConn: dataConn,
-		keepConn: keepConn,
+// Dial Kcp发起连接, 链路断开后以同一sid自动恢复
+func (s5 *KcpConn) Dial(addr string) (err error) {
+	kid := ksuid.New()
+	sid := kid.Bytes()
+
+	link, _, err := s5.dialLink(addr, sid, false, 0)
+	if err != nil {
+		return
+	}
+
+	sess := newKcpSession(kid.String(), s5.config, true)
+	sess.redial = func(rx uint64) (*kcpLink, uint64, error) {
+		return s5.dialLink(addr, sid, true, rx)
+	}
+	if err = sess.attach(link, 0); err != nil {
+		return
 	}
+	s5.sess = sess
 	return
 }
 
 // Send data
 func (s5 *KcpConn) Write(data []byte) (nwrite int, err error) {
-	ncount := 0
-	for {
-		if err = s5.internalSetWriteTimeout(); err != nil {
-			return
-		}
-
-		nwrite, err = s5.sess.dataConn.Write(data)
-		if err != nil {
-			return
-		}
-		ncount += nwrite
-		if ncount >= len(data) {
-			return
-		}
-	}
+	return s5.sess.Write(data, s5.writeTimeout)
 }
 
 // Read data
 func (s5 *KcpConn) Read(buff []byte) (nread int, err error) {
-	if err = s5.internalSetReadTimeout(); err != nil {
-		return
-	}
-	return s5.sess.dataConn.Read(buff)
+	return s5.sess.Read(buff, s5.readTimeout)
 }
 
 // Close conn
 func (s5 *KcpConn) Close() error {
 	if s5.listener != nil {
+		s5.dieOnce.Do(func() { close(s5.die) })
+		s5.synMu.Lock()
+		for sid, syn := range s5.synConn {
+			syn.timer.Stop()
+			syn.close()
+			delete(s5.synConn, sid)
+		}
+		s5.synMu.Unlock()
 		return s5.listener.Close()
 	}
-	s5.sess.keepConn.Close()
-	return s5.sess.dataConn.Close()
+	if s5.sess != nil {
+		s5.sess.close()
+	}
+	return nil
 }
 
-// Accept conn
-func (s5 *KcpConn) Accept() (c Conn, err error) {
-	for {
-		var s *kcp.UDPSession
-		s, err = s5.listener.AcceptKCP()
+// kcpSyn 服务端等待配对的链路, 超过HandshakeTimeout未配对时丢弃
+type kcpSyn struct {
+	dataConn, keepConn     *kcp.UDPSession
+	dataResume, keepResume bool
+	rx                     uint64
+	nonce                  []byte  // data链路握手的nonce, 用于回复
+	key                    *kcpKey // data链路握手使用的密钥
+	timer                  *time.Timer
+}
 
-		var rbuff [21]byte
-		if err = s.SetReadDeadline(time.Now().Add(s5.readTimeout)); err != nil {
-			err = fmt.Errorf("<[Accept] %s -> %s %w>", s.RemoteAddr().String(), s.LocalAddr().String(), err)
-			s.Close()
-			return
-		}
-		if _, err = io.ReadFull(s, rbuff[:]); err != nil {
-			err = fmt.Errorf("<[Accept] %s -> %s %w>", s.RemoteAddr().String(), s.LocalAddr().String(), err)
-			s.Close()
+func (syn *kcpSyn) close() {
+	if syn.dataConn != nil {
+		syn.dataConn.Close()
+	}
+	if syn.keepConn != nil {
+		syn.keepConn.Close()
+	}
+}
+
+// Accept conn, 握手在后台完成, 恢复请求在内部重新接入已有会话, 不返回新连接
+func (s5 *KcpConn) Accept() (Conn, error) {
+	select {
+	case c := <-s5.accept:
+		return c, nil
+	case <-s5.die:
+		return nil, errors.New("<[Accept] kcp listener closed>")
+	}
+}
+
+// serve 后台接受链路, 每条链路单独握手, 握手中的链路数不超过PendingHandshakeSize
+func (s5 *KcpConn) serve() {
+	pending := make(chan struct{}, s5.config.PendingHandshakeSize)
+	for {
+		s, err := s5.listener.AcceptKCP()
+		if err != nil {
+			s5.dieOnce.Do(func() { close(s5.die) })
 			return
 		}
 
-		kid := ksuid.New()
-		if err = kid.UnmarshalBinary(rbuff[1:]); err != nil {
-			err = fmt.Errorf("<[Accept] %s -> %s %w>", s.RemoteAddr().String(), s.LocalAddr().String(), err)
+		select {
+		case pending <- struct{}{}:
+		default:
+			metricKcpHandshakeFailures.With(handshakeFailureReason(errKcpPendingFull)).Inc()
 			s.Close()
-			return
+			continue
 		}
-		sid := kid.String()
+		go func() {
+			defer func() { <-pending }()
+			if err := s5.handshake(s); err != nil {
+				metricKcpHandshakeFailures.With(handshakeFailureReason(err)).Inc()
+				log.Println("[kcp] handshake", s.RemoteAddr().String(), err)
+				s.Close()
+			}
+		}()
+	}
+}
 
-		sess, ok := s5.synConn[sid]
-		if !ok {
-			sess = &kcpSession{}
+// handshake 校验握手消息, 按sid配对data/keep链路
+func (s5 *KcpConn) handshake(s *kcp.UDPSession) (err error) {
+	var hello [kcpHelloSize]byte
+	if err = s.SetReadDeadline(time.Now().Add(s5.config.HandshakeTimeout)); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(s, hello[:]); err != nil {
+		return
+	}
+	// 未通过认证的链路在创建会话前丢弃
+	typ, rawSid, rx, nonce, key, err := s5.auth.openHello(hello[:])
+	if err != nil {
+		return
+	}
+	if typ > kcpResumeKeep {
+		return fmt.Errorf("<unknown type %#x>", typ)
+	}
+	if err = s.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	kid, err := ksuid.FromBytes(rawSid)
+	if err != nil {
+		return
+	}
+	sid := kid.String()
+
+	s5.synMu.Lock()
+	syn, ok := s5.synConn[sid]
+	if !ok {
+		if len(s5.synConn) >= s5.config.PendingHandshakeSize {
+			s5.synMu.Unlock()
+			return errKcpPendingFull
 		}
-		if rbuff[0] == byte(0x00) {
-			if sess.dataConn != nil {
-				sess.dataConn.Close()
-			}
-			sess.dataConn = s
-		} else if rbuff[0] == byte(0x01) {
-			if sess.keepConn != nil {
-				sess.keepConn.Close()
+		syn = &kcpSyn{}
+		syn.timer = time.AfterFunc(s5.config.HandshakeTimeout, func() {
+			s5.synMu.Lock()
+			if s5.synConn[sid] == syn {
+				delete(s5.synConn, sid)
+				syn.close()
 			}
-			sess.keepConn = s
+			s5.synMu.Unlock()
+		})
+		s5.synConn[sid] = syn
+	}
+	switch typ {
+	case kcpNewData, kcpResumeData:
+		if syn.dataConn != nil {
+			syn.dataConn.Close()
+		}
+		syn.dataConn = s
+		syn.dataResume = typ == kcpResumeData
+		syn.rx = rx
+		syn.nonce = nonce
+		syn.key = key
+	case kcpNewKeep, kcpResumeKeep:
+		if syn.keepConn != nil {
+			syn.keepConn.Close()
 		}
-		s5.synConn[sid] = sess
-
-		if sess.dataConn != nil && sess.keepConn != nil {
-			delete(s5.synConn, sess.sid)
-			c = New(s5.config)
-			k := c.(*KcpConn)
-			k.sess = sess
-			k.configBaseConn(k.sess.dataConn)
-			k.sess.keepConn.SetStreamMode(true)
-			k.sess.keepConn.SetWriteDelay(false)
-			// pong
-			go func() {
-				defer c.Close()
-
-				var buff [1]byte
-				var nwrite int
-				for {
-					if err = k.sess.keepConn.SetReadDeadline(time.Now().Add(s5.pingInterval + s5.pongTimeout)); err != nil {
-						return
-					}
-					if _, err = io.ReadFull(k.sess.keepConn, buff[:]); err != nil {
-						return
-					}
-
-					for {
-						if err = k.sess.keepConn.SetWriteDeadline(time.Now().Add(s5.pingInterval + s5.pongTimeout)); err != nil {
-							return
-						}
-						if nwrite, err = k.sess.keepConn.Write(buff[:]); err != nil {
-							return
-						}
-						if nwrite > 0 {
-							break
-						}
-					}
-				}
-			}()
+		syn.keepConn = s
+		syn.keepResume = typ == kcpResumeKeep
+	}
+	if syn.dataConn == nil || syn.keepConn == nil {
+		s5.synMu.Unlock()
+		return
+	}
+	delete(s5.synConn, sid)
+	syn.timer.Stop()
+	s5.synMu.Unlock()
+
+	if syn.dataResume != syn.keepResume {
+		syn.close()
+		return
+	}
+	s5.pair(sid, syn)
+	return
+}
+
+// pair data/keep链路配对完成, 新建会话或重新接入已有会话
+func (s5 *KcpConn) pair(sid string, syn *kcpSyn) {
+	s5.configBaseConn(syn.dataConn)
+	s5.configMtu(syn.dataConn)
+	syn.keepConn.SetStreamMode(true)
+	syn.keepConn.SetWriteDelay(false)
+	s5.configMtu(syn.keepConn)
+	link := newKcpLink(syn.dataConn, syn.keepConn)
+
+	s5.sessionsMu.Lock()
+	sess, ok := s5.sessions[sid]
+	s5.sessionsMu.Unlock()
+
+	if syn.dataResume {
+		if !ok {
+			syn.dataConn.Write(s5.auth.sealReply(syn.key, syn.nonce, kcpResumeUnknown, 0))
+			// 等待拒绝消息送达
+			time.AfterFunc(s5.pongTimeout, link.close)
 			return
 		}
+		reply := func(rx uint64) []byte { return s5.auth.sealReply(syn.key, syn.nonce, kcpResumeOK, rx) }
+		if err := sess.reattach(link, syn.rx, reply); err != nil {
+			log.Println("[kcp] resume", sid, err)
+		}
+		return
+	}
+
+	// sid已被使用
+	if ok {
+		link.close()
+		return
+	}
+	sess = newKcpSession(sid, s5.config, false)
+	sess.onClose = func() {
+		s5.sessionsMu.Lock()
+		delete(s5.sessions, sid)
+		s5.sessionsMu.Unlock()
+	}
+	s5.sessionsMu.Lock()
+	s5.sessions[sid] = sess
+	s5.sessionsMu.Unlock()
+	if err := sess.attach(link, 0); err != nil {
+		return
+	}
+
+	// 与监听共用密钥环, 密钥轮换对已建立的会话同样生效
+	k := &KcpConn{
+		sess:         sess,
+		ring:         s5.ring,
+		auth:         s5.auth,
+		config:       s5.config,
+		readTimeout:  s5.readTimeout,
+		writeTimeout: s5.writeTimeout,
+		pingInterval: s5.pingInterval,
+		pongTimeout:  s5.pongTimeout,
+	}
+	select {
+	case s5.accept <- k:
+	case <-s5.die:
+		sess.close()
 	}
 }
 
 // Listen port
 func (s5 *KcpConn) Listen(args ...interface{}) (err error) {
 	addr := args[0].(string)
-	lis, err := kcp.ListenWithOptions(addr, *s5.blockCrypt, s5.config.DataShard, s5.config.ParityShard)
-	if err == nil {
-		s5.configSizeConn(lis)
+	lis, err := s5.listenKcp(addr)
+	if err != nil {
+		return
 	}
+	s5.configSizeConn(lis)
 	s5.listener = lis
-	s5.synConn = make(map[string]*kcpSession)
-	return err
+	s5.synConn = make(map[string]*kcpSyn)
+	s5.sessions = make(map[string]*kcpSession)
+	s5.accept = make(chan *KcpConn)
+	s5.die = make(chan struct{})
+	go s5.serve()
+	return
+}
+
+// KcpStats KCP统计
+// kcp-go v5.4.11 没有导出单个UDPSession的srtt/cwnd/rmt_wnd, 会话的RTT由keep链路的ping/pong测得
+type KcpStats struct {
+	Snmp                   kcp.Snmp // 本进程所有kcp链路的累计计数, 即kcp.DefaultSnmp
+	SndWnd, RcvWnd         int      // 配置的发送/接收窗口
+	MTU                    int
+	DataShard, ParityShard int
+	Sessions               []KcpSessionStats
+}
+
+// KcpSessionStats 单个可恢复会话的统计
+type KcpSessionStats struct {
+	ID           string
+	Remote       string
+	Attached     bool          // 当前是否有可用链路, false表示等待恢复
+	SRTT, RTTVar time.Duration // 仅客户端测量
+	Rx, Tx       uint64        // 已交付给上层/上层已写入的字节数
+	Unacked      int           // 发送缓冲中未被对端确认的字节数
+	Resumes      int           // 重新接入次数
+	Resent       uint64        // 重新接入时重传的字节数
+}
+
+// Stats 返回统计, 监听端包含所有会话, 连接端只包含自身的会话
+func (s5 *KcpConn) Stats() KcpStats {
+	st := KcpStats{
+		Snmp:        *kcp.DefaultSnmp.Copy(),
+		SndWnd:      s5.config.SndWnd,
+		RcvWnd:      s5.config.RcvWnd,
+		MTU:         s5.config.MTU,
+		DataShard:   s5.config.DataShard,
+		ParityShard: s5.config.ParityShard,
+	}
+	if s5.listener == nil {
+		st.Sessions = []KcpSessionStats{s5.sess.stats()}
+		return st
+	}
+
+	s5.sessionsMu.Lock()
+	sessions := make([]*kcpSession, 0, len(s5.sessions))
+	for _, sess := range s5.sessions {
+		sessions = append(sessions, sess)
+	}
+	s5.sessionsMu.Unlock()
+	for _, sess := range sessions {
+		st.Sessions = append(st.Sessions, sess.stats())
+	}
+	return st
 }
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/xtaci/kcp-go"
+)
+
+// synCount 等待配对的链路数
+func synCount(lis *KcpConn) int {
+	lis.synMu.Lock()
+	defer lis.synMu.Unlock()
+	return len(lis.synConn)
+}
+
+// TestKcpHandshakeDrop 无效与未完成的握手在HandshakeTimeout后丢弃, 不阻塞其他客户端, 等待配对的链路数不超过上限
+func TestKcpHandshakeDrop(t *testing.T) {
+	const timeout = 500 * time.Millisecond
+	lis := kcpEchoServer(t, &KcpConfig{Key: "k", HandshakeTimeout: timeout, PendingHandshakeSize: 16})
+	addr := listenAddr(lis)
+
+	// 与服务端密钥相同, 只发送原始链路数据
+	raw := New(&KcpConfig{Key: "k"}).(*KcpConn)
+	var links []*kcp.UDPSession
+	send := func(data []byte) {
+		s, err := raw.dialKcp(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, s)
+		if _, err := s.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, s := range links {
+			s.Close()
+		}
+	}()
+
+	// 垃圾数据认证失败, 不完整的握手等待读取超时
+	for i := 0; i < 2; i++ {
+		send(make([]byte, kcpHelloSize))
+		send(make([]byte, kcpHelloSize/2))
+	}
+	// 只有data链路的握手等待配对
+	sealed := func(n int) {
+		for i := 0; i < n; i++ {
+			hello, _ := raw.auth.sealHello(kcpNewData, ksuid.New().Bytes(), 0)
+			send(hello)
+		}
+	}
+	sealed(4)
+	// 链路数据异步到达, 等待4个握手都在配对中
+	for deadline := time.Now().Add(timeout / 2); synCount(lis) < 4 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	if !kcpEcho(kcpDial(t, addr, "k"), "during handshakes") {
+		t.Fatal("client rejected while other handshakes pending")
+	}
+	if elapsed := time.Since(start); elapsed >= timeout {
+		t.Errorf("client stalled %v behind pending handshakes", elapsed)
+	}
+	if n := synCount(lis); n != 4 {
+		t.Errorf("synConn %d, want 4", n)
+	}
+
+	// 超过上限的链路被拒绝
+	sealed(24)
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if n := synCount(lis); n > 16 {
+			t.Fatalf("synConn %d over limit 16", n)
+		}
+	}
+
+	deadline := time.Now().Add(5 * timeout)
+	for synCount(lis) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := synCount(lis); n != 0 {
+		t.Errorf("synConn %d after handshake timeout", n)
+	}
+	if !kcpEcho(kcpDial(t, addr, "k"), "after handshakes") {
+		t.Error("client rejected after pending handshakes dropped")
+	}
+}
@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 握手消息, SEALED为AES-GCM密文, TIMESTAMP为附加数据
+// +-----------+-------+---------------------------------+-----+
+// | TIMESTAMP | NONCE | SEALED(TYPE | SESSION_ID | RX) | TAG |
+// +-----------+-------+---------------------------------+-----+
+// |         8 |    12 |                     1 + 20 + 8  |  16 |
+// +-----------+-------+---------------------------------+-----+
+//
+// 恢复回复, 以握手消息的NONCE为附加数据
+// +-------+---------------------+-----+
+// | NONCE | SEALED(STATUS | RX) | TAG |
+// +-------+---------------------+-----+
+// |    12 |               1 + 8 |  16 |
+// +-------+---------------------+-----+
+const (
+	kcpHelloPlainSize = 1 + 20 + 8
+	kcpReplyPlainSize = 1 + 8
+	kcpNonceSize      = 12
+	kcpTagSize        = 16
+	kcpHelloSize      = 8 + kcpNonceSize + kcpHelloPlainSize + kcpTagSize
+	kcpReplySize      = kcpNonceSize + kcpReplyPlainSize + kcpTagSize
+
+	// kcpReplayCacheSize 重放窗口内记录的nonce上限, 超出时拒绝新的握手
+	kcpReplayCacheSize = 1 << 16
+)
+
+var (
+	errKcpAuth   = errors.New("kcp handshake authentication failed")
+	errKcpStale  = errors.New("kcp handshake timestamp out of window")
+	errKcpReplay = errors.New("kcp handshake replayed")
+	// 握手中的链路数达到PendingHandshakeSize
+	errKcpPendingFull = errors.New("kcp pending handshakes full")
+)
+
+// kcpAuth 握手认证, AES-256-GCM, 密钥由Key/Salt派生, 与BlockCrypt使用的密钥相互独立.
+// 时间戳参与认证, 服务端拒绝时间偏差超过窗口的握手, 并记录窗口内的nonce拒绝重放.
+// 客户端以当前密钥发起握手, 服务端接受密钥环中的任一密钥, 并以同一密钥回复
+type kcpAuth struct {
+	ring   *kcpKeyring
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[[kcpNonceSize]byte]time.Time // nonce -> 过期时间
+}
+
+func newKcpAuth(ring *kcpKeyring, window time.Duration) *kcpAuth {
+	return &kcpAuth{
+		ring:   ring,
+		window: window,
+		seen:   make(map[[kcpNonceSize]byte]time.Time),
+	}
+}
+
+// sealHello 客户端握手消息
+func (a *kcpAuth) sealHello(typ byte, sid []byte, rx uint64) (msg, nonce []byte) {
+	plain := make([]byte, kcpHelloPlainSize)
+	plain[0] = typ
+	copy(plain[1:21], sid)
+	binary.BigEndian.PutUint64(plain[21:], rx)
+
+	msg = make([]byte, 8+kcpNonceSize, kcpHelloSize)
+	binary.BigEndian.PutUint64(msg[:8], uint64(time.Now().UnixNano()))
+	nonce = msg[8:]
+	rand.Read(nonce)
+	return a.ring.current().aead.Seal(msg, nonce, plain, msg[:8]), nonce
+}
+
+// openHello 服务端校验握手消息, 返回类型, sid, rx, nonce和握手使用的密钥
+func (a *kcpAuth) openHello(msg []byte) (typ byte, sid []byte, rx uint64, nonce []byte, key *kcpKey, err error) {
+	if len(msg) != kcpHelloSize {
+		return 0, nil, 0, nil, nil, errKcpAuth
+	}
+	ts, nonce := msg[:8], msg[8:8+kcpNonceSize]
+	var plain []byte
+	for _, k := range a.ring.all() {
+		if plain, err = k.aead.Open(nil, nonce, msg[8+kcpNonceSize:], ts); err == nil {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return 0, nil, 0, nil, nil, errKcpAuth
+	}
+
+	now := time.Now()
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(ts)))
+	if sent.Before(now.Add(-a.window)) || sent.After(now.Add(a.window)) {
+		return 0, nil, 0, nil, nil, errKcpStale
+	}
+	if err = a.remember(nonce, now); err != nil {
+		return 0, nil, 0, nil, nil, err
+	}
+	return plain[0], plain[1:21], binary.BigEndian.Uint64(plain[21:]), nonce, key, nil
+}
+
+// remember 记录nonce, 窗口内重复出现视为重放
+func (a *kcpAuth) remember(nonce []byte, now time.Time) error {
+	var key [kcpNonceSize]byte
+	copy(key[:], nonce)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.seen[key]; ok {
+		return errKcpReplay
+	}
+	if len(a.seen) >= kcpReplayCacheSize {
+		for k, expire := range a.seen {
+			if now.After(expire) {
+				delete(a.seen, k)
+			}
+		}
+		if len(a.seen) >= kcpReplayCacheSize {
+			return errKcpReplay
+		}
+	}
+	// 时间戳允许前后各一个窗口的偏差
+	a.seen[key] = now.Add(2 * a.window)
+	return nil
+}
+
+// sealReply 服务端恢复结果, 绑定到客户端握手的nonce, key为客户端握手使用的密钥
+func (a *kcpAuth) sealReply(key *kcpKey, helloNonce []byte, status byte, rx uint64) []byte {
+	plain := make([]byte, kcpReplyPlainSize)
+	plain[0] = status
+	binary.BigEndian.PutUint64(plain[1:], rx)
+
+	msg := make([]byte, kcpNonceSize, kcpReplySize)
+	rand.Read(msg)
+	return key.aead.Seal(msg, msg, plain, helloNonce)
+}
+
+// openReply 客户端校验恢复结果, 握手期间密钥可能已被替换, 尝试密钥环中的所有密钥
+func (a *kcpAuth) openReply(helloNonce, msg []byte) (status byte, rx uint64, err error) {
+	if len(msg) != kcpReplySize {
+		return 0, 0, errKcpAuth
+	}
+	for _, k := range a.ring.all() {
+		if plain, err := k.aead.Open(nil, msg[:kcpNonceSize], msg[kcpNonceSize:], helloNonce); err == nil {
+			return plain[0], binary.BigEndian.Uint64(plain[1:]), nil
+		}
+	}
+	return 0, 0, errKcpAuth
+}
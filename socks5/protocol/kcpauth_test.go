@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// sealHelloAt 以指定的时间戳生成握手消息
+func sealHelloAt(a *kcpAuth, typ byte, sid []byte, sent time.Time) []byte {
+	plain := make([]byte, kcpHelloPlainSize)
+	plain[0] = typ
+	copy(plain[1:21], sid)
+
+	msg := make([]byte, 8+kcpNonceSize, kcpHelloSize)
+	binary.BigEndian.PutUint64(msg[:8], uint64(sent.UnixNano()))
+	rand.Read(msg[8:])
+	return a.ring.current().aead.Seal(msg, msg[8:], plain, msg[:8])
+}
+
+// TestKcpAuthHello 重放, 超出时间窗口, 密钥错误, 截断与篡改的握手均被拒绝
+func TestKcpAuthHello(t *testing.T) {
+	client := newKcpAuth(testKeyring("k"), time.Minute)
+	sid := ksuid.New().Bytes()
+	tamper := func(i int) []byte {
+		msg, _ := client.sealHello(kcpNewData, sid, 0)
+		msg[i] ^= 0x01
+		return msg
+	}
+	replayed, _ := client.sealHello(kcpNewData, sid, 0)
+	wrongKey, _ := newKcpAuth(testKeyring("other"), time.Minute).sealHello(kcpNewData, sid, 0)
+	truncated, _ := client.sealHello(kcpNewData, sid, 0)
+
+	server := newKcpAuth(testKeyring("k"), time.Minute)
+	if _, _, _, _, _, err := server.openHello(replayed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want error
+	}{
+		{"replay", replayed, errKcpReplay},
+		{"stale", sealHelloAt(client, kcpNewData, sid, time.Now().Add(-2*time.Minute)), errKcpStale},
+		{"future", sealHelloAt(client, kcpNewData, sid, time.Now().Add(2*time.Minute)), errKcpStale},
+		{"wrong key", wrongKey, errKcpAuth},
+		{"truncated", truncated[:kcpHelloSize-1], errKcpAuth},
+		{"empty", nil, errKcpAuth},
+		{"tampered timestamp", tamper(0), errKcpAuth},
+		{"tampered nonce", tamper(8), errKcpAuth},
+		{"tampered payload", tamper(8 + kcpNonceSize), errKcpAuth},
+		{"tampered tag", tamper(kcpHelloSize - 1), errKcpAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, _, _, err := server.openHello(tt.msg); !errors.Is(err, tt.want) {
+				t.Errorf("err %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// 窗口内的时间偏差可以接受
+	if _, _, _, _, _, err := server.openHello(sealHelloAt(client, kcpNewData, sid, time.Now().Add(-30*time.Second))); err != nil {
+		t.Errorf("skewed hello rejected: %v", err)
+	}
+	if _, _, err := server.openReply(replayed[8:8+kcpNonceSize], make([]byte, kcpReplySize-1)); err != errKcpAuth {
+		t.Errorf("truncated reply err %v", err)
+	}
+}
+
+// TestKcpAuthReplayCache 记录的nonce数不超过上限, 已满时拒绝新握手, 过期后清理
+func TestKcpAuthReplayCache(t *testing.T) {
+	a := newKcpAuth(testKeyring("k"), time.Minute)
+	now := time.Now()
+	nonce := make([]byte, kcpNonceSize)
+	for i := 0; i < kcpReplayCacheSize; i++ {
+		binary.BigEndian.PutUint64(nonce, uint64(i))
+		if err := a.remember(nonce, now); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	binary.BigEndian.PutUint64(nonce, kcpReplayCacheSize)
+	if err := a.remember(nonce, now.Add(time.Minute)); err != errKcpReplay {
+		t.Errorf("full cache err %v", err)
+	}
+	if len(a.seen) != kcpReplayCacheSize {
+		t.Errorf("cache grew to %d", len(a.seen))
+	}
+
+	// 记录的nonce在两个窗口后过期
+	if err := a.remember(nonce, now.Add(2*time.Minute+time.Second)); err != nil {
+		t.Errorf("expired cache err %v", err)
+	}
+	if len(a.seen) != 1 {
+		t.Errorf("cache %d after expiry, want 1", len(a.seen))
+	}
+}
+
+// TestKcpHandshakeRejected 未通过认证的握手在创建会话前丢弃
+func TestKcpHandshakeRejected(t *testing.T) {
+	lis := kcpEchoServer(t, &KcpConfig{Key: "k", HandshakeTimeout: time.Second})
+	addr := listenAddr(lis)
+	raw := New(&KcpConfig{Key: "k"}).(*KcpConn)
+
+	sessions := func() int {
+		lis.sessionsMu.Lock()
+		defer lis.sessionsMu.Unlock()
+		return len(lis.sessions)
+	}
+	send := func(msgs ...[]byte) {
+		for _, msg := range msgs {
+			s, err := raw.dialKcp(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if _, err := s.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	sid := ksuid.New().Bytes()
+	data, _ := raw.auth.sealHello(kcpNewData, sid, 0)
+	keep, _ := raw.auth.sealHello(kcpNewKeep, sid, 0)
+	send(data, keep)
+	if n := sessions(); n != 1 {
+		t.Fatalf("sessions %d after valid handshake", n)
+	}
+
+	sid = ksuid.New().Bytes()
+	staleData := sealHelloAt(raw.auth, kcpNewData, sid, time.Now().Add(-time.Hour))
+	staleKeep := sealHelloAt(raw.auth, kcpNewKeep, sid, time.Now().Add(-time.Hour))
+	tampered, _ := raw.auth.sealHello(kcpNewKeep, sid, 0)
+	tampered[kcpHelloSize-1] ^= 0x01
+	send(data, keep, staleData, staleKeep, tampered)
+	if n := sessions(); n != 1 {
+		t.Errorf("sessions %d after rejected handshakes", n)
+	}
+	if n := synCount(lis); n != 0 {
+		t.Errorf("synConn %d after rejected handshakes", n)
+	}
+}
@@ -0,0 +1,328 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// 数据包格式与kcp-go内置加密一致, 未升级的对端可以直接互通
+// +-------+-------+---------+
+// | NONCE | CRC32 | PAYLOAD |
+// +-------+-------+---------+
+// |    16 |     4 |     ... |
+// +-------+-------+---------+
+const (
+	kcpCryptNonceSize  = 16
+	kcpCryptHeaderSize = kcpCryptNonceSize + 4
+
+	// kcpPeerIdle 对端地址超过该时间没有数据包时清除其密钥记录
+	kcpPeerIdle = time.Minute * 5
+)
+
+var kcpPacketPool = sync.Pool{New: func() interface{} { return make([]byte, 1500+kcpCryptHeaderSize) }}
+
+// kcpKey 由Key/Salt派生的数据包加密与握手认证密钥
+type kcpKey struct {
+	block kcp.BlockCrypt
+	aead  cipher.AEAD
+}
+
+func newKcpKey(key, salt, crypt string) *kcpKey {
+	pass := pbkdf2.Key([]byte(key), []byte(salt), 4096, 32, sha1.New)
+	var block kcp.BlockCrypt
+	switch crypt {
+	case "sm4":
+		block, _ = kcp.NewSM4BlockCrypt(pass[:16])
+	case "tea":
+		block, _ = kcp.NewTEABlockCrypt(pass[:16])
+	case "xor":
+		block, _ = kcp.NewSimpleXORBlockCrypt(pass)
+	case "none":
+		block, _ = kcp.NewNoneBlockCrypt(pass)
+	case "aes-128":
+		block, _ = kcp.NewAESBlockCrypt(pass[:16])
+	case "aes-192":
+		block, _ = kcp.NewAESBlockCrypt(pass[:24])
+	case "blowfish":
+		block, _ = kcp.NewBlowfishBlockCrypt(pass)
+	case "twofish":
+		block, _ = kcp.NewTwofishBlockCrypt(pass)
+	case "cast5":
+		block, _ = kcp.NewCast5BlockCrypt(pass[:16])
+	case "3des":
+		block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
+	case "xtea":
+		block, _ = kcp.NewXTEABlockCrypt(pass[:16])
+	case "salsa20":
+		block, _ = kcp.NewSalsa20BlockCrypt(pass)
+	default:
+		block, _ = kcp.NewAESBlockCrypt(pass)
+	}
+
+	// 握手密钥与数据包密钥相互独立
+	authKey := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, pass, nil, []byte("kcp handshake")), authKey)
+	aesBlock, _ := aes.NewCipher(authKey)
+	aead, _ := cipher.NewGCM(aesBlock)
+
+	return &kcpKey{block: block, aead: aead}
+}
+
+// kcpKeyring 当前密钥与仍然接受的旧密钥, 可在运行中替换
+type kcpKeyring struct {
+	mu   sync.RWMutex
+	keys []*kcpKey // keys[0]为当前密钥
+}
+
+func newKcpKeyring(config *KcpConfig) *kcpKeyring {
+	r := &kcpKeyring{}
+	r.set(config.Key, config.Keys, config.Salt, config.Crypt)
+	return r
+}
+
+func (r *kcpKeyring) set(key string, accept []string, salt, crypt string) {
+	keys := []*kcpKey{newKcpKey(key, salt, crypt)}
+	for _, k := range accept {
+		if k != key {
+			keys = append(keys, newKcpKey(k, salt, crypt))
+		}
+	}
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+}
+
+func (r *kcpKeyring) current() *kcpKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[0]
+}
+
+func (r *kcpKeyring) all() []*kcpKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys
+}
+
+// kcpPeer 对端最近使用的密钥
+type kcpPeer struct {
+	key      *kcpKey
+	lastSeen time.Time
+}
+
+// kcpCryptConn 在kcp-go之下完成数据包加解密, 支持多个密钥
+// 收到的数据包依次尝试对端上次使用的密钥与密钥环中的各个密钥, 通过CRC校验即认为匹配.
+// 服务端按对端使用的密钥回复, 已建立的会话在其密钥移出密钥环后仍可继续; 客户端总是使用当前密钥发送
+type kcpCryptConn struct {
+	net.PacketConn
+	ring   *kcpKeyring
+	client bool
+
+	mu        sync.Mutex
+	peers     map[string]*kcpPeer
+	lastSweep time.Time
+}
+
+func newKcpCryptConn(conn net.PacketConn, ring *kcpKeyring, client bool) *kcpCryptConn {
+	return &kcpCryptConn{
+		PacketConn: conn,
+		ring:       ring,
+		client:     client,
+		peers:      make(map[string]*kcpPeer),
+		lastSweep:  time.Now(),
+	}
+}
+
+// open 解密数据包, 返回CRC校验是否通过
+func (k *kcpKey) open(dst, src []byte) bool {
+	k.block.Decrypt(dst, src)
+	return crc32.ChecksumIEEE(dst[kcpCryptHeaderSize:]) == binary.LittleEndian.Uint32(dst[kcpCryptNonceSize:])
+}
+
+// ReadFrom 读取并解密数据包, 无法解密的数据包直接丢弃
+func (c *kcpCryptConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	buf := kcpPacketPool.Get().([]byte)
+	defer kcpPacketPool.Put(buf)
+	plainBuf := kcpPacketPool.Get().([]byte)
+	defer kcpPacketPool.Put(plainBuf)
+
+	for {
+		var nread int
+		if nread, addr, err = c.PacketConn.ReadFrom(buf); err != nil {
+			return
+		}
+		if nread < kcpCryptHeaderSize || nread-kcpCryptHeaderSize > len(p) {
+			continue
+		}
+		packet, plain := buf[:nread], plainBuf[:nread]
+
+		now := time.Now()
+		c.mu.Lock()
+		peer := c.peers[addr.String()]
+		c.mu.Unlock()
+
+		var matched *kcpKey
+		if peer != nil && peer.key.open(plain, packet) {
+			matched = peer.key
+		} else {
+			for _, key := range c.ring.all() {
+				if (peer == nil || key != peer.key) && key.open(plain, packet) {
+					matched = key
+					break
+				}
+			}
+		}
+		if matched == nil {
+			atomic.AddUint64(&kcp.DefaultSnmp.InCsumErrors, 1)
+			continue
+		}
+
+		c.mu.Lock()
+		if peer == nil {
+			peer = &kcpPeer{}
+			c.peers[addr.String()] = peer
+		}
+		peer.key, peer.lastSeen = matched, now
+		c.sweep(now)
+		c.mu.Unlock()
+
+		return copy(p, plain[kcpCryptHeaderSize:]), addr, nil
+	}
+}
+
+// sweep 清除长时间没有数据包的对端, 调用时持有mu
+func (c *kcpCryptConn) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < kcpPeerIdle {
+		return
+	}
+	c.lastSweep = now
+	for addr, peer := range c.peers {
+		if now.Sub(peer.lastSeen) > kcpPeerIdle {
+			delete(c.peers, addr)
+		}
+	}
+}
+
+// WriteTo 加密并发送数据包
+func (c *kcpCryptConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	key := c.ring.current()
+	if !c.client {
+		c.mu.Lock()
+		if peer, ok := c.peers[addr.String()]; ok {
+			key = peer.key
+		}
+		c.mu.Unlock()
+	}
+
+	buf := kcpPacketPool.Get().([]byte)
+	defer kcpPacketPool.Put(buf)
+	if len(p)+kcpCryptHeaderSize > len(buf) {
+		buf = make([]byte, len(p)+kcpCryptHeaderSize)
+	}
+	packet := buf[:len(p)+kcpCryptHeaderSize]
+	rand.Read(packet[:kcpCryptNonceSize])
+	copy(packet[kcpCryptHeaderSize:], p)
+	binary.LittleEndian.PutUint32(packet[kcpCryptNonceSize:], crc32.ChecksumIEEE(packet[kcpCryptHeaderSize:]))
+	key.block.Encrypt(packet, packet)
+
+	if _, err := c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetReadBuffer 底层socket
+func (c *kcpCryptConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(*net.UDPConn); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return errors.New("<SetReadBuffer> not supported")
+}
+
+// SetWriteBuffer 底层socket
+func (c *kcpCryptConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(*net.UDPConn); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return errors.New("<SetWriteBuffer> not supported")
+}
+
+// SetDSCP 底层socket
+func (c *kcpCryptConn) SetDSCP(dscp int) error {
+	nc, ok := c.PacketConn.(*net.UDPConn)
+	if !ok {
+		return errors.New("<SetDSCP> not supported")
+	}
+	err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+	err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// dialKcp 与kcp.DialWithOptions相同, 数据包加解密由kcpCryptConn完成
+func (s5 *KcpConn) dialKcp(addr string) (*kcp.UDPSession, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if udpAddr.IP.To4() == nil {
+		network = "udp"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := kcp.NewConn2(udpAddr, nil, s5.config.DataShard, s5.config.ParityShard, newKcpCryptConn(conn, s5.ring, true))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// listenKcp 与kcp.ListenWithOptions相同, 数据包加解密由kcpCryptConn完成
+func (s5 *KcpConn) listenKcp(addr string) (*kcp.Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	lis, err := kcp.ServeConn(nil, s5.config.DataShard, s5.config.ParityShard, newKcpCryptConn(conn, s5.ring, false))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return lis, nil
+}
+
+// SetKeys 替换密钥, key为当前密钥, keys为额外接受的密钥, key为空时与KcpConfig一样使用默认密钥
+// 客户端此后以新密钥发送; 服务端接受列表中的任一密钥, 按对端使用的密钥回复, 已建立的会话在原密钥移除后不会断开
+func (s5 *KcpConn) SetKeys(key string, keys ...string) {
+	if key == "" {
+		key = defaultConfig().Key
+	}
+	s5.ring.set(key, keys, s5.config.Salt, s5.config.Crypt)
+}
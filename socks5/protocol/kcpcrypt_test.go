@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+)
+
+// cryptPair 服务端与客户端各自的kcpCryptConn, 使用本地UDP
+func cryptPair(t *testing.T, server, client *kcpKeyring) (*kcpCryptConn, *kcpCryptConn) {
+	t.Helper()
+	s, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+	return newKcpCryptConn(s, server, false), newKcpCryptConn(c, client, true)
+}
+
+func testKeyring(key string, accept ...string) *kcpKeyring {
+	r := &kcpKeyring{}
+	r.set(key, accept, "salt", "aes")
+	return r
+}
+
+// TestKcpCryptMultiKey 服务端接受密钥环中的任一密钥并按对端密钥回复, 未知密钥丢弃并计数
+func TestKcpCryptMultiKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		client string
+		ok     bool
+	}{
+		{"current key", "new", true},
+		{"accepted key", "old", true},
+		{"unknown key", "other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := cryptPair(t, testKeyring("new", "old"), testKeyring(tt.client))
+			before := atomic.LoadUint64(&kcp.DefaultSnmp.InCsumErrors)
+			msg := []byte("hello " + tt.client)
+			if _, err := client.WriteTo(msg, server.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 1500)
+			server.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			n, addr, err := server.ReadFrom(buf)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("packet with unknown key accepted")
+				}
+				if atomic.LoadUint64(&kcp.DefaultSnmp.InCsumErrors) == before {
+					t.Error("InCsumErrors not incremented")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], msg) {
+				t.Fatalf("server got %q, want %q", buf[:n], msg)
+			}
+
+			// 回复使用对端的密钥, 客户端只有自己的密钥也能解密
+			reply := []byte("reply")
+			if _, err := server.WriteTo(reply, addr); err != nil {
+				t.Fatal(err)
+			}
+			client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			if n, _, err = client.ReadFrom(buf); err != nil {
+				t.Fatal("client read ", err)
+			}
+			if !bytes.Equal(buf[:n], reply) {
+				t.Fatalf("client got %q, want %q", buf[:n], reply)
+			}
+		})
+	}
+}
+
+// kcpEchoServer 回显每个接入的kcp会话
+func kcpEchoServer(t *testing.T, config *KcpConfig) *KcpConn {
+	t.Helper()
+	lis := New(config).(*KcpConn)
+	if err := lis.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetReadTimeout(time.Minute)
+				buf := make([]byte, 1024)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := c.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return lis
+}
+
+func kcpDial(t *testing.T, addr, key string) Conn {
+	t.Helper()
+	c := New(&KcpConfig{Key: key})
+	if err := c.Dial(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// kcpEcho 写入msg并等待回显, 服务端不接受时超时返回false
+func kcpEcho(c Conn, msg string) bool {
+	c.SetReadTimeout(time.Second)
+	if _, err := c.Write([]byte(msg)); err != nil {
+		return false
+	}
+	buf := make([]byte, len(msg))
+	n := 0
+	for n < len(buf) {
+		m, err := c.Read(buf[n:])
+		if err != nil {
+			return false
+		}
+		n += m
+	}
+	return string(buf) == msg
+}
+
+// TestKcpKeyRotation 服务端轮换密钥: 过渡期新旧密钥均可接入, 移除旧密钥后已建立的会话不断开, 旧密钥不能再接入
+func TestKcpKeyRotation(t *testing.T) {
+	lis := kcpEchoServer(t, &KcpConfig{Key: "k1"})
+	addr := listenAddr(lis)
+
+	old := kcpDial(t, addr, "k1")
+	if !kcpEcho(old, "old before rotation") {
+		t.Fatal("k1 client rejected before rotation")
+	}
+
+	// 过渡期
+	lis.SetKeys("k2", "k1")
+	if !kcpEcho(kcpDial(t, addr, "k2"), "new during rotation") {
+		t.Error("k2 client rejected during rotation")
+	}
+	if !kcpEcho(kcpDial(t, addr, "k1"), "old during rotation") {
+		t.Error("k1 client rejected during rotation")
+	}
+
+	// 移除旧密钥
+	lis.SetKeys("k2")
+	if !kcpEcho(old, "old after rotation") {
+		t.Error("established k1 session broken after rotation")
+	}
+	if kcpEcho(kcpDial(t, addr, "k1"), "old after rotation") {
+		t.Error("k1 client accepted after its key was removed")
+	}
+	if !kcpEcho(kcpDial(t, addr, "k2"), "new after rotation") {
+		t.Error("k2 client rejected after rotation")
+	}
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"socks5/metrics"
+
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/xtaci/kcp-go"
+)
+
+var (
+	metricKcpHandshakeFailures = metrics.NewCounter("kcp_handshake_failures_total",
+		"KCP handshakes rejected by the server, by reason.", "reason")
+	metricKcpResumes = metrics.NewCounter("kcp_session_resumes_total",
+		"KCP sessions re-attached to a new link after a flap.")
+)
+
+// kcp.DefaultSnmp中导出的计数, 抓取时读取
+func init() {
+	snmp := kcp.DefaultSnmp
+	counters := []struct {
+		name, help string
+		v          *uint64
+	}{
+		{"kcp_bytes_sent_total", "Bytes written to KCP sessions by the upper layer.", &snmp.BytesSent},
+		{"kcp_bytes_received_total", "Bytes read from KCP sessions by the upper layer.", &snmp.BytesReceived},
+		{"kcp_active_opens_total", "KCP sessions opened by dialing.", &snmp.ActiveOpens},
+		{"kcp_passive_opens_total", "KCP sessions accepted by listeners.", &snmp.PassiveOpens},
+		{"kcp_in_errors_total", "UDP read errors.", &snmp.InErrs},
+		{"kcp_in_csum_errors_total", "Packets dropped for a bad checksum or unknown key.", &snmp.InCsumErrors},
+		{"kcp_input_errors_total", "Packets rejected by KCP input.", &snmp.KCPInErrors},
+		{"kcp_in_packets_total", "UDP packets received.", &snmp.InPkts},
+		{"kcp_out_packets_total", "UDP packets sent.", &snmp.OutPkts},
+		{"kcp_in_segments_total", "KCP segments received.", &snmp.InSegs},
+		{"kcp_out_segments_total", "KCP segments sent.", &snmp.OutSegs},
+		{"kcp_in_bytes_total", "UDP bytes received.", &snmp.InBytes},
+		{"kcp_out_bytes_total", "UDP bytes sent.", &snmp.OutBytes},
+		{"kcp_retrans_segments_total", "KCP segments retransmitted.", &snmp.RetransSegs},
+		{"kcp_fast_retrans_segments_total", "KCP segments fast retransmitted.", &snmp.FastRetransSegs},
+		{"kcp_early_retrans_segments_total", "KCP segments early retransmitted.", &snmp.EarlyRetransSegs},
+		{"kcp_lost_segments_total", "KCP segments inferred as lost.", &snmp.LostSegs},
+		{"kcp_repeat_segments_total", "Duplicate KCP segments received.", &snmp.RepeatSegs},
+		{"kcp_fec_recovered_total", "Packets recovered by FEC.", &snmp.FECRecovered},
+		{"kcp_fec_errors_total", "Incorrect packets recovered by FEC.", &snmp.FECErrs},
+		{"kcp_fec_parity_shards_total", "FEC parity shards received.", &snmp.FECParityShards},
+		{"kcp_fec_short_shards_total", "FEC groups with too few shards to recover.", &snmp.FECShortShards},
+	}
+	for _, c := range counters {
+		v := c.v
+		metrics.NewCounterFunc(c.name, c.help, func() float64 { return float64(atomic.LoadUint64(v)) })
+	}
+	metrics.NewGaugeFunc("kcp_established_sessions", "KCP sessions currently established.",
+		func() float64 { return float64(atomic.LoadUint64(&snmp.CurrEstab)) })
+}
+
+// handshakeFailureReason 握手失败原因, 取值有限
+func handshakeFailureReason(err error) string {
+	switch {
+	case errors.Is(err, errKcpAuth):
+		return "auth"
+	case errors.Is(err, errKcpStale):
+		return "stale"
+	case errors.Is(err, errKcpReplay):
+		return "replay"
+	case errors.Is(err, errKcpPendingFull):
+		return "pending_full"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
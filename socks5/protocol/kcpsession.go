@@ -0,0 +1,490 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+)
+
+// 握手类型
+const (
+	kcpNewData    byte = 0x00
+	kcpNewKeep    byte = 0x01
+	kcpResumeData byte = 0x02
+	kcpResumeKeep byte = 0x03
+)
+
+// 恢复握手结果
+const (
+	kcpResumeOK      byte = 0x00
+	kcpResumeUnknown byte = 0x01
+)
+
+// keep链路帧类型
+const (
+	kcpPing byte = 0x01
+	kcpPong byte = 0x02
+	kcpAck  byte = 0x03
+)
+
+var (
+	errKcpSessionClosed  = errors.New("kcp session closed")
+	errKcpResumeRejected = errors.New("kcp resume rejected, unknown session")
+)
+
+// kcpTimeout 实现net.Error
+type kcpTimeout struct{}
+
+func (kcpTimeout) Error() string   { return "kcp i/o timeout" }
+func (kcpTimeout) Timeout() bool   { return true }
+func (kcpTimeout) Temporary() bool { return true }
+
+// kcpLink 一组data/keep链路, 断线后由新链路替换
+type kcpLink struct {
+	dataConn, keepConn *kcp.UDPSession
+	die                chan struct{}
+	dieOnce            sync.Once
+}
+
+func newKcpLink(dataConn, keepConn *kcp.UDPSession) *kcpLink {
+	return &kcpLink{dataConn: dataConn, keepConn: keepConn, die: make(chan struct{})}
+}
+
+func (l *kcpLink) close() {
+	l.dieOnce.Do(func() {
+		close(l.die)
+		l.dataConn.Close()
+		l.keepConn.Close()
+	})
+}
+
+// kcpSession 可恢复的会话, 以sid标识
+// 双方记录交付给上层的字节数rx, 经keep链路确认给对端, 未确认的数据保留在发送缓冲中.
+// 链路断开后ResumeTimeout内客户端以同一sid重新接入, 双方从对端的rx处重传, 上层无感知
+type kcpSession struct {
+	sid     string
+	config  *KcpConfig
+	client  bool
+	redial  func(rx uint64) (*kcpLink, uint64, error) // client 重新建立链路, 返回对端rx
+	onClose func()                                    // server 从会话表移除
+
+	wmu sync.Mutex // 保证发送缓冲与链路上的写入顺序一致
+	rmu sync.Mutex // 串行化Read与恢复时读取rx, 关闭后的kcp链路仍会返回已缓存的数据
+
+	mu       sync.Mutex
+	link     *kcpLink
+	lastLink *kcpLink      // 断线期间提供地址
+	attached chan struct{} // 断线期间有效, 重新接入时关闭
+	rx       uint64        // 已交付给上层的字节数
+	tx       uint64        // 上层已写入的字节数
+	acked    uint64        // 对端确认收到的字节数
+	ackSent  uint64        // 最近一次确认给对端的rx
+	sendBuf  []byte        // [acked, tx) 未确认的数据
+
+	// 统计
+	pingSent     time.Time     // 最近一次ping的发送时间
+	srtt, rttvar time.Duration // 由keep链路ping/pong测得, 仅客户端
+	resumes      int           // 重新接入次数
+	resent       uint64        // 重新接入时重传的字节数
+
+	ackCh    chan struct{}
+	writable chan struct{}
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+func newKcpSession(sid string, config *KcpConfig, client bool) *kcpSession {
+	return &kcpSession{
+		sid:      sid,
+		config:   config,
+		client:   client,
+		ackCh:    make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		die:      make(chan struct{}),
+	}
+}
+
+func (s *kcpSession) current() (*kcpLink, chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.link, s.attached
+}
+
+func (s *kcpSession) addr() *kcpLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastLink
+}
+
+// ack 对端确认收到peerRx字节, 释放发送缓冲, 调用时持有mu
+func (s *kcpSession) ack(peerRx uint64) {
+	if peerRx <= s.acked || peerRx > s.tx {
+		return
+	}
+	s.sendBuf = s.sendBuf[peerRx-s.acked:]
+	if len(s.sendBuf) == 0 {
+		s.sendBuf = nil
+	}
+	s.acked = peerRx
+	notify(s.writable)
+}
+
+// attach 接入新链路, 重传对端未收到的数据
+func (s *kcpSession) attach(link *kcpLink, peerRx uint64) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.mu.Lock()
+	select {
+	case <-s.die:
+		s.mu.Unlock()
+		link.close()
+		return errKcpSessionClosed
+	default:
+	}
+	if peerRx < s.acked || peerRx > s.tx {
+		s.mu.Unlock()
+		link.close()
+		return fmt.Errorf("<[attach] %s peer rx %d out of range [%d, %d]>", s.sid, peerRx, s.acked, s.tx)
+	}
+	s.ack(peerRx)
+	pending := append([]byte(nil), s.sendBuf...)
+	if s.lastLink != nil {
+		metricKcpResumes.With().Inc()
+		s.resumes++
+		s.resent += uint64(len(pending))
+	}
+	s.link, s.lastLink = link, link
+	attached := s.attached
+	s.attached = nil
+	s.mu.Unlock()
+
+	if attached != nil {
+		close(attached)
+	}
+	go s.keepalive(link)
+
+	if len(pending) > 0 {
+		if _, err := link.dataConn.Write(pending); err != nil {
+			s.detach(link)
+		}
+	}
+	return nil
+}
+
+// reattach 服务端以新链路替换当前链路, 先回复本端rx再重传, reply生成回复消息
+func (s *kcpSession) reattach(link *kcpLink, peerRx uint64, reply func(rx uint64) []byte) error {
+	if old, _ := s.current(); old != nil {
+		s.detach(old)
+	}
+	rx := s.detachedRx()
+
+	if _, err := link.dataConn.Write(reply(rx)); err != nil {
+		link.close()
+		return fmt.Errorf("<[reattach] %s %w>", s.sid, err)
+	}
+	return s.attach(link, peerRx)
+}
+
+// detachedRx 链路断开后的rx, 等待旧链路上进行中的Read完成计数, 之后的Read在重新接入前不再读取
+func (s *kcpSession) detachedRx() uint64 {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rx
+}
+
+// detach 链路失效, 等待重新接入, 超时后关闭会话
+func (s *kcpSession) detach(link *kcpLink) {
+	s.mu.Lock()
+	if s.link != link {
+		s.mu.Unlock()
+		link.close()
+		return
+	}
+	s.link = nil
+	attached := make(chan struct{})
+	s.attached = attached
+	s.mu.Unlock()
+	link.close()
+
+	if s.config.ResumeTimeout < 0 {
+		s.close()
+		return
+	}
+	go s.resume(attached)
+}
+
+// resume 客户端重连, 双方在ResumeTimeout后放弃
+func (s *kcpSession) resume(attached chan struct{}) {
+	timer := time.NewTimer(s.config.ResumeTimeout)
+	defer timer.Stop()
+
+	if !s.client {
+		select {
+		case <-attached:
+		case <-s.die:
+		case <-timer.C:
+			s.close()
+		}
+		return
+	}
+
+	for {
+		link, peerRx, err := s.redial(s.detachedRx())
+		if err == nil {
+			if err = s.attach(link, peerRx); err == nil {
+				return
+			}
+		}
+		log.Println("[kcp] resume", s.sid, err)
+		if errors.Is(err, errKcpResumeRejected) || errors.Is(err, errKcpSessionClosed) {
+			s.close()
+			return
+		}
+
+		select {
+		case <-s.die:
+			return
+		case <-timer.C:
+			s.close()
+			return
+		case <-time.After(s.config.PingInterval):
+		}
+	}
+}
+
+func (s *kcpSession) close() {
+	s.dieOnce.Do(func() {
+		close(s.die)
+		s.mu.Lock()
+		link := s.link
+		s.link = nil
+		s.mu.Unlock()
+		if link != nil {
+			link.close()
+		}
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+}
+
+// wait 等待通知, 会话关闭或超过deadline时返回错误
+func (s *kcpSession) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-s.die:
+		return errKcpSessionClosed
+	case <-timeout:
+		return kcpTimeout{}
+	}
+}
+
+// Read 链路断开时等待重新接入
+func (s *kcpSession) Read(buff []byte, timeout time.Duration) (nread int, err error) {
+	deadline := deadline(timeout)
+	for {
+		s.rmu.Lock()
+		link, attached := s.current()
+		if link == nil {
+			s.rmu.Unlock()
+			if err = s.wait(attached, deadline); err == errKcpSessionClosed {
+				return 0, io.EOF
+			} else if err != nil {
+				return
+			}
+			continue
+		}
+
+		if err = link.dataConn.SetReadDeadline(deadline); err != nil {
+			s.rmu.Unlock()
+			return
+		}
+		if nread, err = link.dataConn.Read(buff); nread > 0 {
+			s.mu.Lock()
+			s.rx += uint64(nread)
+			needAck := s.rx-s.ackSent >= uint64(s.config.ResumeBuffer/4)
+			s.mu.Unlock()
+			s.rmu.Unlock()
+			if needAck {
+				notify(s.ackCh)
+			}
+			return nread, nil
+		}
+		s.rmu.Unlock()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return
+		}
+		s.detach(link)
+	}
+}
+
+// Write 写入发送缓冲后发往当前链路, 断线期间只写入缓冲
+// timeout只作用于等待缓冲空间, 链路上的写入由keep链路判断失效
+func (s *kcpSession) Write(data []byte, timeout time.Duration) (nwrite int, err error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	deadline := deadline(timeout)
+	for {
+		s.mu.Lock()
+		select {
+		case <-s.die:
+			s.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		if len(s.sendBuf) == 0 || len(s.sendBuf)+len(data) <= s.config.ResumeBuffer {
+			break
+		}
+		s.mu.Unlock()
+
+		if err = s.wait(s.writable, deadline); err == errKcpSessionClosed {
+			return 0, io.ErrClosedPipe
+		} else if err != nil {
+			return
+		}
+	}
+	s.sendBuf = append(s.sendBuf, data...)
+	s.tx += uint64(len(data))
+	link := s.link
+	s.mu.Unlock()
+
+	if link != nil {
+		if _, err = link.dataConn.Write(data); err != nil {
+			s.detach(link)
+		}
+	}
+	return len(data), nil
+}
+
+// keepalive 客户端定时ping, 双方在帧中携带rx作为确认, 读超时视为链路失效
+// +------+----+
+// | TYPE | RX |
+// +------+----+
+// |    1 |  8 |
+// +------+----+
+func (s *kcpSession) keepalive(link *kcpLink) {
+	defer s.detach(link)
+
+	timeout := s.config.PingInterval + s.config.PongTimeout
+	var wmu sync.Mutex
+	send := func(typ byte) error {
+		s.mu.Lock()
+		rx := s.rx
+		s.ackSent = rx
+		if typ == kcpPing {
+			s.pingSent = time.Now()
+		}
+		s.mu.Unlock()
+
+		var frame [9]byte
+		frame[0] = typ
+		binary.BigEndian.PutUint64(frame[1:], rx)
+
+		wmu.Lock()
+		defer wmu.Unlock()
+		if err := link.keepConn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+		_, err := link.keepConn.Write(frame[:])
+		return err
+	}
+
+	go func() {
+		defer link.close()
+		var tick <-chan time.Time
+		if s.client {
+			t := time.NewTicker(s.config.PingInterval)
+			defer t.Stop()
+			tick = t.C
+		}
+		for {
+			select {
+			case <-tick:
+				if send(kcpPing) != nil {
+					return
+				}
+			case <-s.ackCh:
+				if send(kcpAck) != nil {
+					return
+				}
+			case <-link.die:
+				return
+			}
+		}
+	}()
+
+	var frame [9]byte
+	for {
+		if err := link.keepConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(link.keepConn, frame[:]); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.ack(binary.BigEndian.Uint64(frame[1:]))
+		if frame[0] == kcpPong && !s.pingSent.IsZero() {
+			s.sampleRTT(time.Since(s.pingSent))
+			s.pingSent = time.Time{}
+		}
+		s.mu.Unlock()
+		if frame[0] == kcpPing {
+			if send(kcpPong) != nil {
+				return
+			}
+		}
+	}
+}
+
+// sampleRTT 平滑RTT, 与kcp相同按RFC 6298计算, 调用时持有mu
+func (s *kcpSession) sampleRTT(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt, s.rttvar = rtt, rtt/2
+		return
+	}
+	delta := rtt - s.srtt
+	if delta < 0 {
+		delta = -delta
+	}
+	s.rttvar = (3*s.rttvar + delta) / 4
+	s.srtt = (7*s.srtt + rtt) / 8
+}
+
+// stats 会话统计
+func (s *kcpSession) stats() KcpSessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := KcpSessionStats{
+		ID:       s.sid,
+		Attached: s.link != nil,
+		SRTT:     s.srtt,
+		RTTVar:   s.rttvar,
+		Rx:       s.rx,
+		Tx:       s.tx,
+		Unacked:  len(s.sendBuf),
+		Resumes:  s.resumes,
+		Resent:   s.resent,
+	}
+	if s.lastLink != nil {
+		st.Remote = s.lastLink.dataConn.RemoteAddr().String()
+	}
+	return st
+}
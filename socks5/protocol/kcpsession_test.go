@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pattern 偏移n处的期望字节, 数据无需保存即可校验顺序与完整性
+func pattern(n int64) byte { return byte(n % 251) }
+
+// TestKcpSessionFlap 数据双向传输中链路反复中断, 会话恢复后回显的数据不丢失不重复
+func TestKcpSessionFlap(t *testing.T) {
+	config := func() *KcpConfig {
+		return &KcpConfig{
+			PingInterval:  100 * time.Millisecond,
+			PongTimeout:   200 * time.Millisecond,
+			ResumeTimeout: 10 * time.Second,
+		}
+	}
+	server, client, relay := lossyPairConfig(t, config(), config(), 0.01, time.Millisecond)
+	go io.Copy(server, server)
+
+	// 持续写入直到链路中断结束
+	stop := make(chan struct{})
+	var written int64
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		chunk := make([]byte, 4096)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for i := range chunk {
+				chunk[i] = pattern(written + int64(i))
+			}
+			if _, err := client.Write(chunk); err != nil {
+				t.Error("write ", err)
+				return
+			}
+			atomic.AddInt64(&written, int64(len(chunk)))
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	// 中断时间超过ping_interval+pong_timeout, 双方均判定链路失效
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(300 * time.Millisecond)
+			relay.SetDown(true)
+			time.Sleep(600 * time.Millisecond)
+			relay.SetDown(false)
+		}
+		time.Sleep(300 * time.Millisecond)
+		close(stop)
+	}()
+
+	// 写入结束且回显全部读取后结束, 短超时以便检查写入状态
+	var read int64
+	buf := make([]byte, 32*1024)
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		select {
+		case <-writeDone:
+			if read == atomic.LoadInt64(&written) {
+				goto done
+			}
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("echoed %d of %d bytes, stats %+v", read, atomic.LoadInt64(&written), client.(*KcpConn).Stats().Sessions[0])
+		}
+		client.SetReadTimeout(200 * time.Millisecond)
+		n, err := client.Read(buf)
+		for i := 0; i < n; i++ {
+			if buf[i] != pattern(read) {
+				t.Fatalf("byte %d = %d, want %d", read, buf[i], pattern(read))
+			}
+			read++
+		}
+		if ne, ok := err.(interface{ Timeout() bool }); err != nil && !(ok && ne.Timeout()) {
+			t.Fatalf("read after %d bytes: %v", read, err)
+		}
+	}
+done:
+	if read == 0 {
+		t.Fatal("no data echoed")
+	}
+	// 链路恢复后会话重新接入, 保活超时较短时可能仍在恢复中
+	var st KcpSessionStats
+	for wait := time.Now().Add(2 * time.Second); ; {
+		st = client.(*KcpConn).Stats().Sessions[0]
+		if st.Attached || time.Now().After(wait) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if st.Resumes == 0 {
+		t.Error("link flap did not trigger resume")
+	}
+	if !st.Attached {
+		t.Error("session not attached after the link recovered")
+	}
+	t.Logf("echoed %d bytes, %d resumes, %d bytes resent", read, st.Resumes, st.Resent)
+}
@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lossyRelay 本地UDP中继, 按概率丢包并增加单向延迟, 模拟有损链路
+// 每个客户端源地址对应一个连接目标的socket, 客户端重新拨号时得到新的上游
+type lossyRelay struct {
+	conn   *net.UDPConn
+	target *net.UDPAddr
+	loss   float64
+	delay  time.Duration
+	down   int32 // 非0时丢弃全部数据包, 模拟链路中断
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	peers map[string]*net.UDPConn
+	dead  bool
+}
+
+func newLossyRelay(tb testing.TB, target string, loss float64, delay time.Duration) *lossyRelay {
+	tb.Helper()
+	raddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r := &lossyRelay{
+		conn:   conn,
+		target: raddr,
+		loss:   loss,
+		delay:  delay,
+		rand:   rand.New(rand.NewSource(1)),
+		peers:  make(map[string]*net.UDPConn),
+	}
+	go r.serve()
+	tb.Cleanup(r.close)
+	return r
+}
+
+// Addr 客户端拨号的地址
+func (r *lossyRelay) Addr() string { return r.conn.LocalAddr().String() }
+
+// SetDown 中断或恢复链路
+func (r *lossyRelay) SetDown(down bool) {
+	var v int32
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&r.down, v)
+}
+
+func (r *lossyRelay) drop() bool {
+	if atomic.LoadInt32(&r.down) != 0 {
+		return true
+	}
+	if r.loss <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rand.Float64() < r.loss
+}
+
+// forward 经过延迟后发送, write在延迟到期时调用
+func (r *lossyRelay) forward(pkt []byte, write func([]byte)) {
+	if r.drop() {
+		return
+	}
+	if r.delay <= 0 {
+		write(pkt)
+		return
+	}
+	buf := append([]byte(nil), pkt...)
+	time.AfterFunc(r.delay, func() { write(buf) })
+}
+
+func (r *lossyRelay) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, peer, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		up, err := r.upstream(peer)
+		if err != nil {
+			continue
+		}
+		r.forward(buf[:n], func(pkt []byte) { up.Write(pkt) })
+	}
+}
+
+// upstream 客户端源地址对应的上游socket
+func (r *lossyRelay) upstream(peer *net.UDPAddr) (*net.UDPConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if up, ok := r.peers[peer.String()]; ok {
+		return up, nil
+	}
+	if r.dead {
+		return nil, net.ErrClosed
+	}
+	up, err := net.DialUDP("udp", nil, r.target)
+	if err != nil {
+		return nil, err
+	}
+	r.peers[peer.String()] = up
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := up.Read(buf)
+			if err != nil {
+				return
+			}
+			r.forward(buf[:n], func(pkt []byte) { r.conn.WriteToUDP(pkt, peer) })
+		}
+	}()
+	return up, nil
+}
+
+func (r *lossyRelay) close() {
+	r.conn.Close()
+	r.mu.Lock()
+	r.dead = true
+	for _, up := range r.peers {
+		up.Close()
+	}
+	r.mu.Unlock()
+}
+
+// udpTransport 经有损链路测试的传输层, 返回服务端与客户端使用的配置
+func udpTransport(tb testing.TB, name string) (server, client Config) {
+	switch name {
+	case "kcp":
+		return &KcpConfig{}, &KcpConfig{}
+	case "quic":
+		ca := newTestCA(tb)
+		server = &QUICConfig{TLS: &TLSConfig{TLS: &tls.Config{Certificates: []tls.Certificate{ca.issue(tb, "server", "127.0.0.1")}}}}
+		client = &QUICConfig{TLS: &TLSConfig{TLS: &tls.Config{RootCAs: ca.pool}}}
+		return
+	}
+	tb.Fatalf("unknown transport %s", name)
+	return
+}
+
+// listenAddr 服务端实际监听的地址
+func listenAddr(c Conn) string {
+	switch c := c.(type) {
+	case *KcpConn:
+		return c.listener.Addr().String()
+	case *QUICConn:
+		return c.listener.Addr().String()
+	}
+	return ""
+}
+
+// lossyPair 建立经过有损中继的一对连接
+func lossyPair(tb testing.TB, name string, loss float64, delay time.Duration) (server, client Conn, relay *lossyRelay) {
+	tb.Helper()
+	serverConfig, clientConfig := udpTransport(tb, name)
+	return lossyPairConfig(tb, serverConfig, clientConfig, loss, delay)
+}
+
+// lossyPairConfig 以指定的配置建立经过有损中继的一对连接
+func lossyPairConfig(tb testing.TB, serverConfig, clientConfig Config, loss float64, delay time.Duration) (server, client Conn, relay *lossyRelay) {
+	tb.Helper()
+	name := serverConfig.Transport()
+	lis, err := NewTransport(name, serverConfig)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := lis.Listen("127.0.0.1:0"); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { lis.Close() })
+	relay = newLossyRelay(tb, listenAddr(lis), loss, delay)
+
+	accepted := make(chan Conn, 1)
+	go func() {
+		c, err := lis.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	if client, err = NewTransport(name, clientConfig); err != nil {
+		tb.Fatal(err)
+	}
+	if err := client.Dial(relay.Addr()); err != nil {
+		tb.Fatal(err)
+	}
+	select {
+	case server = <-accepted:
+	case <-time.After(10 * time.Second):
+	}
+	if server == nil {
+		client.Close()
+		tb.Fatal("accept failed")
+	}
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	server.SetReadTimeout(time.Minute)
+	client.SetReadTimeout(time.Minute)
+	server.SetWriteTimeout(time.Minute)
+	client.SetWriteTimeout(time.Minute)
+	return
+}
+
+// transfer 客户端写入count个chunk, 服务端将全部数据读入dst后回复1字节
+func transfer(tb testing.TB, server, client Conn, chunk []byte, count int, dst io.Writer) {
+	tb.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.CopyN(dst, server, int64(len(chunk)*count)); err != nil {
+			tb.Error("server read ", err)
+		}
+		server.Write([]byte{0})
+	}()
+	for i := 0; i < count; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			tb.Fatal("client write ", err)
+		}
+	}
+	if _, err := io.ReadFull(client, make([]byte, 1)); err != nil {
+		tb.Fatal("client read ack ", err)
+	}
+	<-done
+}
+
+var lossyLinks = []struct {
+	name  string
+	loss  float64
+	delay time.Duration
+}{
+	{"clean", 0, 0},
+	{"loss1%-rtt10ms", 0.01, 5 * time.Millisecond},
+	{"loss5%-rtt10ms", 0.05, 5 * time.Millisecond},
+}
+
+// TestLossyTransfer 有损链路上数据完整有序
+func TestLossyTransfer(t *testing.T) {
+	chunk := make([]byte, 16*1024)
+	rand.New(rand.NewSource(2)).Read(chunk)
+	for _, name := range []string{"kcp", "quic"} {
+		for _, link := range lossyLinks[1:] {
+			t.Run(name+"/"+link.name, func(t *testing.T) {
+				server, client, _ := lossyPair(t, name, link.loss, link.delay)
+				var got bytes.Buffer
+				transfer(t, server, client, chunk, 16, &got)
+				if !bytes.Equal(got.Bytes(), bytes.Repeat(chunk, 16)) {
+					t.Fatal("data corrupted")
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkLossyLink QUIC与KCP在本地有损链路上的吞吐对比
+//
+//	go test -run NONE -bench LossyLink socks5/protocol
+func BenchmarkLossyLink(b *testing.B) {
+	chunk := make([]byte, 32*1024)
+	for _, link := range lossyLinks {
+		for _, name := range []string{"kcp", "quic"} {
+			b.Run(name+"/"+link.name, func(b *testing.B) {
+				server, client, _ := lossyPair(b, name, link.loss, link.delay)
+				b.SetBytes(int64(len(chunk)))
+				b.ResetTimer()
+				transfer(b, server, client, chunk, b.N, io.Discard)
+			})
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// MemConfig 进程内传输层配置, 用于无网络的确定性集成测试
+// 链路参数以Listen端的配置为准
+type MemConfig struct {
+	Latency   time.Duration // 单向时延
+	Loss      float64       // 每次写入被丢弃的概率, 丢弃的数据在一个RTO(2*Latency, 至少1ms)后重传, 保持流语义
+	Bandwidth int           // 单向带宽上限 字节/秒, 0不限
+	Buffer    int           // 单向在途数据上限, 超出时写阻塞, 默认1MB
+	Seed      int64         // 丢包随机数种子, 种子相同时丢包序列相同
+}
+
+// MemConn 进程内连接, Listen/Dial的地址为任意名称
+type MemConn struct {
+	netConn
+	config *MemConfig
+
+	// server
+	name     string
+	accept   chan net.Conn
+	die      chan struct{}
+	dieOnce  sync.Once
+	seed     int64
+	seedLock sync.Mutex
+}
+
+var (
+	memListenersMu sync.Mutex
+	memListeners   = make(map[string]*MemConn)
+)
+
+var (
+	errMemClosed  = errors.New("mem conn closed")
+	errMemRefused = errors.New("mem connection refused")
+)
+
+// memTimeout 实现net.Error
+type memTimeout struct{}
+
+func (memTimeout) Error() string   { return "mem i/o timeout" }
+func (memTimeout) Timeout() bool   { return true }
+func (memTimeout) Temporary() bool { return true }
+
+func init() {
+	Register("mem", func(config Config) (Conn, error) {
+		if config == nil {
+			return newMemConn(nil), nil
+		}
+		memConfig, ok := config.(*MemConfig)
+		if !ok {
+			return nil, fmt.Errorf("<mem config invalid %T>", config)
+		}
+		return newMemConn(memConfig), nil
+	})
+}
+
+// Transport 传输层名称
+func (c *MemConfig) Transport() string { return "mem" }
+
+func newMemConn(config *MemConfig) *MemConn {
+	if config == nil {
+		config = &MemConfig{}
+	}
+	if config.Buffer == 0 {
+		config.Buffer = 1024 * 1024
+	}
+	return &MemConn{
+		netConn: netConn{
+			readTimeout:  time.Second * 3,
+			writeTimeout: time.Second * 3,
+		},
+		config: config,
+	}
+}
+
+// Dial 连接同进程内名为addr的监听
+func (c *MemConn) Dial(addr string) (err error) {
+	memListenersMu.Lock()
+	lis, ok := memListeners[addr]
+	memListenersMu.Unlock()
+	if !ok {
+		return fmt.Errorf("<[Dial] %s %w>", addr, errMemRefused)
+	}
+
+	lis.seedLock.Lock()
+	seed := lis.seed
+	lis.seed += 2
+	lis.seedLock.Unlock()
+
+	up := newMemPipe(lis.config, seed)
+	down := newMemPipe(lis.config, seed+1)
+	client := &memConn{rx: down, tx: up, local: memAddr("client:" + addr), remote: memAddr(addr)}
+	server := &memConn{rx: up, tx: down, local: memAddr(addr), remote: memAddr("client:" + addr)}
+
+	select {
+	case lis.accept <- server:
+	case <-lis.die:
+		return fmt.Errorf("<[Dial] %s %w>", addr, errMemRefused)
+	}
+	c.conn = client
+	return
+}
+
+// Listen 以名称注册监听
+func (c *MemConn) Listen(args ...interface{}) (err error) {
+	name := args[0].(string)
+	memListenersMu.Lock()
+	defer memListenersMu.Unlock()
+	if _, dup := memListeners[name]; dup {
+		return fmt.Errorf("<[Listen] mem address %s in use>", name)
+	}
+	c.name = name
+	c.accept = make(chan net.Conn)
+	c.die = make(chan struct{})
+	c.seed = c.config.Seed
+	memListeners[name] = c
+	return
+}
+
+// Accept conn
+func (c *MemConn) Accept() (Conn, error) {
+	select {
+	case conn := <-c.accept:
+		return &MemConn{
+			netConn: newNetConn(conn, c.readTimeout, c.writeTimeout),
+			config:  c.config,
+		}, nil
+	case <-c.die:
+		return nil, errors.New("<[Accept] mem listener closed>")
+	}
+}
+
+// Close conn
+func (c *MemConn) Close() error {
+	if c.die != nil {
+		c.dieOnce.Do(func() {
+			close(c.die)
+			memListenersMu.Lock()
+			delete(memListeners, c.name)
+			memListenersMu.Unlock()
+		})
+		return nil
+	}
+	return c.conn.Close()
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memChunk 一次写入, 在deliverAt之后对读端可见
+type memChunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// memPipe 单向链路, 模拟时延/丢包重传/带宽
+type memPipe struct {
+	config *MemConfig
+	rand   *rand.Rand
+
+	mu       sync.Mutex
+	queue    []memChunk
+	queued   int
+	busyTill time.Time // 带宽占用截止时间
+	lastAt   time.Time // 保证按写入顺序交付
+	closed   bool
+
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newMemPipe(config *MemConfig, seed int64) *memPipe {
+	return &memPipe{
+		config:   config,
+		rand:     rand.New(rand.NewSource(seed)),
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (p *memPipe) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	notify(p.readable)
+	notify(p.writable)
+}
+
+// write 放入队列, 计算交付时间
+func (p *memPipe) write(data []byte, deadline time.Time) (err error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return errMemClosed
+		}
+		if p.queued == 0 || p.queued+len(data) <= p.config.Buffer {
+			break
+		}
+		p.mu.Unlock()
+		if err = wait(p.writable, deadline, time.Time{}); err != nil {
+			return
+		}
+	}
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	delay := p.config.Latency
+	if p.config.Loss > 0 && p.rand.Float64() < p.config.Loss {
+		rto := p.config.Latency * 2
+		if rto < time.Millisecond {
+			rto = time.Millisecond
+		}
+		delay += rto
+	}
+	sendAt := now
+	if p.config.Bandwidth > 0 {
+		if p.busyTill.After(sendAt) {
+			sendAt = p.busyTill
+		}
+		p.busyTill = sendAt.Add(time.Duration(len(data)) * time.Second / time.Duration(p.config.Bandwidth))
+		sendAt = p.busyTill
+	}
+	deliverAt := sendAt.Add(delay)
+	if deliverAt.Before(p.lastAt) {
+		deliverAt = p.lastAt
+	}
+	p.lastAt = deliverAt
+
+	p.queue = append(p.queue, memChunk{data: append([]byte(nil), data...), deliverAt: deliverAt})
+	p.queued += len(data)
+	notify(p.readable)
+	return
+}
+
+// read 读取已到达的数据
+func (p *memPipe) read(buff []byte, deadline time.Time) (nread int, err error) {
+	for {
+		p.mu.Lock()
+		var due time.Time
+		if len(p.queue) > 0 {
+			head := &p.queue[0]
+			if !head.deliverAt.After(time.Now()) {
+				nread = copy(buff, head.data)
+				head.data = head.data[nread:]
+				if len(head.data) == 0 {
+					p.queue = p.queue[1:]
+				}
+				p.queued -= nread
+				p.mu.Unlock()
+				notify(p.writable)
+				return
+			}
+			due = head.deliverAt
+		} else if p.closed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		p.mu.Unlock()
+
+		if err = wait(p.readable, deadline, due); err != nil {
+			return
+		}
+	}
+}
+
+// wait 等待通知, 超过deadline返回超时, due非零时到期返回
+func wait(ch chan struct{}, deadline, due time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return memTimeout{}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	var ready <-chan time.Time
+	if !due.IsZero() {
+		t := time.NewTimer(time.Until(due))
+		defer t.Stop()
+		ready = t.C
+	}
+
+	select {
+	case <-ch:
+	case <-ready:
+	case <-timeout:
+		return memTimeout{}
+	}
+	return nil
+}
+
+// memConn 进程内net.Conn
+type memConn struct {
+	rx, tx        *memPipe
+	local, remote memAddr
+
+	mu                          sync.Mutex
+	readDeadline, writeDeadline time.Time
+	closeOnce                   sync.Once
+}
+
+func (c *memConn) Read(buff []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	return c.rx.read(buff, deadline)
+}
+
+func (c *memConn) Write(data []byte) (nwrite int, err error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if err = c.tx.write(data, deadline); err != nil {
+		return
+	}
+	return len(data), nil
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.tx.close()
+		c.rx.close()
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
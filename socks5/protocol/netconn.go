@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// netConn 基于net.Conn的通用连接实现, 供流式传输层复用
+type netConn struct {
+	conn                      net.Conn
+	readTimeout, writeTimeout time.Duration
+}
+
+func newNetConn(conn net.Conn, readTimeout, writeTimeout time.Duration) netConn {
+	return netConn{
+		conn:         conn,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// SetReadTimeout 设置read timeout, 0为不超时
+func (c *netConn) SetReadTimeout(timeout time.Duration) { c.readTimeout = timeout }
+
+// SetWriteTimeout 设置write timeout, 0为不超时
+func (c *netConn) SetWriteTimeout(timeout time.Duration) { c.writeTimeout = timeout }
+
+// RemoteAddr 返回raw conn
+func (c *netConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// LocalAddr 返回raw conn
+func (c *netConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// Read data
+func (c *netConn) Read(buff []byte) (nread int, err error) {
+	if err = c.conn.SetReadDeadline(deadline(c.readTimeout)); err != nil {
+		return
+	}
+	return c.conn.Read(buff)
+}
+
+// Write data
+func (c *netConn) Write(data []byte) (nwrite int, err error) {
+	if err = c.conn.SetWriteDeadline(deadline(c.writeTimeout)); err != nil {
+		return
+	}
+	return c.conn.Write(data)
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout > 0 {
+		return time.Now().Add(timeout)
+	}
+	return time.Time{}
+}
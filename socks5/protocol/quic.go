@@ -0,0 +1,250 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICConfig QUIC配置, 证书参数与TLS传输层一致(TLS 1.3)
+type QUICConfig struct {
+	TLS                  *TLSConfig
+	HandshakeTimeout     time.Duration
+	IdleTimeout          time.Duration
+	KeepAlivePeriod      time.Duration
+	StreamReceiveWindow  uint64 // 单流接收窗口上限, 对应KCP rcvwnd
+	ConnReceiveWindow    uint64 // 连接接收窗口上限
+	PendingHandshakeSize int    // 服务端等待首个流的连接数上限
+}
+
+// QUICConn QUIC连接, 每条连接只使用一个双向流承载smux会话
+type QUICConn struct {
+	netConn
+	config *QUICConfig
+	tls    *tls.Config
+
+	// server
+	listener *quic.Listener
+	accept   chan *quicStream
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+// quicALPN 未配置ALPN时使用
+const quicALPN = "s5-quic"
+
+// quicPreamble 客户端打开流后写入的首字节, QUIC流在有数据时才会被对端感知
+const quicPreamble byte = 0x01
+
+func init() {
+	Register("quic", func(config Config) (Conn, error) {
+		quicConfig, ok := config.(*QUICConfig)
+		if !ok || quicConfig == nil || quicConfig.TLS == nil {
+			return nil, fmt.Errorf("<quic config invalid %T>", config)
+		}
+		return newQUICConn(quicConfig), nil
+	})
+	RegisterConfig("quic", parseQUICConfig)
+}
+
+func parseQUICConfig(src ConfigSource) (Config, error) {
+	config := &QUICConfig{TLS: tlsSection(src)}
+	if src.IsSet("quic.handshake_timeout") {
+		config.HandshakeTimeout = seconds(src, "quic.handshake_timeout")
+	}
+	if src.IsSet("quic.idle_timeout") {
+		config.IdleTimeout = seconds(src, "quic.idle_timeout")
+	}
+	if src.IsSet("quic.keepalive") {
+		config.KeepAlivePeriod = seconds(src, "quic.keepalive")
+	}
+	if src.IsSet("quic.stream_window") {
+		config.StreamReceiveWindow = uint64(src.GetInt64("quic.stream_window"))
+	}
+	if src.IsSet("quic.conn_window") {
+		config.ConnReceiveWindow = uint64(src.GetInt64("quic.conn_window"))
+	}
+	return config, nil
+}
+
+// Transport 传输层名称
+func (c *QUICConfig) Transport() string { return "quic" }
+
+func newQUICConn(config *QUICConfig) *QUICConn {
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = time.Second * 10
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = time.Second * 30
+	}
+	if config.KeepAlivePeriod == 0 {
+		config.KeepAlivePeriod = time.Second * 10
+	}
+	if config.PendingHandshakeSize == 0 {
+		config.PendingHandshakeSize = 128
+	}
+	return &QUICConn{
+		netConn: netConn{
+			readTimeout:  time.Second * 3,
+			writeTimeout: time.Second * 3,
+		},
+		config: config,
+	}
+}
+
+func (c *QUICConn) quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:       c.config.HandshakeTimeout,
+		MaxIdleTimeout:             c.config.IdleTimeout,
+		KeepAlivePeriod:            c.config.KeepAlivePeriod,
+		MaxStreamReceiveWindow:     c.config.StreamReceiveWindow,
+		MaxConnectionReceiveWindow: c.config.ConnReceiveWindow,
+	}
+}
+
+func (c *QUICConn) buildTLS() (err error) {
+	tlsConfig, err := c.config.TLS.build()
+	if err != nil {
+		return
+	}
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{quicALPN}
+	}
+	c.tls = tlsConfig
+	return
+}
+
+// Dial 建立QUIC连接并打开承载流
+func (c *QUICConn) Dial(addr string) (err error) {
+	if err = c.buildTLS(); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.HandshakeTimeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, c.tls, c.quicConfig())
+	if err != nil {
+		return fmt.Errorf("<[Dial] %s %w>", addr, err)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return fmt.Errorf("<[Dial] %s open stream %w>", addr, err)
+	}
+	if _, err = stream.Write([]byte{quicPreamble}); err != nil {
+		conn.CloseWithError(0, "")
+		return fmt.Errorf("<[Dial] %s %w>", addr, err)
+	}
+
+	c.conn = &quicStream{Stream: stream, conn: conn}
+	return
+}
+
+// Listen port
+func (c *QUICConn) Listen(args ...interface{}) (err error) {
+	if err = c.buildTLS(); err != nil {
+		return
+	}
+	if len(c.tls.Certificates) == 0 && c.tls.GetCertificate == nil {
+		return errors.New("<[Listen] quic server requires certificate>")
+	}
+
+	addr := args[0].(string)
+	if c.listener, err = quic.ListenAddr(addr, c.tls, c.quicConfig()); err != nil {
+		return
+	}
+	c.accept = make(chan *quicStream)
+	c.die = make(chan struct{})
+	go c.serve()
+	return
+}
+
+// serve 后台接受连接, 等待首个流的握手不阻塞其他客户端
+func (c *QUICConn) serve() {
+	pending := make(chan struct{}, c.config.PendingHandshakeSize)
+	for {
+		conn, err := c.listener.Accept(context.Background())
+		if err != nil {
+			c.dieOnce.Do(func() { close(c.die) })
+			return
+		}
+
+		select {
+		case pending <- struct{}{}:
+		default:
+			conn.CloseWithError(0, "busy")
+			continue
+		}
+
+		go func() {
+			defer func() { <-pending }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), c.config.HandshakeTimeout)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				conn.CloseWithError(0, "")
+				return
+			}
+			var preamble [1]byte
+			stream.SetReadDeadline(time.Now().Add(c.config.HandshakeTimeout))
+			if _, err = io.ReadFull(stream, preamble[:]); err != nil || preamble[0] != quicPreamble {
+				conn.CloseWithError(0, "")
+				return
+			}
+			stream.SetReadDeadline(time.Time{})
+
+			select {
+			case c.accept <- &quicStream{Stream: stream, conn: conn}:
+			case <-c.die:
+				conn.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+// Accept conn
+func (c *QUICConn) Accept() (Conn, error) {
+	select {
+	case stream := <-c.accept:
+		return &QUICConn{
+			netConn: newNetConn(stream, c.readTimeout, c.writeTimeout),
+			config:  c.config,
+		}, nil
+	case <-c.die:
+		return nil, errors.New("<[Accept] quic listener closed>")
+	}
+}
+
+// Close conn
+func (c *QUICConn) Close() error {
+	if c.listener != nil {
+		c.dieOnce.Do(func() { close(c.die) })
+		return c.listener.Close()
+	}
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// quicStream 将QUIC流适配为net.Conn, 关闭时同时关闭所属连接
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (s *quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *quicStream) Close() error {
+	s.Stream.Close()
+	return s.conn.CloseWithError(0, "")
+}
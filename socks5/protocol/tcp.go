@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// TCPConfig TCP配置
+type TCPConfig struct {
+	KeepAlive   time.Duration // TCP keepalive 间隔, 0使用系统默认, 小于0关闭
+	NoDelay     bool          // 关闭Nagle算法
+	DialTimeout time.Duration
+}
+
+// TCPConn TCP连接, 用于UDP不可用的网络
+type TCPConn struct {
+	netConn
+	listener net.Listener
+	config   *TCPConfig
+}
+
+func init() {
+	Register("tcp", func(config Config) (Conn, error) {
+		if config == nil {
+			return newTCPConn(nil), nil
+		}
+		tcpConfig, ok := config.(*TCPConfig)
+		if !ok {
+			return nil, fmt.Errorf("<tcp config invalid %T>", config)
+		}
+		return newTCPConn(tcpConfig), nil
+	})
+	RegisterConfig("tcp", parseTCPConfig)
+}
+
+func parseTCPConfig(src ConfigSource) (Config, error) {
+	return tcpSection(src), nil
+}
+
+// tcpSection tcp项, 同时作为tls的底层配置
+func tcpSection(src ConfigSource) *TCPConfig {
+	config := DefaultTCPConfig()
+	if src.IsSet("tcp.keepalive") {
+		config.KeepAlive = seconds(src, "tcp.keepalive")
+	}
+	if src.IsSet("tcp.nodelay") {
+		config.NoDelay = src.GetBool("tcp.nodelay")
+	}
+	if src.IsSet("tcp.dial_timeout") {
+		config.DialTimeout = seconds(src, "tcp.dial_timeout")
+	}
+	return config
+}
+
+// Transport 传输层名称
+func (c *TCPConfig) Transport() string { return "tcp" }
+
+// DefaultTCPConfig tcp默认配置
+func DefaultTCPConfig() *TCPConfig {
+	return &TCPConfig{
+		KeepAlive:   time.Second * 15,
+		NoDelay:     true,
+		DialTimeout: time.Second * 10,
+	}
+}
+
+func newTCPConn(config *TCPConfig) *TCPConn {
+	if config == nil {
+		config = DefaultTCPConfig()
+	}
+	return &TCPConn{
+		netConn: netConn{
+			readTimeout:  time.Second * 3,
+			writeTimeout: time.Second * 3,
+		},
+		config: config,
+	}
+}
+
+// 设置keepalive nodelay
+func (c *TCPConn) configConn(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(c.config.NoDelay); err != nil {
+		log.Println("SetNoDelay:", err)
+	}
+	if c.config.KeepAlive < 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			log.Println("SetKeepAlive:", err)
+		}
+	} else if c.config.KeepAlive > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			log.Println("SetKeepAlive:", err)
+		}
+		if err := tcpConn.SetKeepAlivePeriod(c.config.KeepAlive); err != nil {
+			log.Println("SetKeepAlivePeriod:", err)
+		}
+	}
+}
+
+// Dial TCP发起连接
+func (c *TCPConn) Dial(addr string) (err error) {
+	conn, err := net.DialTimeout("tcp", addr, c.config.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("<[Dial] %s %w>", addr, err)
+	}
+	c.configConn(conn)
+	c.conn = conn
+	return
+}
+
+// Listen port
+func (c *TCPConn) Listen(args ...interface{}) (err error) {
+	addr := args[0].(string)
+	c.listener, err = net.Listen("tcp", addr)
+	return
+}
+
+// Accept conn
+func (c *TCPConn) Accept() (Conn, error) {
+	conn, err := c.listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("<[Accept] %w>", err)
+	}
+	c.configConn(conn)
+
+	return &TCPConn{
+		netConn: newNetConn(conn, c.readTimeout, c.writeTimeout),
+		config:  c.config,
+	}, nil
+}
+
+// Close conn
+func (c *TCPConn) Close() error {
+	if c.listener != nil {
+		return c.listener.Close()
+	}
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// TLSConfig TLS配置
+type TLSConfig struct {
+	TCP        *TCPConfig // 底层TCP参数, nil使用默认
+	CertFile   string     // 本端证书, 服务端必须, 客户端设置时用于双向认证
+	KeyFile    string
+	CAFile     string   // 固定的CA证书包, 只信任由其签发的对端证书
+	ClientAuth bool     // 服务端要求并校验客户端证书
+	ServerName string   // 客户端SNI, 同时用于校验服务端证书
+	ALPN       []string // 应用层协议协商
+
+	// TLS 可选, 直接提供的基础配置(例如内存中生成的证书), 以上各项在其副本上追加
+	TLS *tls.Config
+}
+
+// TLSConn TLS连接, 握手在首次读写时进行, 不阻塞Accept
+type TLSConn struct {
+	*TCPConn
+	tlsConfig *tls.Config
+}
+
+func init() {
+	Register("tls", func(config Config) (Conn, error) {
+		tlsConfig, ok := config.(*TLSConfig)
+		if !ok || tlsConfig == nil {
+			return nil, fmt.Errorf("<tls config invalid %T>", config)
+		}
+		return newTLSConn(tlsConfig)
+	})
+	RegisterConfig("tls", parseTLSConfig)
+}
+
+func parseTLSConfig(src ConfigSource) (Config, error) {
+	return tlsSection(src), nil
+}
+
+// tlsSection tls项, 同时作为wss与quic的证书配置
+func tlsSection(src ConfigSource) *TLSConfig {
+	config := &TLSConfig{TCP: tcpSection(src)}
+	if src.IsSet("tls.cert") {
+		config.CertFile = src.GetString("tls.cert")
+	}
+	if src.IsSet("tls.key") {
+		config.KeyFile = src.GetString("tls.key")
+	}
+	if src.IsSet("tls.ca") {
+		config.CAFile = src.GetString("tls.ca")
+	}
+	if src.IsSet("tls.client_auth") {
+		config.ClientAuth = src.GetBool("tls.client_auth")
+	}
+	if src.IsSet("tls.server_name") {
+		config.ServerName = src.GetString("tls.server_name")
+	}
+	if src.IsSet("tls.alpn") {
+		config.ALPN = src.GetStringSlice("tls.alpn")
+	}
+	return config
+}
+
+// Transport 传输层名称
+func (c *TLSConfig) Transport() string { return "tls" }
+
+// build 生成tls.Config, 客户端与服务端共用
+func (c *TLSConfig) build() (config *tls.Config, err error) {
+	if c.TLS != nil {
+		config = c.TLS.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("<tls load cert> %w", err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("<tls load ca> %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("<tls load ca> no certificate in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+
+	if c.ClientAuth {
+		if config.ClientCAs == nil {
+			return nil, errors.New("<tls client auth requires ca>")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if c.ServerName != "" {
+		config.ServerName = c.ServerName
+	}
+	if len(c.ALPN) > 0 {
+		config.NextProtos = c.ALPN
+	}
+	return
+}
+
+func newTLSConn(config *TLSConfig) (*TLSConn, error) {
+	tlsConfig, err := config.build()
+	if err != nil {
+		return nil, err
+	}
+	return &TLSConn{
+		TCPConn:   newTCPConn(config.TCP),
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+// Dial TLS发起连接, 完成握手后返回
+func (c *TLSConn) Dial(addr string) (err error) {
+	if err = c.TCPConn.Dial(addr); err != nil {
+		return
+	}
+
+	conn := tls.Client(c.conn, clientTLS(c.tlsConfig, addr))
+	if err = conn.SetDeadline(time.Now().Add(c.config.DialTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	if err = conn.Handshake(); err != nil {
+		conn.Close()
+		return fmt.Errorf("<[Dial] %s tls handshake %w>", addr, err)
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+	c.conn = conn
+	return
+}
+
+// clientTLS 未指定ServerName时以addr中的主机名作为SNI并校验服务端证书
+func clientTLS(config *tls.Config, addr string) *tls.Config {
+	if config.ServerName != "" || config.InsecureSkipVerify {
+		return config
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return config
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// Listen port
+func (c *TLSConn) Listen(args ...interface{}) (err error) {
+	if len(c.tlsConfig.Certificates) == 0 && c.tlsConfig.GetCertificate == nil {
+		return errors.New("<[Listen] tls server requires certificate>")
+	}
+	return c.TCPConn.Listen(args...)
+}
+
+// Accept conn
+func (c *TLSConn) Accept() (Conn, error) {
+	conn, err := c.TCPConn.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcpConn := conn.(*TCPConn)
+	tcpConn.conn = tls.Server(tcpConn.conn, c.tlsConfig)
+
+	return &TLSConn{
+		TCPConn:   tcpConn,
+		tlsConfig: c.tlsConfig,
+	}, nil
+}
@@ -0,0 +1,241 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA 内存中生成的CA, 用于签发测试证书
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t testing.TB) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue 签发证书, hosts为DNS名称或IP
+func (ca *testCA) issue(t testing.TB, name string, hosts ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsEchoServer 监听本地端口, 每个连接回显一次数据, 返回监听地址
+func tlsEchoServer(t *testing.T, config *TLSConfig) string {
+	t.Helper()
+	server, err := newTLSConn(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetReadTimeout(2 * time.Second)
+				buf := make([]byte, 16)
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				conn.Write(buf[:n])
+			}()
+		}
+	}()
+	return server.listener.Addr().String()
+}
+
+// tlsEcho 连接并完成一次回显, 双向认证失败时握手或首次读取报错
+func tlsEcho(config *TLSConfig, addr string) (*TLSConn, error) {
+	client, err := newTLSConn(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Dial(addr); err != nil {
+		return nil, err
+	}
+	client.SetReadTimeout(2 * time.Second)
+	if _, err := client.Write([]byte("ping")); err != nil {
+		client.Close()
+		return nil, err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// TestTLSServerName 未配置server_name时以拨号地址的主机名校验证书
+func TestTLSServerName(t *testing.T) {
+	ca := newTestCA(t)
+	addr := tlsEchoServer(t, &TLSConfig{TLS: &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "localhost")}}})
+	_, port, _ := net.SplitHostPort(addr)
+
+	tests := []struct {
+		name       string
+		addr       string
+		serverName string
+		ok         bool
+	}{
+		{"host from addr", net.JoinHostPort("localhost", port), "", true},
+		{"ip not in certificate", addr, "", false},
+		{"explicit server name", addr, "localhost", true},
+		{"wrong server name", net.JoinHostPort("localhost", port), "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &tls.Config{RootCAs: ca.pool}
+			conn, err := tlsEcho(&TLSConfig{TLS: base, ServerName: tt.serverName}, tt.addr)
+			if (err == nil) != tt.ok {
+				t.Fatalf("dial %s: %v", tt.addr, err)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			// 不修改共享的基础配置
+			if base.ServerName != "" {
+				t.Errorf("base config modified: %q", base.ServerName)
+			}
+		})
+	}
+}
+
+// TestTLSClientAuth 服务端要求客户端证书时只接受由CA签发的证书
+func TestTLSClientAuth(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	addr := tlsEchoServer(t, &TLSConfig{
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{ca.issue(t, "server", "127.0.0.1")},
+			ClientCAs:    ca.pool,
+		},
+		ClientAuth: true,
+	})
+
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"signed client", []tls.Certificate{ca.issue(t, "client")}, true},
+		{"no certificate", nil, false},
+		{"unknown ca", []tls.Certificate{other.issue(t, "client")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tlsEcho(&TLSConfig{TLS: &tls.Config{RootCAs: ca.pool, Certificates: tt.certs}}, addr)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		})
+	}
+
+	if _, err := newTLSConn(&TLSConfig{ClientAuth: true}); err == nil {
+		t.Error("client auth without ca accepted")
+	}
+}
+
+// TestTLSALPN 协商双方共同支持的应用层协议, 没有交集时握手失败
+func TestTLSALPN(t *testing.T) {
+	ca := newTestCA(t)
+	addr := tlsEchoServer(t, &TLSConfig{
+		TLS:  &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "127.0.0.1")}},
+		ALPN: []string{"s5/2", "s5/1"},
+	})
+
+	tests := []struct {
+		name   string
+		client []string
+		want   string
+		ok     bool
+	}{
+		{"server preference", []string{"s5/1", "s5/2"}, "s5/2", true},
+		{"single common", []string{"h2", "s5/1"}, "s5/1", true},
+		{"no alpn", nil, "", true},
+		{"no common", []string{"h2"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tlsEcho(&TLSConfig{TLS: &tls.Config{RootCAs: ca.pool}, ALPN: tt.client}, addr)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if conn == nil {
+				return
+			}
+			defer conn.Close()
+			if got := conn.conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; got != tt.want {
+				t.Errorf("negotiated %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
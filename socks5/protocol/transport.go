@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTransport 未指定配置时使用的传输层
+const DefaultTransport = "kcp"
+
+// Config 传输层配置, Transport返回对应的传输层名称
+type Config interface {
+	Transport() string
+}
+
+// Transport 传输层构造函数, config为对应传输层的配置类型, 为nil时使用默认配置
+type Transport func(config Config) (Conn, error)
+
+// ConfigSource 配置来源, 键为带传输层前缀的完整路径(例如 "kcp.key"), *viper.Viper 满足此接口
+type ConfigSource interface {
+	IsSet(key string) bool
+	GetString(key string) string
+	GetBool(key string) bool
+	GetInt(key string) int
+	GetInt64(key string) int64
+	GetFloat64(key string) float64
+	GetDuration(key string) time.Duration
+	GetStringSlice(key string) []string
+	GetStringMapString(key string) map[string]string
+}
+
+// ConfigParser 从配置来源读取传输层配置, 返回nil时使用默认配置
+type ConfigParser func(src ConfigSource) (Config, error)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = make(map[string]Transport)
+	parsers      = make(map[string]ConfigParser)
+)
+
+// Register 注册传输层, 名称重复时panic
+func Register(name string, t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if _, dup := transports[name]; dup {
+		panic("[protocol.Register] duplicate transport " + name)
+	}
+	transports[name] = t
+}
+
+// RegisterConfig 注册传输层的配置解析, 未注册解析的传输层不能通过配置文件选择, 名称重复时panic
+func RegisterConfig(name string, p ConfigParser) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if _, dup := parsers[name]; dup {
+		panic("[protocol.RegisterConfig] duplicate config parser " + name)
+	}
+	parsers[name] = p
+}
+
+// ParseConfig 按名称解析传输层配置
+func ParseConfig(name string, src ConfigSource) (Config, error) {
+	transportsMu.RLock()
+	p, ok := parsers[name]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("<transport %s not configurable>", name)
+	}
+	config, err := p(src)
+	if err != nil {
+		return nil, fmt.Errorf("<config %s err> %w", name, err)
+	}
+	return config, nil
+}
+
+// Configurable 可通过配置选择的传输层名称
+func Configurable() (names []string) {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// seconds 以秒为单位的配置项
+func seconds(src ConfigSource, key string) time.Duration {
+	return src.GetDuration(key) * time.Second
+}
+
+// Transports 已注册的传输层名称
+func Transports() (names []string) {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// NewTransport 按名称构造传输层
+func NewTransport(name string, config Config) (Conn, error) {
+	transportsMu.RLock()
+	t, ok := transports[name]
+	transportsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("<unknown transport %s>", name)
+	}
+	return t(config)
+}
+
+// New 根据配置类型构造对应的传输层, 无参数时使用默认KCP
+func New(args ...interface{}) Conn {
+	name := DefaultTransport
+	var config Config
+	if len(args) > 0 && args[0] != nil {
+		// 非法参数校验
+		var ok bool
+		if config, ok = args[0].(Config); !ok {
+			panic("[protocol.New] args invalid!")
+		}
+		name = config.Transport()
+	}
+
+	c, err := NewTransport(name, config)
+	if err != nil {
+		panic("[protocol.New] " + err.Error())
+	}
+	return c
+}
@@ -0,0 +1,23 @@
+package protocol
+
+import "testing"
+
+// TestCloseUnconnected 未Dial/Listen的连接关闭时不应panic
+func TestCloseUnconnected(t *testing.T) {
+	for _, name := range []string{"tcp", "ws", "unix", "kcp"} {
+		c, err := NewTransport(name, nil)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("%s: close %v", name, err)
+		}
+	}
+	// tls与quic必须提供证书配置
+	for _, c := range []Conn{&TLSConn{TCPConn: newTCPConn(nil)}, &QUICConn{}} {
+		if err := c.Close(); err != nil {
+			t.Errorf("%T: close %v", c, err)
+		}
+	}
+}
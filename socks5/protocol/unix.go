@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnixConfig unix domain socket配置
+type UnixConfig struct {
+	Mode        os.FileMode // 监听socket文件权限, 默认0600
+	DialTimeout time.Duration
+}
+
+// UnixConn unix domain socket连接, 地址为socket路径, 可带 "unix:" 前缀
+type UnixConn struct {
+	netConn
+	listener net.Listener
+	config   *UnixConfig
+}
+
+func init() {
+	Register("unix", func(config Config) (Conn, error) {
+		if config == nil {
+			return newUnixConn(nil), nil
+		}
+		unixConfig, ok := config.(*UnixConfig)
+		if !ok {
+			return nil, fmt.Errorf("<unix config invalid %T>", config)
+		}
+		return newUnixConn(unixConfig), nil
+	})
+	RegisterConfig("unix", parseUnixConfig)
+}
+
+// parseUnixConfig unix domain socket传输层, server与client在同一主机
+func parseUnixConfig(src ConfigSource) (Config, error) {
+	config := &UnixConfig{}
+	if src.IsSet("unix.mode") {
+		mode, err := ParseFileMode(src.GetString("unix.mode"))
+		if err != nil {
+			return nil, err
+		}
+		config.Mode = mode
+	}
+	if src.IsSet("unix.dial_timeout") {
+		config.DialTimeout = seconds(src, "unix.dial_timeout")
+	}
+	return config, nil
+}
+
+// ParseFileMode 八进制的socket文件权限, 例如 "0660"
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("<file mode %q err> %w", s, err)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Transport 传输层名称
+func (c *UnixConfig) Transport() string { return "unix" }
+
+func newUnixConn(config *UnixConfig) *UnixConn {
+	if config == nil {
+		config = &UnixConfig{}
+	}
+	if config.Mode == 0 {
+		config.Mode = 0600
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = time.Second * 10
+	}
+	return &UnixConn{
+		netConn: netConn{
+			readTimeout:  time.Second * 3,
+			writeTimeout: time.Second * 3,
+		},
+		config: config,
+	}
+}
+
+// Dial 连接socket
+func (c *UnixConn) Dial(addr string) (err error) {
+	conn, err := net.DialTimeout("unix", strings.TrimPrefix(addr, "unix:"), c.config.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("<[Dial] %s %w>", addr, err)
+	}
+	c.conn = conn
+	return
+}
+
+// Listen socket, 清理残留的socket文件并设置权限
+func (c *UnixConn) Listen(args ...interface{}) (err error) {
+	c.listener, err = ListenUnix(strings.TrimPrefix(args[0].(string), "unix:"), c.config.Mode)
+	return
+}
+
+// Accept conn
+func (c *UnixConn) Accept() (Conn, error) {
+	conn, err := c.listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("<[Accept] %w>", err)
+	}
+	return &UnixConn{
+		netConn: newNetConn(conn, c.readTimeout, c.writeTimeout),
+		config:  c.config,
+	}, nil
+}
+
+// Close conn, 监听关闭时删除socket文件
+func (c *UnixConn) Close() error {
+	if c.listener != nil {
+		return c.listener.Close()
+	}
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// ListenUnix 监听unix socket, 删除残留的socket文件, 并将权限设置为mode
+func ListenUnix(path string, mode os.FileMode) (lis net.Listener, err error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("<[Listen] %s exists and is not a socket>", path)
+		}
+		// 仍有进程在监听时不删除
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("<[Listen] %s address already in use>", path)
+		}
+		os.Remove(path)
+	}
+
+	if lis, err = net.Listen("unix", path); err != nil {
+		return
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return
+}
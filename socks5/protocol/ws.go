@@ -0,0 +1,252 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSConfig WebSocket配置, 用于穿越只允许HTTP升级的出口/反向代理/CDN
+type WSConfig struct {
+	Path             string            // 请求路径, 默认 "/"
+	Host             string            // 客户端Host头, 默认使用拨号地址
+	Headers          map[string]string // 客户端附加请求头
+	TLS              *TLSConfig        // 非nil时使用wss
+	HandshakeTimeout time.Duration
+}
+
+// WSConn WebSocket连接, 数据承载在binary帧中
+type WSConn struct {
+	netConn
+	config *WSConfig
+
+	// server
+	listener net.Listener
+	server   *http.Server
+	accept   chan *wsStream
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+func init() {
+	Register("ws", func(config Config) (Conn, error) {
+		if config == nil {
+			return newWSConn(nil), nil
+		}
+		wsConfig, ok := config.(*WSConfig)
+		if !ok {
+			return nil, fmt.Errorf("<ws config invalid %T>", config)
+		}
+		return newWSConn(wsConfig), nil
+	})
+	RegisterConfig("ws", parseWSConfig)
+}
+
+func parseWSConfig(src ConfigSource) (Config, error) {
+	config := &WSConfig{}
+	if src.IsSet("ws.path") {
+		config.Path = src.GetString("ws.path")
+	}
+	if src.IsSet("ws.host") {
+		config.Host = src.GetString("ws.host")
+	}
+	if src.IsSet("ws.headers") {
+		config.Headers = src.GetStringMapString("ws.headers")
+	}
+	if src.IsSet("ws.handshake_timeout") {
+		config.HandshakeTimeout = seconds(src, "ws.handshake_timeout")
+	}
+	// wss
+	if src.IsSet("ws.tls") && src.GetBool("ws.tls") {
+		config.TLS = tlsSection(src)
+	}
+	return config, nil
+}
+
+// Transport 传输层名称
+func (c *WSConfig) Transport() string { return "ws" }
+
+func newWSConn(config *WSConfig) *WSConn {
+	if config == nil {
+		config = &WSConfig{}
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = time.Second * 10
+	}
+	return &WSConn{
+		netConn: netConn{
+			readTimeout:  time.Second * 3,
+			writeTimeout: time.Second * 3,
+		},
+		config: config,
+	}
+}
+
+// Dial 发起WebSocket连接
+func (c *WSConn) Dial(addr string) (err error) {
+	dialer := &websocket.Dialer{HandshakeTimeout: c.config.HandshakeTimeout}
+	scheme := "ws"
+	if c.config.TLS != nil {
+		scheme = "wss"
+		if dialer.TLSClientConfig, err = c.config.TLS.build(); err != nil {
+			return
+		}
+	}
+
+	header := http.Header{}
+	for k, v := range c.config.Headers {
+		header.Set(k, v)
+	}
+	if c.config.Host != "" {
+		header.Set("Host", c.config.Host)
+	}
+
+	url := scheme + "://" + addr + c.config.Path
+	ws, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("<[Dial] %s %s %w>", url, resp.Status, err)
+		}
+		return fmt.Errorf("<[Dial] %s %w>", url, err)
+	}
+	c.conn = newWSStream(ws)
+	return
+}
+
+// Listen 在addr上启动HTTP服务, 仅在Path上接受升级请求
+func (c *WSConn) Listen(args ...interface{}) (err error) {
+	addr := args[0].(string)
+	if c.listener, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+
+	c.accept = make(chan *wsStream)
+	c.die = make(chan struct{})
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: c.config.HandshakeTimeout,
+		CheckOrigin:      func(r *http.Request) bool { return true },
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(c.config.Path, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		stream := newWSStream(ws)
+		select {
+		case c.accept <- stream:
+		case <-c.die:
+			stream.Close()
+			return
+		}
+		// 链接关闭前handler不能返回
+		select {
+		case <-stream.die:
+		case <-c.die:
+		}
+	})
+	c.server = &http.Server{Handler: mux}
+
+	lis := c.listener
+	if c.config.TLS != nil {
+		tlsConfig, err := c.config.TLS.build()
+		if err != nil {
+			lis.Close()
+			return err
+		}
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	go c.server.Serve(lis)
+	return
+}
+
+// Accept conn
+func (c *WSConn) Accept() (Conn, error) {
+	select {
+	case stream := <-c.accept:
+		return &WSConn{
+			netConn: newNetConn(stream, c.readTimeout, c.writeTimeout),
+			config:  c.config,
+		}, nil
+	case <-c.die:
+		return nil, errors.New("<[Accept] ws listener closed>")
+	}
+}
+
+// Close conn
+func (c *WSConn) Close() error {
+	if c.server != nil {
+		c.dieOnce.Do(func() { close(c.die) })
+		return c.server.Close()
+	}
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// wsStream 将WebSocket消息适配为字节流
+type wsStream struct {
+	*websocket.Conn
+	reader  io.Reader
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newWSStream(ws *websocket.Conn) *wsStream {
+	return &wsStream{Conn: ws, die: make(chan struct{})}
+}
+
+func (s *wsStream) Read(buff []byte) (nread int, err error) {
+	for {
+		if s.reader == nil {
+			var mt int
+			if mt, s.reader, err = s.NextReader(); err != nil {
+				return
+			}
+			if mt != websocket.BinaryMessage {
+				s.reader = nil
+				continue
+			}
+		}
+		nread, err = s.reader.Read(buff)
+		if err == io.EOF {
+			s.reader = nil
+			if nread == 0 {
+				continue
+			}
+			err = nil
+		}
+		return
+	}
+}
+
+func (s *wsStream) Write(data []byte) (nwrite int, err error) {
+	if err = s.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return
+	}
+	return len(data), nil
+}
+
+func (s *wsStream) SetDeadline(t time.Time) (err error) {
+	if err = s.SetReadDeadline(t); err != nil {
+		return
+	}
+	return s.SetWriteDeadline(t)
+}
+
+func (s *wsStream) Close() error {
+	s.dieOnce.Do(func() { close(s.die) })
+	return s.Conn.Close()
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsEchoServer 监听本地端口并回显每个连接的数据, 返回监听地址
+func wsEchoServer(t *testing.T, config *WSConfig) string {
+	t.Helper()
+	server := newWSConn(config)
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return server.listener.Addr().String()
+}
+
+// TestWSRoundTrip 只有请求路径匹配的升级请求被接受, 数据跨多个帧完整回显
+func TestWSRoundTrip(t *testing.T) {
+	ca := newTestCA(t)
+	serverTLS := &TLSConfig{TLS: &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "127.0.0.1")}}}
+	clientTLS := &TLSConfig{TLS: &tls.Config{RootCAs: ca.pool}}
+
+	tests := []struct {
+		name       string
+		serverPath string
+		clientPath string
+		tls        bool
+		ok         bool
+	}{
+		{"default path", "", "", false, true},
+		{"matching path", "/tunnel", "/tunnel", false, true},
+		{"wrong path", "/tunnel", "/other", false, false},
+		{"root on tunnel path", "/tunnel", "", false, false},
+		{"wss", "/tunnel", "/tunnel", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := &WSConfig{Path: tt.serverPath}, &WSConfig{Path: tt.clientPath}
+			if tt.tls {
+				server.TLS, client.TLS = serverTLS, clientTLS
+			}
+			addr := wsEchoServer(t, server)
+
+			c := newWSConn(client)
+			err := c.Dial(addr)
+			if (err == nil) != tt.ok {
+				t.Fatalf("dial err %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "404") {
+					t.Errorf("dial err %v, want 404", err)
+				}
+				return
+			}
+			defer c.Close()
+
+			data := make([]byte, 100*1024)
+			rand.Read(data)
+			go func() {
+				for i := 0; i < len(data); i += 4096 {
+					c.Write(data[i : i+4096])
+				}
+			}()
+			c.SetReadTimeout(5 * time.Second)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("echo mismatch")
+			}
+		})
+	}
+
+	// 非升级请求被拒绝
+	addr := wsEchoServer(t, &WSConfig{Path: "/tunnel"})
+	resp, err := http.Get("http://" + addr + "/tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain request status %d", resp.StatusCode)
+	}
+}
+
+// TestWSDialHeaders 客户端发送配置的路径, Host与附加请求头
+func TestWSDialHeaders(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	upgrader := &websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ws.Close()
+	}))
+	defer ts.Close()
+
+	c := newWSConn(&WSConfig{
+		Path:    "/edge/ws",
+		Host:    "cdn.example.com",
+		Headers: map[string]string{"X-Tunnel-Token": "abc", "User-Agent": "testsocks5"},
+	})
+	if err := c.Dial(strings.TrimPrefix(ts.URL, "http://")); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r := <-requests
+	if r.URL.Path != "/edge/ws" || r.Host != "cdn.example.com" {
+		t.Errorf("request %s host %s", r.URL.Path, r.Host)
+	}
+	if r.Header.Get("X-Tunnel-Token") != "abc" || r.Header.Get("User-Agent") != "testsocks5" {
+		t.Errorf("headers %v", r.Header)
+	}
+}
@@ -0,0 +1,219 @@
+package rule
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Action 出站动作
+type Action int
+
+// ACTION
+const (
+	ActionTunnel Action = iota // 经隧道转发
+	ActionDirect               // 本地直连
+	ActionReject               // 拒绝连接
+)
+
+var actionName = map[Action]string{
+	ActionTunnel: "tunnel",
+	ActionDirect: "direct",
+	ActionReject: "reject",
+}
+
+func (a Action) String() string {
+	if name, ok := actionName[a]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseAction 字符串转Action
+func ParseAction(s string) (Action, error) {
+	for k, v := range actionName {
+		if v == strings.ToLower(s) {
+			return k, nil
+		}
+	}
+	return ActionTunnel, fmt.Errorf("<unknown action %s>", s)
+}
+
+// PortRange 端口范围 [Min, Max]
+type PortRange struct {
+	Min, Max uint16
+}
+
+// Rule 单条规则
+// 主机条件(Domains/Nets)与端口条件(Ports)同时满足时命中, 条件为空视为匹配任意值
+type Rule struct {
+	Action  Action
+	Domains []string // 域名后缀, "example.com" 匹配自身及所有子域名
+	Nets    []*net.IPNet
+	Ports   []PortRange
+}
+
+// AddDomain 添加域名
+func (r *Rule) AddDomain(domain string) {
+	domain = strings.TrimPrefix(domain, "*")
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if domain != "" {
+		r.Domains = append(r.Domains, domain)
+	}
+}
+
+// AddCIDR 添加网段, 单个IP视为/32或/128
+func (r *Rule) AddCIDR(cidr string) (err error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return fmt.Errorf("<invalid cidr %s>", cidr)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("<invalid cidr %s> %w", cidr, err)
+	}
+	r.Nets = append(r.Nets, ipNet)
+	return
+}
+
+// AddPorts 添加端口规则 "80" 或 "8000-9000"
+func (r *Rule) AddPorts(ports string) (err error) {
+	var p PortRange
+	bounds := strings.SplitN(ports, "-", 2)
+	if p.Min, err = parsePort(bounds[0]); err != nil {
+		return
+	}
+	p.Max = p.Min
+	if len(bounds) == 2 {
+		if p.Max, err = parsePort(bounds[1]); err != nil {
+			return
+		}
+	}
+	if p.Min > p.Max {
+		return fmt.Errorf("<invalid port range %s>", ports)
+	}
+	r.Ports = append(r.Ports, p)
+	return
+}
+
+// LoadDomainFile 从文件加载域名列表, 每行一个, '#'开头为注释
+func (r *Rule) LoadDomainFile(path string) error {
+	return readLines(path, func(line string) error {
+		r.AddDomain(line)
+		return nil
+	})
+}
+
+// LoadCIDRFile 从文件加载网段列表, 每行一个, '#'开头为注释
+func (r *Rule) LoadCIDRFile(path string) error {
+	return readLines(path, r.AddCIDR)
+}
+
+// Match 目标地址是否命中该规则
+func (r *Rule) Match(host string, port uint16) bool {
+	return r.matchHost(host) && r.matchPort(port)
+}
+
+func (r *Rule) matchHost(host string) bool {
+	if len(r.Domains) == 0 && len(r.Nets) == 0 {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range r.Nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, d := range r.Domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchPort(port uint16) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if port >= p.Min && port <= p.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// Router 出站路由
+// 按顺序匹配规则, 首条命中的规则生效, 均未命中时使用Default
+// 域名不会被解析为IP, 避免本地DNS泄露, 因此CIDR规则只对IP地址生效
+type Router struct {
+	Rules   []*Rule
+	Default Action
+}
+
+// Match 返回目标地址 host:port 对应的出站动作
+func (r *Router) Match(addr string) Action {
+	if r == nil {
+		return ActionTunnel
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return r.Default
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return r.Default
+	}
+
+	for _, rule := range r.Rules {
+		if rule.Match(host, port) {
+			return rule.Action
+		}
+	}
+	return r.Default
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("<invalid port %s> %w", s, err)
+	}
+	return uint16(p), nil
+}
+
+func readLines(path string, fn func(line string) error) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err = fn(line); err != nil {
+			return fmt.Errorf("<%s> %w", path, err)
+		}
+	}
+	return scanner.Err()
+}
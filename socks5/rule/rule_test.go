@@ -0,0 +1,214 @@
+package rule
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newRule(t *testing.T, action Action, domains, cidrs, ports []string) *Rule {
+	t.Helper()
+	r := &Rule{Action: action}
+	for _, d := range domains {
+		r.AddDomain(d)
+	}
+	for _, c := range cidrs {
+		if err := r.AddCIDR(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range ports {
+		if err := r.AddPorts(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func TestRuleDomainSuffix(t *testing.T) {
+	r := newRule(t, ActionDirect, []string{"example.com", "*.corp.lan", ".Internal."}, nil, nil)
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"a.b.example.com", true},
+		{"EXAMPLE.COM.", true},
+		{"badexample.com", false},
+		{"example.com.evil", false},
+		{"corp.lan", true},
+		{"git.corp.lan", true},
+		{"svc.internal", true},
+		{"internal.io", false},
+		{"10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := r.Match(tt.host, 443); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRuleCIDR(t *testing.T) {
+	r := newRule(t, ActionDirect, nil, []string{"10.0.0.0/8", "192.168.1.7", "fd00::/8"}, nil)
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"fd12::1", true},
+		{"fe80::1", false},
+		// 域名不解析, 不命中cidr规则
+		{"localhost", false},
+	}
+	for _, tt := range tests {
+		if got := r.Match(tt.host, 80); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0"} {
+		if err := (&Rule{}).AddCIDR(bad); err == nil {
+			t.Errorf("AddCIDR(%q) accepted", bad)
+		}
+	}
+}
+
+func TestRulePorts(t *testing.T) {
+	r := newRule(t, ActionReject, nil, nil, []string{"25", "6660-6669", " 8080 "})
+	tests := []struct {
+		port uint16
+		want bool
+	}{
+		{25, true},
+		{24, false},
+		{6660, true},
+		{6665, true},
+		{6669, true},
+		{6670, false},
+		{8080, true},
+	}
+	for _, tt := range tests {
+		if got := r.Match("example.com", tt.port); got != tt.want {
+			t.Errorf("Match(port %d) = %v, want %v", tt.port, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "x", "70000", "9000-8000", "1-2-3"} {
+		if err := (&Rule{}).AddPorts(bad); err == nil {
+			t.Errorf("AddPorts(%q) accepted", bad)
+		}
+	}
+}
+
+func TestRuleHostAndPort(t *testing.T) {
+	// 主机与端口条件同时满足才命中
+	r := newRule(t, ActionDirect, []string{"lan"}, []string{"10.0.0.0/8"}, []string{"22"})
+	tests := []struct {
+		host string
+		port uint16
+		want bool
+	}{
+		{"nas.lan", 22, true},
+		{"10.0.0.5", 22, true},
+		{"nas.lan", 80, false},
+		{"example.com", 22, false},
+	}
+	for _, tt := range tests {
+		if got := r.Match(tt.host, tt.port); got != tt.want {
+			t.Errorf("Match(%q, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	router := &Router{
+		Default: ActionReject,
+		Rules: []*Rule{
+			newRule(t, ActionReject, nil, nil, []string{"25"}),
+			newRule(t, ActionDirect, []string{"lan"}, []string{"192.168.0.0/16"}, nil),
+			newRule(t, ActionTunnel, nil, nil, []string{"80", "443"}),
+		},
+	}
+	tests := []struct {
+		addr string
+		want Action
+	}{
+		// 首条命中的规则生效
+		{"mail.lan:25", ActionReject},
+		{"nas.lan:8080", ActionDirect},
+		{"192.168.3.4:443", ActionDirect},
+		{"example.com:443", ActionTunnel},
+		{"[2001:db8::1]:80", ActionTunnel},
+		// 均未命中时使用Default
+		{"example.com:22", ActionReject},
+		{"no-port", ActionReject},
+		{"example.com:http", ActionReject},
+	}
+	for _, tt := range tests {
+		if got := router.Match(tt.addr); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	var none *Router
+	if got := none.Match("example.com:80"); got != ActionTunnel {
+		t.Errorf("nil router Match = %v, want tunnel", got)
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Action
+		ok   bool
+	}{
+		{"tunnel", ActionTunnel, true},
+		{"DIRECT", ActionDirect, true},
+		{"reject", ActionReject, true},
+		{"drop", ActionTunnel, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseAction(tt.in)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("ParseAction(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestLoadFiles(t *testing.T) {
+	dir := t.TempDir()
+	domains := filepath.Join(dir, "domains.txt")
+	cidrs := filepath.Join(dir, "cidrs.txt")
+	if err := os.WriteFile(domains, []byte("# comment\n\nexample.org\n  corp.lan  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cidrs, []byte("10.0.0.0/8\n# 11.0.0.0/8\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Rule{}
+	if err := r.LoadDomainFile(domains); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.LoadCIDRFile(cidrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Domains) != 2 || len(r.Nets) != 1 {
+		t.Fatalf("loaded %v %v", r.Domains, r.Nets)
+	}
+	if !r.Match("www.corp.lan", 1) || r.Match("11.1.1.1", 1) {
+		t.Error("unexpected match after loading files")
+	}
+
+	if err := os.WriteFile(cidrs, []byte("10.0.0.0/8\nbogus\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Rule{}).LoadCIDRFile(cidrs); err == nil {
+		t.Error("invalid cidr file accepted")
+	}
+}
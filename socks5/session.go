@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"socks5/protocol"
+
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session 一条正在转发的连接, 由ProxySession登记
+type Session struct {
+	ID     uint64
+	User   string // 认证用户, 客户端为本端配置的用户名
+	Client string // 发起方地址
+	Dest   string // 目标地址
+	Route  string // 客户端路由(proxy_router的in)
+	Start  time.Time
+
+	up, down uint64 // client->target, target->client 字节数
+	closers  []io.Closer
+}
+
+// SessionInfo 会话快照
+type SessionInfo struct {
+	ID       uint64    `json:"id"`
+	User     string    `json:"user"`
+	Client   string    `json:"client"`
+	Dest     string    `json:"dest"`
+	Route    string    `json:"route,omitempty"`
+	Start    time.Time `json:"start"`
+	Upload   uint64    `json:"upload"`
+	Download uint64    `json:"download"`
+}
+
+func (s *Session) info() SessionInfo {
+	return SessionInfo{
+		ID:       s.ID,
+		User:     s.User,
+		Client:   s.Client,
+		Dest:     s.Dest,
+		Route:    s.Route,
+		Start:    s.Start,
+		Upload:   atomic.LoadUint64(&s.up),
+		Download: atomic.LoadUint64(&s.down),
+	}
+}
+
+// SessionRegistry 正在转发的会话
+type SessionRegistry struct {
+	mu       sync.Mutex
+	seq      uint64
+	sessions map[uint64]*Session
+}
+
+// Sessions 本进程的会话
+var Sessions = &SessionRegistry{sessions: make(map[uint64]*Session)}
+
+func (r *SessionRegistry) add(s *Session, closers ...io.Closer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	s.ID = r.seq
+	s.Start = time.Now()
+	s.closers = closers
+	r.sessions[s.ID] = s
+}
+
+func (r *SessionRegistry) remove(s *Session) {
+	r.mu.Lock()
+	delete(r.sessions, s.ID)
+	r.mu.Unlock()
+}
+
+// Len 会话数
+func (r *SessionRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// List 按ID顺序返回满足match的会话, match为nil时返回全部
+func (r *SessionRegistry) List(match func(SessionInfo) bool) []SessionInfo {
+	r.mu.Lock()
+	list := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		if info := s.info(); match == nil || match(info) {
+			list = append(list, info)
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Kill 关闭会话两端, 转发随之结束, 会话不存在时返回false
+func (r *SessionRegistry) Kill(id uint64) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	for _, c := range s.closers {
+		c.Close()
+	}
+	return true
+}
+
+// counter 累计写入的字节数
+type counter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (c counter) Write(b []byte) (n int, err error) {
+	n, err = c.w.Write(b)
+	atomic.AddUint64(c.n, uint64(n))
+	return
+}
+
+// ProxySession 登记会话并转发, client为发起方一侧, target为目标一侧, 任一方向结束后关闭两端并注销
+func ProxySession(sess *Session, client, target io.ReadWriteCloser) {
+	defer client.Close()
+	defer target.Close()
+
+	if s1, ok := client.(protocol.Stream); ok {
+		if p2, ok := target.(net.Conn); ok {
+			log.Info("stream open in:", s1.RemoteAddr().String(), " out:", p2.LocalAddr().String())
+			defer log.Info("stream close in:", s1.RemoteAddr().String(), " out:", p2.LocalAddr().String())
+		}
+	}
+
+	if c, ok := client.(interface{ RemoteAddr() net.Addr }); ok && sess.Client == "" {
+		sess.Client = c.RemoteAddr().String()
+	}
+	Sessions.add(sess, client, target)
+	defer Sessions.remove(sess)
+
+	streamCopy := func(dst io.Writer, src io.ReadCloser) chan struct{} {
+		die := make(chan struct{})
+		go func() {
+			buff := s5Buf.Get().([]byte)
+			if _, err := io.CopyBuffer(dst, src, buff); err != nil {
+				log.Warn("[streamCopy] err: ", err)
+			}
+			s5Buf.Put(buff)
+			close(die)
+		}()
+		return die
+	}
+
+	select {
+	case <-streamCopy(counter{target, &sess.up}, client):
+	case <-streamCopy(counter{client, &sess.down}, target):
+	}
+}
@@ -0,0 +1,129 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startSession 以net.Pipe登记一条转发中的会话, 返回会话ID, 发起方一端与转发结束信号
+// 各会话的Client须不同, 用于找到登记后的会话
+func startSession(t *testing.T, sess *Session) (uint64, net.Conn, <-chan struct{}) {
+	t.Helper()
+	addr := sess.Client
+	client, clientPeer := net.Pipe()
+	target, targetPeer := net.Pipe()
+	t.Cleanup(func() {
+		clientPeer.Close()
+		targetPeer.Close()
+	})
+	go io.Copy(targetPeer, targetPeer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ProxySession(sess, client, target)
+	}()
+	// 等待会话登记
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if list := Sessions.List(func(s SessionInfo) bool { return s.Client == addr }); len(list) == 1 {
+			return list[0].ID, clientPeer, done
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestSessionRegistry List按条件过滤并按ID排序, Kill关闭两端后会话注销
+func TestSessionRegistry(t *testing.T) {
+	const user = "TestSessionRegistry"
+	a := &Session{User: user, Client: "10.0.0.1:1000", Dest: "example.com:443", Route: "127.0.0.1:1080"}
+	b := &Session{User: user, Client: "10.0.0.2:2000", Dest: "example.org:80", Route: "127.0.0.1:1081"}
+	c := &Session{User: user + "-other", Client: "10.0.0.3:3000", Dest: "example.com:80"}
+	idA, peerA, doneA := startSession(t, a)
+	idB, _, doneB := startSession(t, b)
+	idC, _, doneC := startSession(t, c)
+
+	// 转发中的字节数计入快照, 回显送达后计数才增加
+	go peerA.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(peerA, buf); err != nil {
+		t.Fatal(err)
+	}
+	var byUser []SessionInfo
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		byUser = Sessions.List(func(s SessionInfo) bool { return s.User == user })
+		if byUser[0].Download == 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ids := func(list []SessionInfo) (ids []uint64) {
+		for _, s := range list {
+			ids = append(ids, s.ID)
+		}
+		return
+	}
+	equal := func(got []uint64, want ...uint64) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if got := ids(byUser); !equal(got, idA, idB) {
+		t.Errorf("list by user = %v, want %v", got, []uint64{idA, idB})
+	}
+	if byUser[0].Upload != 4 || byUser[0].Download != 4 {
+		t.Errorf("session bytes up %d down %d, want 4/4", byUser[0].Upload, byUser[0].Download)
+	}
+	byRoute := Sessions.List(func(s SessionInfo) bool { return s.Route == "127.0.0.1:1081" })
+	if got := ids(byRoute); !equal(got, idB) {
+		t.Errorf("list by route = %v, want %v", got, []uint64{idB})
+	}
+	all := ids(Sessions.List(nil))
+	for _, id := range []uint64{idA, idB, idC} {
+		found := false
+		for _, got := range all {
+			found = found || got == id
+		}
+		if !found {
+			t.Errorf("session %d missing from unfiltered list", id)
+		}
+	}
+
+	// Kill只结束指定的会话
+	if !Sessions.Kill(idA) {
+		t.Fatal("kill returned false for a live session")
+	}
+	select {
+	case <-doneA:
+	case <-time.After(2 * time.Second):
+		t.Fatal("proxy did not end after kill")
+	}
+	if got := ids(Sessions.List(func(s SessionInfo) bool { return s.User == user })); !equal(got, idB) {
+		t.Errorf("list after kill = %v, want %v", got, []uint64{idB})
+	}
+	if Sessions.Kill(idA) {
+		t.Error("kill returned true for a removed session")
+	}
+	select {
+	case <-doneB:
+		t.Error("unrelated session ended")
+	case <-doneC:
+		t.Error("unrelated session ended")
+	default:
+	}
+	Sessions.Kill(idB)
+	Sessions.Kill(idC)
+	<-doneB
+	<-doneC
+}
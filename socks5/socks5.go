@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var s5Buf sync.Pool
@@ -24,12 +26,22 @@ func init() {
 type S5Protocol struct {
 	Version            byte
 	Username, Password string
-	AuthMethodSupport  []byte      // 双方支持的认证方式
-	AuthMethodChoose   byte        // 双方最终协商决定
-	DirectMode         bool        // 自定义模式 connect时不去链接 bind address, 直接复用socks5认证链接.
-	ConnConfig         interface{} // 下层链接私有参数
+	Secret             string          // AuthHMACChallenge 共享密钥
+	AuthMethodSupport  []byte          // 支持的认证方式, 服务端按顺序优先选择
+	RequireAuth        bool            // 服务端拒绝无认证方式
+	AuthMethodChoose   byte            // Deprecated: 协商结果属于单个连接, 多个连接共用同一配置并发Dial, 不再写入
+	DirectMode         bool            // 自定义模式 connect时不去链接 bind address, 直接复用socks5认证链接.
+	ConnConfig         interface{}     // 下层链接私有参数
+	AddrMap            *AddrMap        // 服务端目标地址改写
+	Authenticators     []Authenticator // 自定义认证方法, 优先于内置实现
+	UnixTargets        []string        // 服务端允许客户端connect的unix socket路径(filepath.Match模式), 为空时拒绝unix目标
+	// DialTarget 服务端连接connect目标的方法, 为nil时使用DialAddr. 返回ErrNotAllowed时回复规则拒绝
+	DialTarget func(addr string) (net.Conn, error)
 }
 
+// ErrNotAllowed 目标不被规则允许, 服务端回复 ReplyConnectionNotAllowByRuleset
+var ErrNotAllowed = errors.New("<connection not allowed by ruleset>")
+
 // NewS5Protocol 协议体
 func NewS5Protocol() *S5Protocol {
 	return &S5Protocol{
@@ -54,57 +66,71 @@ func (s *S5Protocol) Server(conn io.ReadWriteCloser) {
 	buff := totalBuff[:2]
 	if _, err := s.ReadFull(conn, buff); err != nil {
 		log.Error("[authConn] Read header err: ", err)
+		metricHandshakeFailures.With("read").Inc()
 		return
 	}
 
 	if err := s.isSameVersion(buff[0]); err != nil {
 		log.Error("[authConn] isSameVersion err: ", err)
+		metricHandshakeFailures.With("version").Inc()
 		return
 	}
 
 	// methods(由之前method_counts决定)
 	methodCount := buff[1]
+	buff = totalBuff[:methodCount]
 	if methodCount > 0 {
-		buff = totalBuff[:methodCount]
 		if _, err := s.ReadFull(conn, buff); err != nil {
 			log.Error("[authConn] Read methods err: ", err)
+			metricHandshakeFailures.With("read").Inc()
 			return
 		}
-	} else {
-		buff = []byte{AuthNoAuthRequired}
-	}
-
-	var chooseAuthMethod byte
-	for _, v1 := range s.AuthMethodSupport {
-		for _, v2 := range buff {
-			if v1 == v2 {
-				chooseAuthMethod = v1
-			}
-		}
 	}
 
+	// 按服务端优先级选择认证方法, 无可用方法时返回 AuthNoAcceptMethods 并关闭链接
+	chooseAuthMethod := s.negotiate(buff)
 	if _, err := conn.Write(frame.ServerAuthResponse(s.Version, chooseAuthMethod)); err != nil {
 		log.Error("[authConn] ServerAuthResponse write err: ", err)
+		metricHandshakeFailures.With("write").Inc()
 		return
 	}
+	if chooseAuthMethod == AuthNoAcceptMethods {
+		log.Error("[authConn] no acceptable methods, client offer ", buff)
+		metricHandshakeFailures.With("no_method").Inc()
+		return
+	}
+	auth := s.authenticator(chooseAuthMethod)
 
-	switch chooseAuthMethod {
-	case AuthNoAuthRequired:
-		// 没有认证 Do Nothing
-	case AuthUsernamePasswd:
-		// 用户名密码验证
-		err := s.servAuthUsernamePasswd(conn, totalBuff[:], frame)
-		if err != nil {
-			log.Error("[authConn] servAuthUsernamePasswd err: ", err)
-			return
-		}
-
-	default:
-		log.Error("[authConn] unknown auth type ")
+	// 认证方法可能封装链接, 后续通信使用封装后的链接
+	c, err := auth.ServerAuth(s, conn)
+	if err != nil {
+		log.Error("[authConn] auth method ", chooseAuthMethod, " err: ", err)
+		metricHandshakeFailures.With("auth").Inc()
 		return
 	}
 
-	s.servHandleCommand(conn, totalBuff[:], frame)
+	// 内置认证只接受配置的用户名, 其它认证方法由链接提供用户
+	user := "anonymous"
+	if a, ok := c.(AuthenticatedConn); ok && a.AuthUser() != "" {
+		user = a.AuthUser()
+	} else if chooseAuthMethod == AuthUsernamePasswd || chooseAuthMethod == AuthHMACChallenge {
+		user = s.Username
+	}
+	s.servHandleCommand(c, totalBuff[:], frame, user)
+}
+
+// negotiate 依次检查服务端支持的认证方法(靠前者优先), 返回首个客户端也支持且已实现的方法
+// RequireAuth 时不接受 AuthNoAuthRequired
+func (s *S5Protocol) negotiate(clientMethods []byte) byte {
+	for _, method := range s.AuthMethodSupport {
+		if method == AuthNoAcceptMethods || (s.RequireAuth && method == AuthNoAuthRequired) {
+			continue
+		}
+		if byteContain(clientMethods, method) && s.authenticator(method) != nil {
+			return method
+		}
+	}
+	return AuthNoAcceptMethods
 }
 
 func (s *S5Protocol) isSameVersion(version byte) (err error) {
@@ -174,7 +200,7 @@ func (s *S5Protocol) servAuthUsernamePasswd(conn io.ReadWriteCloser, totalBuff [
 }
 
 // 处理command
-func (s *S5Protocol) servHandleCommand(conn io.ReadWriteCloser, totalBuff []byte, frame *Frame) {
+func (s *S5Protocol) servHandleCommand(conn io.ReadWriteCloser, totalBuff []byte, frame *Frame, user string) {
 	// +-----+---------+-----+
 	// | VER | COMMAND | RSV |
 	// +-----+---------+-----+
@@ -193,7 +219,7 @@ func (s *S5Protocol) servHandleCommand(conn io.ReadWriteCloser, totalBuff []byte
 
 	switch buff[1] {
 	case CmdConnect:
-		s.servDoConnect(conn, frame)
+		s.servDoConnect(conn, frame, user)
 	case CmdBind:
 		s.servDoBind(conn, frame)
 		fallthrough
@@ -201,13 +227,28 @@ func (s *S5Protocol) servHandleCommand(conn io.ReadWriteCloser, totalBuff []byte
 		s.servDoUDP(conn, frame)
 		fallthrough
 	default:
-		if _, err := conn.Write(frame.ServerCommandResponse(s.Version, ReplyCommandNotSupport, byte(0), "", "")); err != nil {
+		if _, err := s.reply(conn, frame, ReplyCommandNotSupport, "", ""); err != nil {
 			log.Error("[servHandleCommand] CommandNotSupport ", err)
 		}
 	}
 }
 
-func (s *S5Protocol) servDoConnect(conn io.ReadWriteCloser, frame *Frame) {
+// unixAllowed unix socket目标是否匹配UnixTargets, 非unix目标总是允许
+func (s *S5Protocol) unixAllowed(addr string) bool {
+	network, path := SplitNetwork(addr)
+	if network != "unix" {
+		return true
+	}
+	path = filepath.Clean(path)
+	for _, pattern := range s.UnixTargets {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *S5Protocol) servDoConnect(conn io.ReadWriteCloser, frame *Frame, user string) {
 	// +--------------+----------+----------+
 	// | ADDRESS_TYPE | BND.ADDR | BND.PORT |
 	// +--------------+----------+----------+
@@ -219,35 +260,73 @@ func (s *S5Protocol) servDoConnect(conn io.ReadWriteCloser, frame *Frame) {
 		return
 	}
 
+	// 目标地址改写
+	rewritten := false
+	if s.AddrMap != nil {
+		mapAddr, mapPort := s.AddrMap.Rewrite(addr, port)
+		if mapAddr != addr || mapPort != port {
+			log.Info("[servDoConnect] rewrite ", addr, ":", port, " -> ", mapAddr, ":", mapPort)
+			addr, port = mapAddr, mapPort
+			rewritten = true
+		}
+	}
+
 	// 测试目标是否可达 同时获取一个可用端口
-	p2, err := net.Dial("tcp", addr+":"+port)
+	dial := s.DialTarget
+	if dial == nil {
+		dial = DialAddr
+	}
+	start := time.Now()
+	var p2 net.Conn
+	// 客户端指定的unix socket须在允许列表中, addr_map改写得到的目标由服务端配置决定
+	if !rewritten && !s.unixAllowed(addr) {
+		err = fmt.Errorf("<unix target %s> %w", addr, ErrNotAllowed)
+	} else {
+		p2, err = dial(JoinAddr(addr, port))
+	}
 	if err != nil {
+		metricDialDuration.With("error").Observe(time.Since(start).Seconds())
 		log.Error("[servDoConnect] Dail err: ", err)
-		if _, err = conn.Write(frame.ServerCommandResponse(s.Version, ReplyNetworkUnreachable, byte(0), "", "")); err != nil {
+		reply := ReplyNetworkUnreachable
+		if errors.Is(err, ErrNotAllowed) {
+			reply = ReplyConnectionNotAllowByRuleset
+		}
+		if _, err = s.reply(conn, frame, reply, "", ""); err != nil {
 			log.Error("[servDoConnect] ServerCommandResponse err: ", err)
 		}
 		return
 	}
+	metricDialDuration.With("ok").Observe(time.Since(start).Seconds())
+	p2 = NewMeteredConn(p2, metricUserBytes.With(user, "download"), metricUserBytes.With(user, "upload"))
 
 	// 直连模式
 	if s.DirectMode {
 		// 响应客户端command数据包
-		if _, err = conn.Write(frame.ServerCommandResponse(s.Version, ReplySuccess, byte(0), "", "")); err != nil {
+		if _, err = s.reply(conn, frame, ReplySuccess, "", ""); err != nil {
 			log.Error("[servDoConnect] ServerCommandResponse err: ", err)
 			return
 		}
-		ProxyStream(conn, p2)
+		ProxySession(&Session{User: user, Dest: JoinAddr(addr, port)}, conn, p2)
 		return
 	}
 
 	bindIP := "0.0.0.0"
-	bindPort := strings.Split(p2.LocalAddr().String(), ":")[1]
+	_, bindPort, err := net.SplitHostPort(p2.LocalAddr().String())
+	if err != nil {
+		// unix socket没有可复用的端口, 只支持直连模式
+		log.Error("[servDoConnect] bind port err: ", err)
+		if _, err = s.reply(conn, frame, ReplyAddressTypeNotSupported, "", ""); err != nil {
+			log.Error("[servDoConnect] ServerCommandResponse err: ", err)
+		}
+		p2.Close()
+		return
+	}
 
 	// 开启端口转发监听 等待客户端连接
 	server := protocol.New(s.ConnConfig)
 	if err = server.Listen(bindIP + ":" + bindPort); err != nil {
 		log.Error("[servDoConnect] listen err: ", err)
-		if _, err = conn.Write(frame.ServerCommandResponse(s.Version, ReplySOCKSServerFailure, byte(0), "", "")); err != nil {
+		if _, err = s.reply(conn, frame, ReplySOCKSServerFailure, "", ""); err != nil {
 			log.Error("[servDoConnect] ServerCommandResponse err: ", err)
 		}
 		p2.Close()
@@ -255,7 +334,7 @@ func (s *S5Protocol) servDoConnect(conn io.ReadWriteCloser, frame *Frame) {
 	}
 
 	// 响应客户端command数据包
-	if _, err = conn.Write(frame.ServerCommandResponse(s.Version, ReplySuccess, byte(0), bindIP, bindPort)); err != nil {
+	if _, err = s.reply(conn, frame, ReplySuccess, bindIP, bindPort); err != nil {
 		log.Error("[servDoConnect] ServerCommandResponse err: ", err)
 		p2.Close()
 		server.Close()
@@ -271,12 +350,18 @@ func (s *S5Protocol) servDoConnect(conn io.ReadWriteCloser, frame *Frame) {
 			return
 		}
 
-		ProxyStream(p1, p2)
+		ProxySession(&Session{User: user, Dest: JoinAddr(addr, port)}, p1, p2)
 	}()
 
 	return
 }
 
+// reply 回复command, 按回复码计数
+func (s *S5Protocol) reply(conn io.Writer, frame *Frame, reply byte, bindAddr, bindPort string) (int, error) {
+	metricReplies.With(ReplyMessage[reply]).Inc()
+	return conn.Write(frame.ServerCommandResponse(s.Version, reply, byte(0), bindAddr, bindPort))
+}
+
 func (s *S5Protocol) servDoBind(conn io.ReadWriteCloser, frame *Frame) (err error) {
 	return
 }
@@ -285,8 +370,8 @@ func (s *S5Protocol) servDoUDP(conn io.ReadWriteCloser, frame *Frame) (err error
 	return
 }
 
-// Dial socks5发起端
-func (s *S5Protocol) Dial(conn io.ReadWriteCloser) (err error) {
+// Dial socks5发起端, 返回认证完成后用于通信的链接
+func (s *S5Protocol) Dial(conn io.ReadWriteCloser) (c io.ReadWriteCloser, err error) {
 	frame := &Frame{}
 	var totalBuff [8]byte
 
@@ -298,7 +383,7 @@ func (s *S5Protocol) Dial(conn io.ReadWriteCloser) (err error) {
 	// | 1  |    1     |  1~255   |
 	// +----+----------+----------+
 	if _, err = conn.Write(frame.ClientAuthRequest(s.Version, s.AuthMethodSupport)); err != nil {
-		return fmt.Errorf("<conn write ClientAuthRequest err: %w>", err)
+		return nil, fmt.Errorf("<conn write ClientAuthRequest err: %w>", err)
 	}
 
 	// 服务端响应握手 选择验证方式
@@ -309,28 +394,30 @@ func (s *S5Protocol) Dial(conn io.ReadWriteCloser) (err error) {
 	// +-----+--------+
 	buff := totalBuff[:2]
 	if _, err = s.ReadFull(conn, buff); err != nil {
-		return fmt.Errorf("<ServerAuthResponse readFull failed> %w ", err)
+		return nil, fmt.Errorf("<ServerAuthResponse readFull failed> %w ", err)
 	}
 
 	if err = s.isSameVersion(buff[0]); err != nil {
-		return fmt.Errorf("<ServerAuthResponse> %w", err)
+		return nil, fmt.Errorf("<ServerAuthResponse> %w", err)
 	}
 
 	// 选定鉴权方式
-	s.AuthMethodChoose = buff[1]
-	return s.clientAuth(conn, totalBuff[:], frame)
+	return s.clientAuth(conn, buff[1])
 }
 
-func (s *S5Protocol) clientAuth(conn io.ReadWriteCloser, totalBuff []byte, frame *Frame) (err error) {
-	// 无须验证
-	if s.AuthMethodChoose == AuthNoAuthRequired {
-		return nil
+func (s *S5Protocol) clientAuth(conn io.ReadWriteCloser, method byte) (io.ReadWriteCloser, error) {
+	if method == AuthNoAcceptMethods {
+		return nil, errors.New("<no acceptable methods>")
 	}
-
-	if s.AuthMethodChoose != AuthUsernamePasswd {
-		return errors.New("<unsupport auth type>")
+	auth := s.authenticator(method)
+	if auth == nil || !byteContain(s.AuthMethodSupport, method) {
+		return nil, errors.New("<unsupport auth type>")
 	}
+	return auth.ClientAuth(s, conn)
+}
 
+// 用户名密码认证
+func (s *S5Protocol) clientAuthUsernamePasswd(conn io.ReadWriteCloser, totalBuff []byte, frame *Frame) (err error) {
 	// 客户端发送验证数据包
 	// +-----+-----------------+----------+-----------------+----------+
 	// | VER | USERNAME_LENGTH | USERNAME | PASSWORD_LENGTH | PASSWORD |
@@ -370,10 +457,15 @@ func (s *S5Protocol) Connect(conn io.ReadWriteCloser, proxyAddr, dstAddr string)
 	var totalBuff [8]byte
 
 	var ip, port string
-	addr := strings.Split(dstAddr, ":")
-	ip, port = addr[0], addr[1]
-	if ip == "localhost" || ip == "" {
-		ip = "127.0.0.1"
+	if strings.HasPrefix(dstAddr, UnixPrefix) {
+		// unix socket以域名形式发送, 端口为0
+		ip, port = dstAddr, "0"
+	} else {
+		addr := strings.Split(dstAddr, ":")
+		ip, port = addr[0], addr[1]
+		if ip == "localhost" || ip == "" {
+			ip = "127.0.0.1"
+		}
 	}
 	// log.Info("[Connect] ", ip, ":", port)
 
@@ -417,33 +509,9 @@ func (s *S5Protocol) Connect(conn io.ReadWriteCloser, proxyAddr, dstAddr string)
 	return
 }
 
-// ProxyStream 转发流
+// ProxyStream 转发流, 会话不带附加信息
 func ProxyStream(p1 io.ReadWriteCloser, p2 net.Conn) {
-	defer p1.Close()
-	defer p2.Close()
-
-	if s1, ok := p1.(protocol.Stream); ok {
-		log.Info("stream open in:", s1.RemoteAddr().String(), " out:", p2.LocalAddr().String())
-		defer log.Info("stream close in:", s1.RemoteAddr().String(), " out:", p2.LocalAddr().String())
-	}
-
-	streamCopy := func(dst io.Writer, src io.ReadCloser) chan struct{} {
-		die := make(chan struct{})
-		go func() {
-			buff := s5Buf.Get().([]byte)
-			if _, err := io.CopyBuffer(dst, src, buff); err != nil {
-				log.Warn("[streamCopy] err: ", err)
-			}
-			s5Buf.Put(buff)
-			close(die)
-		}()
-		return die
-	}
-
-	select {
-	case <-streamCopy(p1, p2):
-	case <-streamCopy(p2, p1):
-	}
+	ProxySession(&Session{}, p1, p2)
 }
 
 // ReadAddress data
@@ -453,9 +521,9 @@ func ProxyStream(p1 io.ReadWriteCloser, p2 net.Conn) {
 // |           1  | 1-255    |        2 |
 // +--------------+----------+----------+
 func ReadAddress(c io.ReadWriteCloser) (addr, port string, err error) {
-	var totalBuff [16]byte
+	var totalBuff [256]byte
 	buff := totalBuff[:1]
-	if _, err = c.Read(buff); err != nil {
+	if _, err = io.ReadFull(c, buff); err != nil {
 		return
 	}
 
@@ -463,14 +531,14 @@ func ReadAddress(c io.ReadWriteCloser) (addr, port string, err error) {
 	switch addrType {
 	case AddrIPv4:
 		buff = totalBuff[:4]
-		if _, err = c.Read(buff); err != nil {
+		if _, err = io.ReadFull(c, buff); err != nil {
 			err = fmt.Errorf("<invalid ipv4 address> %w", err)
 			return
 		}
 		addr = IPv4ByteToStr(buff)
 	case AddrIPv6:
 		buff = totalBuff[:16]
-		if _, err = c.Read(buff); err != nil {
+		if _, err = io.ReadFull(c, buff); err != nil {
 			err = fmt.Errorf("<invalid ipv6 address> %w", err)
 			return
 		}
@@ -478,14 +546,14 @@ func ReadAddress(c io.ReadWriteCloser) (addr, port string, err error) {
 	case AddrDomain:
 		// 域名地址的第1个字节为域名长度, 剩下字节为域名名称字节数组
 		buff = totalBuff[:1]
-		if _, err = c.Read(buff); err != nil {
+		if _, err = io.ReadFull(c, buff); err != nil {
 			err = fmt.Errorf("<invalid domain address> %w", err)
 			return
 		}
-		domainLen := buff[1]
+		domainLen := buff[0]
+		buff = totalBuff[:domainLen]
 		if domainLen > 0 {
-			buff = totalBuff[:domainLen]
-			if _, err = c.Read(buff); err != nil {
+			if _, err = io.ReadFull(c, buff); err != nil {
 				err = fmt.Errorf("<invalid domain address> %w", err)
 				return
 			}
@@ -497,7 +565,7 @@ func ReadAddress(c io.ReadWriteCloser) (addr, port string, err error) {
 	}
 
 	buff = totalBuff[:2]
-	if _, err = c.Read(buff); err != nil {
+	if _, err = io.ReadFull(c, buff); err != nil {
 		err = fmt.Errorf("<invalid port> %w", err)
 		return
 	}